@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	aclAllow = "allow"
+	aclDeny  = "deny"
+)
+
+// ACL decides which senders may run which commands. Rules are checked in
+// order and the first match wins; Default applies when none match, except
+// for restrictedCommands, which are denied.
+type ACL struct {
+	Default string    `yaml:"default"`
+	Rules   []ACLRule `yaml:"rules"`
+}
+
+// ACLRule matches a command run by a sender in a conversation. Commands
+// are given by their name, not an alias, optionally followed by a
+// subcommand as in "home call"; "*" matches every command but the
+// restricted ones. Empty lists match anything. Channels are either a
+// channel name or "team#channel".
+type ACLRule struct {
+	Action   string   `yaml:"action"`
+	Commands []string `yaml:"commands"`
+	Users    []string `yaml:"users"`
+	Teams    []string `yaml:"teams"`
+	Channels []string `yaml:"channels"`
+}
+
+var acl = &ACL{Default: aclAllow}
+
+// restrictedCommands are denied to everyone unless a rule names them, so
+// that an ACL left out or opened up with "*" never lets anyone stop the
+// bot.
+var restrictedCommands = []string{"shutdown"}
+
+func loadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ACL file: %s", err.Error())
+	}
+
+	a := new(ACL)
+	if err := yaml.UnmarshalStrict(data, a); err != nil {
+		return nil, fmt.Errorf("could not parse ACL file: %s", err.Error())
+	}
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ACL) validate() error {
+	if a.Default == "" {
+		a.Default = aclAllow
+	}
+	if a.Default != aclAllow && a.Default != aclDeny {
+		return fmt.Errorf("invalid ACL default %q, expected allow or deny", a.Default)
+	}
+
+	for i, rule := range a.Rules {
+		if rule.Action != aclAllow && rule.Action != aclDeny {
+			return fmt.Errorf("ACL rule %d: invalid action %q, expected allow or deny", i+1, rule.Action)
+		}
+		if len(rule.Commands) == 0 {
+			return fmt.Errorf("ACL rule %d: no commands given", i+1)
+		}
+		for _, command := range rule.Commands {
+			if words := len(strings.Fields(command)); words == 0 || words > 2 {
+				return fmt.Errorf("ACL rule %d: invalid command %q, expected a command and at most one subcommand", i+1, command)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the sender of msg may run command with args.
+func (a *ACL) Allowed(command string, args []string, msg kbchat.SubscriptionMessage) bool {
+	for _, rule := range a.Rules {
+		if rule.matches(command, args, msg) {
+			return rule.Action == aclAllow
+		}
+	}
+	if containsFold(restrictedCommands, command) {
+		return false
+	}
+	return a.Default == aclAllow
+}
+
+func (r ACLRule) matches(command string, args []string, msg kbchat.SubscriptionMessage) bool {
+	if !r.covers(command, args) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsFold(r.Users, msg.Message.Sender.Username) {
+		return false
+	}
+
+	team, channel := conversationNames(msg)
+	if len(r.Teams) > 0 && !containsFold(r.Teams, team) {
+		return false
+	}
+	if len(r.Channels) > 0 && !containsFold(r.Channels, channel) && !containsFold(r.Channels, team+"#"+channel) {
+		return false
+	}
+	return true
+}
+
+// covers reports whether the rule names command, or the subcommand of it
+// given as the first of args.
+func (r ACLRule) covers(command string, args []string) bool {
+	for _, entry := range r.Commands {
+		words := strings.Fields(entry)
+		switch {
+		case entry == "*":
+			if !containsFold(restrictedCommands, command) {
+				return true
+			}
+		case len(words) == 0 || !strings.EqualFold(words[0], command):
+		case len(words) == 1:
+			return true
+		case len(args) > 0 && strings.EqualFold(words[1], args[0]):
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks cmd and its args against the ACL, replying and writing
+// an audit line when the sender is not allowed to run it.
+func authorize(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, acl *ACL, cmd Command, args []string) bool {
+	if acl.Allowed(cmd.Name(), args, msg) {
+		return true
+	}
+
+	logger.Warn("audit: command denied", "command", cmd.Name(), "sender", msg.Message.Sender.Username, "conversation", describeConversation(msg))
+	reply(kbc, msg, fmt.Sprintf("Sorry, you are not authorized to run `%s`.", cmd.Name()))
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func createTeamMessage(msg string, user string, team string, channel string) kbchat.SubscriptionMessage {
+	m := createTextMessage(msg)
+	m.Message.Sender = chat1.MsgSender{Username: user}
+	m.Message.Channel = chat1.ChatChannel{
+		Name:        team,
+		MembersType: "team",
+		TopicType:   "chat",
+		TopicName:   channel,
+	}
+	return m
+}
+
+const testACL = `
+default: allow
+rules:
+  - action: allow
+    commands: [shutdown]
+    users: [alice]
+  - action: deny
+    commands: [home call]
+    users: [bob]
+  - action: deny
+    commands: [home]
+    channels: [family#general]
+  - action: allow
+    commands: ["*"]
+    teams: [family]
+  - action: deny
+    commands: ["*"]
+    users: [mallory]
+`
+
+func TestACLAllowed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yml")
+	require.Nil(t, os.WriteFile(path, []byte(testACL), 0600))
+
+	a, err := loadACL(path)
+	require.Nil(t, err)
+
+	cases := []struct {
+		command  string
+		args     []string
+		msg      kbchat.SubscriptionMessage
+		expected bool
+	}{
+		{"shutdown", nil, createTeamMessage("shutdown", "alice", "family", "general"), true},
+		// "*" does not open up restricted commands
+		{"shutdown", nil, createTeamMessage("shutdown", "bob", "family", "general"), false},
+		{"shutdown", nil, createTextMessage("shutdown"), false},
+		{"home", nil, createTeamMessage("home", "alice", "family", "general"), false},
+		{"home", nil, createTeamMessage("home", "alice", "family", "garage"), true},
+		{"home", nil, createTeamMessage("home", "mallory", "family", "garage"), true},
+		{"home", []string{"Call", "light.turn_on"}, createTeamMessage("home call", "bob", "work", "general"), false},
+		{"home", []string{"states"}, createTeamMessage("home states", "bob", "work", "general"), true},
+		{"home", nil, createTeamMessage("home", "bob", "work", "general"), true},
+		{"ip", nil, createTeamMessage("ip", "mallory", "work", "general"), false},
+		{"ip", nil, createTeamMessage("ip", "bob", "work", "general"), true},
+		{"ip", nil, createTextMessage("ip"), true},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, a.Allowed(c.command, c.args, c.msg), "%s %v by %s", c.command, c.args, c.msg.Message.Sender.Username)
+	}
+
+	// without an ACL only the restricted commands are denied
+	a = &ACL{Default: aclAllow}
+	require.False(t, a.Allowed("shutdown", nil, createTeamMessage("shutdown", "alice", "family", "general")))
+	require.True(t, a.Allowed("home", []string{"call"}, createTeamMessage("home call", "alice", "family", "general")))
+}
+
+func TestLoadACLErrors(t *testing.T) {
+	cases := []struct {
+		content       string
+		expectedError string
+	}{
+		{"default: maybe", `invalid ACL default "maybe"`},
+		{"rules:\n  - action: permit\n    commands: [ip]", `ACL rule 1: invalid action "permit"`},
+		{"rules:\n  - action: allow", "ACL rule 1: no commands given"},
+		{"rules:\n  - action: allow\n    commands: [home call light]", `ACL rule 1: invalid command "home call light"`},
+		{"rules:\n  - action: allow\n    command: [ip]", "could not parse ACL file"},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "acl.yml")
+		require.Nil(t, os.WriteFile(path, []byte(c.content), 0600))
+
+		_, err := loadACL(path)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+
+	_, err := loadACL("itdoesnotexist.yml")
+	require.Contains(t, err.Error(), "could not read ACL file")
+}
+
+func TestHandleMessageDenied(t *testing.T) {
+	saved := acl
+	t.Cleanup(func() { acl = saved })
+
+	acl = &ACL{Default: aclAllow}
+
+	exited := false
+	setShutdownFunc(func() { exited = true })
+	t.Cleanup(func() { setShutdownFunc(nil) })
+
+	msg := createTeamMessage("bye", "mallory", "family", "general")
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "Sorry, you are not authorized to run `shutdown`.").Return(kbchat.SendResponse{}, nil)
+
+	fakeStdout := captureOutput(t, func() { handleMessage(kbc, msg, mocks.NewRequests(t)) })
+
+	require.False(t, exited)
+	require.Contains(t, fakeStdout, "audit: command denied command=shutdown sender=mallory conversation=family#general")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// parseChannel turns "team#channel" into a team channel and anything else,
+// such as "alice" or "alice,bob", into a direct conversation.
+func parseChannel(name string) chat1.ChatChannel {
+	if team, topic, ok := strings.Cut(name, "#"); ok {
+		return chat1.ChatChannel{
+			Name:        team,
+			MembersType: "team",
+			TopicType:   "chat",
+			TopicName:   topic,
+		}
+	}
+	return chat1.ChatChannel{Name: name}
+}
+
+// parseChannels parses a comma-separated list of channels.
+func parseChannels(list string) []chat1.ChatChannel {
+	var channels []chat1.ChatChannel
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			channels = append(channels, parseChannel(name))
+		}
+	}
+	return channels
+}
+
+// conversationNames returns the team and channel a message was sent in.
+// Both are empty for direct messages.
+func conversationNames(msg kbchat.SubscriptionMessage) (string, string) {
+	if msg.Message.Channel.MembersType != "team" {
+		return "", ""
+	}
+	return msg.Message.Channel.Name, msg.Message.Channel.TopicName
+}
+
+// describeConversation names a conversation for log lines.
+func describeConversation(msg kbchat.SubscriptionMessage) string {
+	team, channel := conversationNames(msg)
+	if team == "" {
+		return fmt.Sprintf("dm %s", msg.Message.Channel.Name)
+	}
+	return fmt.Sprintf("%s#%s", team, channel)
+}
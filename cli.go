@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const cliUsage = `usage: keybasebot <command> [flags]
+
+commands:
+  run [--config file]                    run the bot (the default)
+  check-config [--config file]           validate the configuration and exit
+  send --channel <channel> <text>        post a message to a conversation
+  hass get [--instance name] <path>      print a Home Assistant API response
+  secrets new-key                        print a key for the secret store
+  secrets set <name>                     store a secret read from stdin
+  version                                print the version
+
+Every command accepts --env-file (default .env).
+`
+
+// startChat connects to the Keybase service. It is a variable so tests
+// can run without one.
+var startChat = func() (KeyBaseChat, error) {
+	return kbchat.Start(kbchat.RunOptions{KeybaseLocation: kbLoc, HomeDir: kbHomeDir})
+}
+
+// stdin is read by commands taking secrets, so tests can replace it.
+var stdin io.Reader = os.Stdin
+
+// errUsage marks a command line that could not be parsed; its usage has
+// already been printed.
+var errUsage = errors.New("invalid usage")
+
+// cliCommands maps each subcommand to its implementation. They get the
+// arguments after the subcommand name and write results to stdout.
+var cliCommands = map[string]func(args []string, stdout io.Writer, stderr io.Writer) error{
+	"run":          runBot,
+	"check-config": checkConfig,
+	"send":         sendMessage,
+	"hass":         hassCli,
+	"secrets":      secretsCli,
+	"version":      printVersion,
+}
+
+// runCli runs the subcommand named by args[0] and returns the exit code.
+// Without a subcommand the bot is run.
+func runCli(args []string, stdout io.Writer, stderr io.Writer) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	}
+
+	command, ok := cliCommands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", name, cliUsage)
+		return 2
+	}
+
+	err := command(args, stdout, stderr)
+	switch {
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "keybasebot %s: %s\n", name, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// newFlagSet returns the flags shared by every subcommand. configFile is
+// only registered when the subcommand reads the config file.
+func newFlagSet(name string, stderr io.Writer, withConfig bool) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&dotenv, "env-file", dotenv, "`file` of environment variables to load first")
+
+	configFile := new(string)
+	if withConfig {
+		fs.StringVar(configFile, "config", "", "config `file`, instead of CONFIG_FILE")
+	}
+	return fs, configFile
+}
+
+// parseFlags parses args allowing flags after positional arguments, as in
+// "hass get /api/states --instance cabin", and returns the positional
+// ones.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runBot(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs, configFile := newFlagSet("run", stderr, true)
+	if positional, err := parseFlags(fs, args); err != nil || len(positional) > 0 {
+		return usageError(fs, "run takes no arguments")
+	}
+	if err := setupEnv(*configFile); err != nil {
+		return err
+	}
+
+	kbc, err := startChat()
+	if err != nil {
+		logger.Error("could not start", "error", err)
+		return err
+	}
+	if api, ok := kbc.(*kbchat.API); ok {
+		botUsername = api.GetUsername()
+		setKVStore(api)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if monitoringListen != "" {
+		if _, err := startMonitoring(ctx, monitoringListen); err != nil {
+			logger.Error("could not start", "error", err)
+			return err
+		}
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for range hangups {
+			requestReload()
+		}
+	}()
+
+	httpReq = configuredRequests{}
+	if err := mainLoop(ctx, kbc, httpReq); err != nil {
+		logger.Error("bot stopped", "error", err)
+		return err
+	}
+	return nil
+}
+
+func checkConfig(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs, configFile := newFlagSet("check-config", stderr, true)
+	if positional, err := parseFlags(fs, args); err != nil || len(positional) > 0 {
+		return usageError(fs, "check-config takes no arguments")
+	}
+	if err := setupEnv(*configFile); err != nil {
+		return err
+	}
+
+	source := configPath
+	if source == "" {
+		source = "environment"
+	}
+	fmt.Fprintf(stdout, "%s: OK (%d Home Assistant instances, %d ACL rules, %d alert rules, %d DDNS records, %d jobs)\n",
+		source, len(hassInstances), len(acl.Rules), len(alertRules), len(ddnsRecords), len(scheduledJobs))
+	return nil
+}
+
+func sendMessage(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs, configFile := newFlagSet("send", stderr, true)
+	channel := fs.String("channel", "", "`conversation` to post to, e.g. team#channel or a username")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	text := strings.Join(positional, " ")
+	if *channel == "" || text == "" {
+		return usageError(fs, "usage: keybasebot send --channel <channel> <text>")
+	}
+	if err := setupEnv(*configFile); err != nil {
+		return err
+	}
+
+	kbc, err := startChat()
+	if err != nil {
+		return err
+	}
+	if _, err := kbc.SendMessage(parseChannel(*channel), redactSecrets(text)); err != nil {
+		return fmt.Errorf("could not send message: %s", err.Error())
+	}
+	return nil
+}
+
+func hassCli(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs, configFile := newFlagSet("hass", stderr, true)
+	instanceName := fs.String("instance", "", "named Home Assistant `instance` to query")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 || positional[0] != "get" {
+		return usageError(fs, "usage: keybasebot hass get [--instance name] <path>")
+	}
+	if err := setupEnv(*configFile); err != nil {
+		return err
+	}
+
+	hass, ok := hassInstances[strings.ToLower(*instanceName)]
+	if !ok {
+		return fmt.Errorf("unknown Home Assistant instance %q", *instanceName)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(positional[1], "/"), "api/")
+
+	var response json.RawMessage
+	if err := fetchFromHass(hass.requests(newHttpRequests(nil)), hass.endpoint(path), hass.Token, &response); err != nil {
+		return err
+	}
+	var output bytes.Buffer
+	if err := json.Indent(&output, response, "", "  "); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, redactSecrets(output.String()))
+	return nil
+}
+
+func secretsCli(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs, configFile := newFlagSet("secrets", stderr, true)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(positional) == 1 && positional[0] == "new-key":
+		key, err := newSecretKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, key)
+		return nil
+	case len(positional) == 2 && positional[0] == "set":
+	default:
+		return usageError(fs, "usage: keybasebot secrets new-key | secrets set <name>")
+	}
+
+	// the rest of the configuration may refer to the secret being set,
+	// so only the store settings are read
+	godotenv.Load(dotenv)
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	storePath, keyFile, err := secretStoreSettings(*configFile, os.Getenv)
+	if err != nil {
+		return err
+	}
+	if storePath == "" {
+		return errors.New("no secret store configured, set secrets.store or SECRETS_STORE")
+	}
+	store, err := openSecretStore(storePath, keyFile)
+	if err != nil {
+		return err
+	}
+
+	value, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	value = strings.TrimRight(value, "\r\n")
+	if value == "" {
+		return errors.New("no secret given on stdin")
+	}
+	if err := store.Set(positional[1], value); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "stored secret %s, refer to it as store:%s\n", positional[1], positional[1])
+	return nil
+}
+
+func printVersion(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs, _ := newFlagSet("version", stderr, false)
+	if positional, err := parseFlags(fs, args); err != nil || len(positional) > 0 {
+		return usageError(fs, "version takes no arguments")
+	}
+	fmt.Fprintf(stdout, "keybasebot %s\n", version)
+	return nil
+}
+
+// usageError prints message and the flags of fs.
+func usageError(fs *flag.FlagSet, message string) error {
+	fmt.Fprintln(fs.Output(), message)
+	fs.PrintDefaults()
+	return errUsage
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+// runTestCli runs the command line args without a .env file and returns
+// the exit code, stdout and stderr.
+func runTestCli(t *testing.T, args ...string) (int, string, string) {
+	useGlobals(t)
+	saved := dotenv
+	t.Cleanup(func() { dotenv = saved })
+	dotenv = "itdoesnotexist"
+
+	var stdout, stderr bytes.Buffer
+	var code int
+	captureOutput(t, func() { code = runCli(args, &stdout, &stderr) })
+	return code, stdout.String(), stderr.String()
+}
+
+func useStartChat(t *testing.T, kbc KeyBaseChat) {
+	saved := startChat
+	t.Cleanup(func() { startChat = saved })
+	startChat = func() (KeyBaseChat, error) { return kbc, nil }
+}
+
+func TestRunCliUsage(t *testing.T) {
+	code, stdout, _ := runTestCli(t, "help")
+	require.Equal(t, 0, code)
+	require.Contains(t, stdout, "usage: keybasebot <command> [flags]")
+
+	code, _, stderr := runTestCli(t, "frobnicate")
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, `unknown command "frobnicate"`)
+
+	code, _, stderr = runTestCli(t, "check-config", "--nope")
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, "flag provided but not defined: -nope")
+
+	code, _, stderr = runTestCli(t, "send", "--channel", "home")
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr, "usage: keybasebot send --channel <channel> <text>")
+}
+
+func TestVersion(t *testing.T) {
+	code, stdout, _ := runTestCli(t, "version")
+	require.Equal(t, 0, code)
+	require.Equal(t, "keybasebot dev\n", stdout)
+}
+
+func TestCheckConfig(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	code, stdout, _ := runTestCli(t, "check-config", "--config", path)
+	require.Equal(t, 0, code)
+	require.Equal(t, path+": OK (2 Home Assistant instances, 1 ACL rules, 1 alert rules, 1 DDNS records, 0 jobs)\n", stdout)
+
+	code, _, stderr := runTestCli(t, "check-config", "--config", writeConfig(t, "workers: 0\n"))
+	require.Equal(t, 1, code)
+	require.Contains(t, stderr, "workers and queue_depth must be at least 1")
+}
+
+func TestSendMessage(t *testing.T) {
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", parseChannel("home#general"), "back in five").Return(kbchat.SendResponse{}, nil)
+	useStartChat(t, kbc)
+
+	code, _, stderr := runTestCli(t, "send", "--channel", "home#general", "back", "in five")
+	require.Equal(t, 0, code, stderr)
+}
+
+func TestHassCli(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cliToken123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"path": %q}`, r.URL.Path)
+	}))
+	defer server.Close()
+	path := writeConfig(t, fmt.Sprintf("home_assistant:\n  instances:\n    cabin:\n      url: %s\n      token: cliToken123\n", server.URL))
+
+	code, stdout, stderr := runTestCli(t, "hass", "get", "/api/states", "--instance", "cabin", "--config", path)
+	require.Equal(t, 0, code, stderr)
+	require.Equal(t, "{\n  \"path\": \"/api/states\"\n}\n", stdout)
+
+	code, _, stderr = runTestCli(t, "hass", "get", "states", "--instance", "attic", "--config", path)
+	require.Equal(t, 1, code)
+	require.Equal(t, "keybasebot hass: unknown Home Assistant instance \"attic\"\n", stderr)
+
+	code, _, _ = runTestCli(t, "hass", "post", "states")
+	require.Equal(t, 2, code)
+}
+
+func TestSecretsCli(t *testing.T) {
+	useSecrets(t)
+	code, key, _ := runTestCli(t, "secrets", "new-key")
+	require.Equal(t, 0, code)
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	require.Nil(t, os.WriteFile(keyFile, []byte(key), 0o600))
+	storePath := filepath.Join(dir, "secrets.enc")
+	path := writeConfig(t, fmt.Sprintf("secrets:\n  store: %s\n  key_file: %s\nhome_assistant:\n  token: store:hass\n", storePath, keyFile))
+
+	saved := stdin
+	t.Cleanup(func() { stdin = saved })
+	stdin = strings.NewReader("storedToken123\n")
+
+	code, stdout, stderr := runTestCli(t, "secrets", "set", "hass", "--config", path)
+	require.Equal(t, 0, code, stderr)
+	require.Equal(t, "stored secret hass, refer to it as store:hass\n", stdout)
+
+	code, _, stderr = runTestCli(t, "check-config", "--config", path)
+	require.Equal(t, 0, code, stderr)
+
+	stdin = io.MultiReader()
+	code, _, stderr = runTestCli(t, "secrets", "set", "hass", "--config", path)
+	require.Equal(t, 1, code)
+	require.Equal(t, "keybasebot secrets: no secret given on stdin\n", stderr)
+}
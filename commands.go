@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// commandPrefix may optionally precede a command keyword, e.g. "!ip".
+const commandPrefix = "!"
+
+// HandlerFunc runs a command for a single chat message. args holds the
+// whitespace-separated words that followed the command keyword.
+type HandlerFunc func(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error
+
+type Command interface {
+	Name() string
+	Aliases() []string
+	Args() []ArgSpec
+	Description() string
+	Run(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error
+}
+
+// ArgSpec describes one positional argument of a command.
+type ArgSpec struct {
+	Name     string
+	Optional bool
+	Variadic bool
+}
+
+func (a ArgSpec) String() string {
+	name := a.Name
+	if a.Variadic {
+		name += "..."
+	}
+	if a.Optional {
+		return fmt.Sprintf("[%s]", name)
+	}
+	return fmt.Sprintf("<%s>", name)
+}
+
+// SimpleCommand is a Command backed by plain fields and a HandlerFunc.
+type SimpleCommand struct {
+	CommandName string
+	AliasNames  []string
+	ArgSpecs    []ArgSpec
+	Summary     string
+	Handler     HandlerFunc
+}
+
+func (s *SimpleCommand) Name() string {
+	return s.CommandName
+}
+
+func (s *SimpleCommand) Aliases() []string {
+	return s.AliasNames
+}
+
+func (s *SimpleCommand) Args() []ArgSpec {
+	return s.ArgSpecs
+}
+
+func (s *SimpleCommand) Description() string {
+	return s.Summary
+}
+
+func (s *SimpleCommand) Run(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	return s.Handler(kbc, msg, httpReq, args)
+}
+
+// usage renders the argument syntax of a command, e.g. "home [path...]".
+func usage(cmd Command) string {
+	parts := []string{cmd.Name()}
+	for _, arg := range cmd.Args() {
+		parts = append(parts, arg.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// checkArgs verifies that args satisfies the argument spec of cmd.
+func checkArgs(cmd Command, args []string) error {
+	required := 0
+	variadic := false
+	for _, spec := range cmd.Args() {
+		if !spec.Optional {
+			required++
+		}
+		if spec.Variadic {
+			variadic = true
+		}
+	}
+
+	if len(args) < required || (!variadic && len(args) > len(cmd.Args())) {
+		return fmt.Errorf("usage: %s", usage(cmd))
+	}
+	return nil
+}
+
+// rawArgs returns the text of msg after its first n words with the
+// original spacing kept, for arguments that are free text rather than
+// words.
+func rawArgs(msg kbchat.SubscriptionMessage, n int) string {
+	if msg.Message.Content.Text == nil {
+		return ""
+	}
+
+	text := strings.TrimSpace(msg.Message.Content.Text.Body)
+	for i := 0; i < n; i++ {
+		end := strings.IndexFunc(text, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		text = strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+	}
+	return text
+}
+
+type CommandRegistry struct {
+	commands []Command
+	keywords map[string]Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		keywords: make(map[string]Command),
+	}
+}
+
+// Register adds cmd to the registry under its name and all of its aliases.
+func (r *CommandRegistry) Register(cmd Command) error {
+	keywords := append([]string{cmd.Name()}, cmd.Aliases()...)
+	for _, keyword := range keywords {
+		keyword = strings.ToLower(keyword)
+		if existing, ok := r.keywords[keyword]; ok {
+			return fmt.Errorf("keyword %q of command %q already registered by %q", keyword, cmd.Name(), existing.Name())
+		}
+	}
+
+	for _, keyword := range keywords {
+		r.keywords[strings.ToLower(keyword)] = cmd
+	}
+	r.commands = append(r.commands, cmd)
+	return nil
+}
+
+// MustRegister is like Register but panics on conflicting keywords.
+func (r *CommandRegistry) MustRegister(cmd Command) {
+	if err := r.Register(cmd); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup finds a command by its name or one of its aliases. A trailing
+// "@target" on the keyword is ignored here; see commandTarget.
+func (r *CommandRegistry) Lookup(keyword string) (Command, bool) {
+	keyword, _, _ = strings.Cut(strings.TrimPrefix(keyword, commandPrefix), "@")
+	cmd, ok := r.keywords[strings.ToLower(keyword)]
+	return cmd, ok
+}
+
+// Match splits input into a leading keyword and arguments and returns the
+// command registered for that keyword.
+func (r *CommandRegistry) Match(input string) (Command, []string, bool) {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return nil, nil, false
+	}
+
+	cmd, ok := r.Lookup(fields[0])
+	if !ok {
+		return nil, nil, false
+	}
+	return cmd, fields[1:], true
+}
+
+// Commands returns every registered command in registration order.
+func (r *CommandRegistry) Commands() []Command {
+	return r.commands
+}
+
+var commands = defaultCommands()
+
+func defaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+
+	r.MustRegister(&SimpleCommand{
+		CommandName: "ip",
+		Summary:     "Show the bot's public IPv4 and IPv6 addresses",
+		Handler:     ipCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "shutdown",
+		AliasNames:  []string{"bye"},
+		Summary:     "Stop the bot after finishing in-flight commands",
+		Handler:     shutdownCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "home",
+		AliasNames:  []string{"hass"},
+		ArgSpecs:    []ArgSpec{{Name: "path", Optional: true, Variadic: true}},
+		Summary:     "Query Home Assistant: `home state <entity>`, `home states [pattern]`, `home history <entity> [since 6h]`, `home logbook [entity] [since 6h]`, `home call <service> [key=value...]`, `home template <template>` or a raw API path; use `home@<instance>` for a named instance",
+		Handler:     homeCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "ddns",
+		ArgSpecs:    []ArgSpec{{Name: "status", Optional: true}},
+		Summary:     "Show when each dynamic DNS record was last updated",
+		Handler:     ddnsCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "remind",
+		ArgSpecs:    []ArgSpec{{Name: "me|#channel"}, {Name: "when"}, {Name: "text", Variadic: true}},
+		Summary:     "Set a reminder, e.g. `remind me in 2h close the garage` or `remind #general tomorrow 9am standup`",
+		Handler:     remindCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "reminders",
+		ArgSpecs:    []ArgSpec{{Name: "action", Optional: true}, {Name: "argument", Optional: true}},
+		Summary:     "List your reminders, `reminders cancel <id>` or `reminders timezone [zone]`",
+		Handler:     remindersCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "jobs",
+		ArgSpecs:    []ArgSpec{{Name: "action", Optional: true}, {Name: "name", Optional: true}},
+		Summary:     "List scheduled jobs, or `jobs pause|resume|run-now <name>`",
+		Handler:     jobsCommand,
+	})
+	r.MustRegister(&SimpleCommand{
+		CommandName: "help",
+		AliasNames:  []string{"?"},
+		ArgSpecs:    []ArgSpec{{Name: "command", Optional: true}},
+		Summary:     "List commands, or show usage of one command",
+		Handler:     helpHandler(r),
+	})
+
+	return r
+}
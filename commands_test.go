@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+func noopHandler(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	return nil
+}
+
+func TestCommandRegistryMatch(t *testing.T) {
+	cases := []struct {
+		input        string
+		expectedName string
+		expectedArgs []string
+	}{
+		{"ip", "ip", []string{}},
+		{"!ip", "ip", []string{}},
+		{"IP", "ip", []string{}},
+		{"shipment", "", nil},
+		{"homework", "", nil},
+		{"home states", "home", []string{"states"}},
+		{"hass  config  core", "home", []string{"config", "core"}},
+		{"!home", "home", []string{}},
+		{"", "", nil},
+		{"what is my ip", "", nil},
+	}
+
+	for _, c := range cases {
+		cmd, args, ok := commands.Match(c.input)
+		if c.expectedName == "" {
+			require.False(t, ok, c.input)
+			require.Nil(t, cmd)
+			continue
+		}
+		require.True(t, ok, c.input)
+		require.Equal(t, c.expectedName, cmd.Name())
+		require.Equal(t, c.expectedArgs, args)
+	}
+}
+
+func TestCommandRegistryRegister(t *testing.T) {
+	r := NewCommandRegistry()
+
+	require.Nil(t, r.Register(&SimpleCommand{CommandName: "ping", AliasNames: []string{"p"}, Handler: noopHandler}))
+
+	err := r.Register(&SimpleCommand{CommandName: "pong", AliasNames: []string{"P"}, Handler: noopHandler})
+	require.Contains(t, err.Error(), `keyword "p" of command "pong" already registered by "ping"`)
+
+	_, ok := r.Lookup("pong")
+	require.False(t, ok)
+	require.Len(t, r.Commands(), 1)
+
+	require.Panics(t, func() {
+		r.MustRegister(&SimpleCommand{CommandName: "ping", Handler: noopHandler})
+	})
+}
+
+func TestCheckArgs(t *testing.T) {
+	cmd := &SimpleCommand{
+		CommandName: "call",
+		ArgSpecs: []ArgSpec{
+			{Name: "service"},
+			{Name: "data", Optional: true, Variadic: true},
+		},
+	}
+	fixed := &SimpleCommand{
+		CommandName: "state",
+		ArgSpecs:    []ArgSpec{{Name: "entity"}},
+	}
+
+	require.Equal(t, "call <service> [data...]", usage(cmd))
+	require.Equal(t, "state <entity>", usage(fixed))
+
+	require.Nil(t, checkArgs(cmd, []string{"light.turn_on"}))
+	require.Nil(t, checkArgs(cmd, []string{"light.turn_on", "a=1", "b=2"}))
+	require.EqualError(t, checkArgs(cmd, []string{}), "usage: call <service> [data...]")
+	require.Nil(t, checkArgs(fixed, []string{"sensor.temp"}))
+	require.EqualError(t, checkArgs(fixed, []string{"a", "b"}), "usage: state <entity>")
+}
+
+func TestHandleMessageUsage(t *testing.T) {
+	commands.MustRegister(&SimpleCommand{
+		CommandName: "needsarg",
+		ArgSpecs:    []ArgSpec{{Name: "thing"}},
+		Handler:     noopHandler,
+	})
+	t.Cleanup(func() { commands = defaultCommands() })
+
+	msg := createTextMessage("needsarg")
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "usage: needsarg <thing>").Return(kbchat.SendResponse{}, nil)
+
+	handleMessage(kbc, msg, mocks.NewRequests(t))
+}
+
+func TestRawArgs(t *testing.T) {
+	require.Equal(t, "{{ states('sensor.power') }}  W", rawArgs(createTextMessage("home template {{ states('sensor.power') }}  W"), 2))
+	require.Equal(t, "a  b", rawArgs(createTextMessage("  echo\ta  b "), 1))
+	require.Equal(t, "", rawArgs(createTextMessage("home template"), 2))
+	require.Equal(t, "", rawArgs(createNonTextMessage(""), 1))
+}
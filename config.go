@@ -0,0 +1,659 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"gopkg.in/yaml.v2"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+var configPollInterval = 5 * time.Second
+
+// Config is the layout of the YAML config file named by CONFIG_FILE. Every
+// setting can also be given, or overridden, by the environment variable
+// noted next to it.
+type Config struct {
+	Keybase struct {
+		Location string `yaml:"location"` // KB_LOCATION
+		HomeDir  string `yaml:"home_dir"` // KB_HOME_DIR
+	} `yaml:"keybase"`
+
+	Log struct {
+		Level  string `yaml:"level"`  // LOG_LEVEL
+		Format string `yaml:"format"` // LOG_FORMAT
+	} `yaml:"log"`
+
+	Workers           int `yaml:"workers"`            // WORKERS
+	QueueDepth        int `yaml:"queue_depth"`        // QUEUE_DEPTH
+	ReconnectAttempts int `yaml:"reconnect_attempts"` // RECONNECT_MAX_ATTEMPTS
+
+	HTTP struct {
+		Timeout        time.Duration `yaml:"timeout"`         // HTTP_TIMEOUT
+		ConnectTimeout time.Duration `yaml:"connect_timeout"` // HTTP_CONNECT_TIMEOUT
+		Retries        int           `yaml:"retries"`         // HTTP_RETRIES
+	} `yaml:"http"`
+
+	// HomeAssistant holds the default instance inline and named ones
+	// under instances; see hassSettingsFromEnv for the variables.
+	HomeAssistant struct {
+		hassSettings `yaml:",inline"`
+		Instances    map[string]hassSettings `yaml:"instances"`
+	} `yaml:"home_assistant"`
+
+	// Secrets configures the encrypted store for "store:" references.
+	// Tokens anywhere in the config may refer to a secret instead of
+	// holding it; see secretResolver.
+	Secrets struct {
+		Store   string `yaml:"store"`    // SECRETS_STORE
+		KeyFile string `yaml:"key_file"` // SECRETS_KEY_FILE
+	} `yaml:"secrets"`
+
+	ACL *ACL `yaml:"acl"` // ACL_FILE
+
+	Channels struct {
+		Notify []string `yaml:"notify"` // NOTIFY_CHANNELS
+		IP     []string `yaml:"ip"`     // IP_NOTIFY_CHANNELS
+	} `yaml:"channels"`
+
+	Alerts []*alertRule `yaml:"alerts"` // ALERTS_FILE
+
+	IP struct {
+		Providers     []string      `yaml:"providers"`      // IP_PROVIDERS
+		Consensus     int           `yaml:"consensus"`      // IP_CONSENSUS
+		WatchInterval time.Duration `yaml:"watch_interval"` // IP_WATCH_INTERVAL
+	} `yaml:"ip"`
+
+	DDNS []*ddnsRecord `yaml:"ddns"` // DDNS_FILE
+
+	Jobs []*job `yaml:"jobs"`
+
+	Reminders struct {
+		Timezone string `yaml:"timezone"` // REMINDERS_TIMEZONE
+	} `yaml:"reminders"`
+
+	State storageSettings `yaml:"state"`
+
+	RateLimits rateLimits `yaml:"rate_limits"`
+
+	Monitoring struct {
+		Listen string `yaml:"listen"` // MONITORING_LISTEN
+	} `yaml:"monitoring"`
+
+	logLevel         Level
+	hass             map[string]*hassInstance
+	notifyChannels   []chat1.ChatChannel
+	ipNotifyChannels []chat1.ChatChannel
+	ipProviders      []ipProvider
+	storage          Storage
+	reminderLocation *time.Location
+}
+
+var (
+	// defaultConfig holds the built-in settings, so that a setting removed
+	// from the config file goes back to its default on reload.
+	defaultConfig = builtinConfig()
+
+	// configPath is the config file in use, if any.
+	configPath string
+
+	// configMu guards the globals apply writes. Code that runs while a
+	// reload may happen reads them through snapshotConfig.
+	configMu sync.RWMutex
+
+	kbHomeDir string
+)
+
+func builtinConfig() Config {
+	var c Config
+	c.Workers = workerCount
+	c.QueueDepth = queueDepth
+	c.ReconnectAttempts = reconnectPolicy.MaxAttempts
+	c.HTTP.Timeout = httpTimeout
+	c.HTTP.ConnectTimeout = httpConnectTimeout
+	c.HTTP.Retries = httpRetries
+	c.IP.Consensus = ipConsensus
+	c.IP.WatchInterval = ipWatchInterval
+	c.ipProviders = ipProviders
+	c.State = storageSettings{Backend: storageFile, File: "state.json"}
+	return c
+}
+
+// loadConfig reads the config file at path, if given, applies environment
+// overrides from getenv and validates the result.
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	c := new(Config)
+	*c = defaultConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %s", err.Error())
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("could not parse config file %s: %s", path, err.Error())
+		}
+	}
+
+	if err := c.overrideFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if err := c.validate(getenv); err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("config file %s: %s", path, err.Error())
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// secretStoreSettings returns the secret store and key file from the
+// config file at path, if any, and the environment, without loading the
+// rest of the configuration.
+func secretStoreSettings(path string, getenv func(string) string) (string, string, error) {
+	c := new(Config)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read config file: %s", err.Error())
+		}
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return "", "", fmt.Errorf("could not parse config file %s: %s", path, err.Error())
+		}
+	}
+
+	store, keyFile := c.Secrets.Store, c.Secrets.KeyFile
+	if value := getenv("SECRETS_STORE"); value != "" {
+		store = value
+	}
+	if value := getenv("SECRETS_KEY_FILE"); value != "" {
+		keyFile = value
+	}
+	return store, keyFile, nil
+}
+
+func (c *Config) overrideFromEnv(getenv func(string) string) error {
+	for name, target := range map[string]*string{
+		"KB_LOCATION": &c.Keybase.Location,
+		"KB_HOME_DIR": &c.Keybase.HomeDir,
+		"LOG_LEVEL":   &c.Log.Level,
+		"LOG_FORMAT":  &c.Log.Format,
+
+		"SECRETS_STORE":    &c.Secrets.Store,
+		"SECRETS_KEY_FILE": &c.Secrets.KeyFile,
+
+		"STATE_BACKEND": &c.State.Backend,
+		"STATE_FILE":    &c.State.File,
+		"STATE_TEAM":    &c.State.Team,
+
+		"REMINDERS_TIMEZONE": &c.Reminders.Timezone,
+		"MONITORING_LISTEN":  &c.Monitoring.Listen,
+	} {
+		if value := getenv(name); value != "" {
+			*target = value
+		}
+	}
+
+	for name, target := range map[string]*int{
+		"WORKERS":                &c.Workers,
+		"QUEUE_DEPTH":            &c.QueueDepth,
+		"RECONNECT_MAX_ATTEMPTS": &c.ReconnectAttempts,
+		"HTTP_RETRIES":           &c.HTTP.Retries,
+		"IP_CONSENSUS":           &c.IP.Consensus,
+	} {
+		if raw := getenv(name); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, raw)
+			}
+			*target = value
+		}
+	}
+
+	for name, target := range map[string]*time.Duration{
+		"HTTP_TIMEOUT":         &c.HTTP.Timeout,
+		"HTTP_CONNECT_TIMEOUT": &c.HTTP.ConnectTimeout,
+		"IP_WATCH_INTERVAL":    &c.IP.WatchInterval,
+	} {
+		if raw := getenv(name); raw != "" {
+			value, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, raw)
+			}
+			*target = value
+		}
+	}
+
+	for name, target := range map[string]**rateLimit{
+		"RATE_LIMIT_USER":         &c.RateLimits.User,
+		"RATE_LIMIT_CONVERSATION": &c.RateLimits.Conversation,
+	} {
+		if raw := getenv(name); raw != "" {
+			value, err := parseRateLimit(raw)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q, expected e.g. 10/1m", name, raw)
+			}
+			*target = &value
+		}
+	}
+
+	for name, target := range map[string]*[]string{
+		"NOTIFY_CHANNELS":    &c.Channels.Notify,
+		"IP_NOTIFY_CHANNELS": &c.Channels.IP,
+		"IP_PROVIDERS":       &c.IP.Providers,
+	} {
+		if raw := getenv(name); raw != "" {
+			*target = strings.Split(raw, ",")
+		}
+	}
+
+	base := map[string]hassSettings{"": c.HomeAssistant.hassSettings}
+	for name, instance := range c.HomeAssistant.Instances {
+		base[name] = instance
+	}
+	settings, err := hassSettingsFromEnv(base, getenv)
+	if err != nil {
+		return err
+	}
+	c.HomeAssistant.hassSettings = settings[""]
+	delete(settings, "")
+	c.HomeAssistant.Instances = settings
+
+	if path := getenv("ACL_FILE"); path != "" {
+		if c.ACL, err = loadACL(path); err != nil {
+			return err
+		}
+	}
+	if path := getenv("ALERTS_FILE"); path != "" {
+		if c.Alerts, err = loadAlertRules(path); err != nil {
+			return err
+		}
+	}
+	if path := getenv("DDNS_FILE"); path != "" {
+		if c.DDNS, err = loadDdnsRecords(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate(getenv func(string) string) error {
+	c.logLevel = LevelInfo
+	if c.Log.Level != "" {
+		level, err := parseLevel(c.Log.Level)
+		if err != nil {
+			return fmt.Errorf("log: %s", err.Error())
+		}
+		c.logLevel = level
+	}
+	if c.Log.Format != "" && c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log: unknown format %q, expected text or json", c.Log.Format)
+	}
+
+	if c.Workers < 1 || c.QueueDepth < 1 {
+		return fmt.Errorf("workers and queue_depth must be at least 1")
+	}
+	if c.ReconnectAttempts < 0 {
+		return fmt.Errorf("reconnect_attempts must not be negative")
+	}
+	if c.HTTP.Timeout <= 0 || c.HTTP.ConnectTimeout <= 0 {
+		return fmt.Errorf("http: timeouts must be positive")
+	}
+	if c.HTTP.Retries < 0 {
+		return fmt.Errorf("http: retries must not be negative")
+	}
+	if c.Monitoring.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Monitoring.Listen); err != nil {
+			return fmt.Errorf("monitoring: invalid listen address %q, e.g. :9090", c.Monitoring.Listen)
+		}
+	}
+
+	if err := c.resolveSecrets(getenv); err != nil {
+		return fmt.Errorf("secrets: %s", err.Error())
+	}
+
+	settings := map[string]hassSettings{"": c.HomeAssistant.hassSettings}
+	for name, instance := range c.HomeAssistant.Instances {
+		settings[name] = instance
+	}
+	var err error
+	if c.hass, err = buildHassInstances(settings); err != nil {
+		return fmt.Errorf("home_assistant: %s", err.Error())
+	}
+
+	if c.ACL == nil {
+		c.ACL = &ACL{Default: aclAllow}
+	}
+	if err := c.ACL.validate(); err != nil {
+		return fmt.Errorf("acl: %s", err.Error())
+	}
+
+	c.notifyChannels = parseChannels(strings.Join(c.Channels.Notify, ","))
+	c.ipNotifyChannels = parseChannels(strings.Join(c.Channels.IP, ","))
+
+	if err := validateAlertRules(c.Alerts); err != nil {
+		return fmt.Errorf("alerts: %s", err.Error())
+	}
+	for _, rule := range c.Alerts {
+		if _, ok := c.hass[rule.Instance]; !ok {
+			return fmt.Errorf("alerts: unknown Home Assistant instance %q", rule.Instance)
+		}
+	}
+
+	if len(c.IP.Providers) > 0 {
+		providers, err := parseIpProviders(strings.Join(c.IP.Providers, ","))
+		if err != nil {
+			return fmt.Errorf("ip: %s", err.Error())
+		}
+		c.ipProviders = providers
+	}
+	if c.IP.Consensus < 1 {
+		return fmt.Errorf("ip: consensus must be at least 1")
+	}
+	if c.IP.WatchInterval < 0 {
+		return fmt.Errorf("ip: watch_interval must not be negative")
+	}
+
+	if err := validateDdnsRecords(c.DDNS); err != nil {
+		return fmt.Errorf("ddns: %s", err.Error())
+	}
+	if len(c.DDNS) > 0 && c.IP.WatchInterval == 0 {
+		c.IP.WatchInterval = defaultDdnsInterval
+	}
+
+	if err := c.RateLimits.validate(); err != nil {
+		return fmt.Errorf("rate_limits: %s", err.Error())
+	}
+
+	if err := validateJobs(c.Jobs); err != nil {
+		return fmt.Errorf("jobs: %s", err.Error())
+	}
+
+	c.reminderLocation = time.Local
+	if c.Reminders.Timezone != "" {
+		if c.reminderLocation, err = time.LoadLocation(c.Reminders.Timezone); err != nil {
+			return fmt.Errorf("reminders: unknown timezone %q", c.Reminders.Timezone)
+		}
+	}
+
+	if err := c.State.validate(); err != nil {
+		return fmt.Errorf("state: %s", err.Error())
+	}
+	return nil
+}
+
+// openState opens the state storage c names, unless it is the one already
+// open, so that only a change of the state settings reopens it.
+func (c *Config) openState() error {
+	if c.State == stateSettings {
+		return nil
+	}
+	storage, err := openStorage(c.State)
+	if err != nil {
+		return fmt.Errorf("state: %s", err.Error())
+	}
+	c.storage = storage
+	return nil
+}
+
+// resolveSecrets replaces secret references in tokens with their values.
+func (c *Config) resolveSecrets(getenv func(string) string) error {
+	var store *secretStore
+	if c.Secrets.Store != "" {
+		var err error
+		if store, err = openSecretStore(c.Secrets.Store, c.Secrets.KeyFile); err != nil {
+			return err
+		}
+	}
+	resolver := newSecretResolver(getenv, store)
+
+	if err := resolver.resolve(&c.HomeAssistant.Token); err != nil {
+		return fmt.Errorf("home_assistant token: %s", err.Error())
+	}
+	for name, instance := range c.HomeAssistant.Instances {
+		if err := resolver.resolve(&instance.Token); err != nil {
+			return fmt.Errorf("home_assistant instance %q token: %s", name, err.Error())
+		}
+		c.HomeAssistant.Instances[name] = instance
+	}
+	for i, record := range c.DDNS {
+		for _, ref := range []*string{&record.Token, &record.TsigSecret} {
+			if err := resolver.resolve(ref); err != nil {
+				return fmt.Errorf("DDNS record %d: %s", i+1, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// apply makes c the running configuration, switching to the storage
+// opened by openState if there is one. Callers other than setupEnv must
+// hold configMu.
+func (c *Config) apply() {
+	kbLoc = c.Keybase.Location
+	kbHomeDir = c.Keybase.HomeDir
+
+	if structured, ok := logger.(*StructuredLogger); ok {
+		structured.SetOptions(c.logLevel, c.Log.Format)
+	}
+
+	workerCount = c.Workers
+	queueDepth = c.QueueDepth
+	reconnectPolicy.MaxAttempts = c.ReconnectAttempts
+
+	rebuild := c.HTTP.Timeout != httpTimeout || c.HTTP.ConnectTimeout != httpConnectTimeout || c.HTTP.Retries != httpRetries
+	httpTimeout = c.HTTP.Timeout
+	httpConnectTimeout = c.HTTP.ConnectTimeout
+	httpRetries = c.HTTP.Retries
+	if rebuild {
+		sharedClient = newHttpRequests(nil)
+	}
+	for _, instance := range c.hass {
+		instance.newClient()
+	}
+	hassInstances = c.hass
+
+	acl = c.ACL
+	notifyChannels = c.notifyChannels
+	ipNotifyChannels = c.ipNotifyChannels
+	alertRules = c.Alerts
+	ipProviders = c.ipProviders
+	ipConsensus = c.IP.Consensus
+	ipWatchInterval = c.IP.WatchInterval
+	for _, record := range c.DDNS {
+		for _, old := range ddnsRecords {
+			if old.Hostname == record.Hostname && strings.EqualFold(old.Backend, record.Backend) {
+				record.inherit(old)
+			}
+		}
+	}
+	ddnsRecords = c.DDNS
+
+	for _, j := range c.Jobs {
+		for _, old := range scheduledJobs {
+			if old.Name == j.Name {
+				j.inherit(old)
+			}
+		}
+	}
+	scheduledJobs = c.Jobs
+
+	monitoringListen = c.Monitoring.Listen
+	limiter = newRateLimiter(c.RateLimits)
+
+	reminderLocation = c.reminderLocation
+	if c.storage != nil {
+		stateStorage, stateSettings = c.storage, c.State
+		reminders = newReminderStore(stateStorage)
+	}
+}
+
+// configSnapshot is the configuration as commands, jobs and the chat
+// subscription see it. They take one with snapshotConfig rather than
+// reading the globals, so a reload neither changes the configuration
+// under them nor waits for them to finish.
+type configSnapshot struct {
+	acl              *ACL
+	limiter          *rateLimiter
+	hass             map[string]*hassInstance
+	ddnsRecords      []*ddnsRecord
+	jobs             []*job
+	ipProviders      []ipProvider
+	ipConsensus      int
+	reminders        *reminderStore
+	reminderLocation *time.Location
+	notifyChannels   []chat1.ChatChannel
+	reconnectPolicy  backoffPolicy
+	httpReq          *httpRequests
+}
+
+func snapshotConfig() configSnapshot {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return configSnapshot{
+		acl:              acl,
+		limiter:          limiter,
+		hass:             hassInstances,
+		ddnsRecords:      ddnsRecords,
+		jobs:             scheduledJobs,
+		ipProviders:      ipProviders,
+		ipConsensus:      ipConsensus,
+		reminders:        reminders,
+		reminderLocation: reminderLocation,
+		notifyChannels:   notifyChannels,
+		reconnectPolicy:  reconnectPolicy,
+		httpReq:          sharedClient,
+	}
+}
+
+// background runs the watchers that depend on the configuration, so that
+// a reload can restart them with the new one.
+type background struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startBackground(ctx context.Context, kbc KeyBaseChat, httpReq Requests) *background {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &background{cancel: cancel}
+
+	rules, jobs, store := alertRules, scheduledJobs, reminders
+	b.wg.Add(4)
+	go func() {
+		defer b.wg.Done()
+		watchEvents(ctx, kbc, rules)
+	}()
+	go func() {
+		defer b.wg.Done()
+		watchIp(ctx, kbc, httpReq)
+	}()
+	go func() {
+		defer b.wg.Done()
+		runScheduler(ctx, kbc, httpReq, jobs, schedulerClock)
+	}()
+	go func() {
+		defer b.wg.Done()
+		runReminders(ctx, kbc, store, schedulerClock)
+	}()
+	return b
+}
+
+func (b *background) stop() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// reloadRequests wakes mainLoop to reload the config file.
+var reloadRequests = make(chan struct{}, 1)
+
+// requestReload asks the running mainLoop to reload its configuration, for
+// example on SIGHUP.
+func requestReload() {
+	select {
+	case reloadRequests <- struct{}{}:
+	default:
+	}
+}
+
+// reloadConfig loads the configuration again and, if it is valid, swaps
+// it in. The background watchers are restarted around the swap; the chat
+// subscription is left alone, and running commands keep the snapshot they
+// took.
+func reloadConfig(bg *background, start func() *background) *background {
+	config, err := loadConfig(configPath, os.Getenv)
+	if err == nil {
+		err = config.openState()
+	}
+	if err != nil {
+		logger.Error("config reload failed, keeping the current configuration", "error", err)
+		return bg
+	}
+
+	oldLoc, oldHome, oldWorkers, oldDepth, oldListen := kbLoc, kbHomeDir, workerCount, queueDepth, monitoringListen
+	bg.stop()
+	configMu.Lock()
+	config.apply()
+	configMu.Unlock()
+
+	if kbLoc != oldLoc || kbHomeDir != oldHome || workerCount != oldWorkers || queueDepth != oldDepth || monitoringListen != oldListen {
+		logger.Warn("keybase, workers, queue_depth and monitoring.listen changes take effect after a restart")
+	}
+	logger.Info("configuration reloaded", "path", configPath)
+	return start()
+}
+
+// runReloads starts the background watchers and reloads the configuration
+// whenever one is requested, until ctx is cancelled and the watchers have
+// stopped. It runs apart from mainLoop, so that waiting for the watchers
+// to stop never holds up reading messages or shutting down.
+func runReloads(ctx context.Context, start func() *background) {
+	bg := start()
+	defer func() { bg.stop() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloadRequests:
+			bg = reloadConfig(bg, start)
+		}
+	}
+}
+
+// watchConfigFile requests a reload whenever the modification time of
+// path changes, until ctx is cancelled.
+func watchConfigFile(ctx context.Context, path string) {
+	if path == "" {
+		return
+	}
+
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(lastMod) {
+			lastMod = info.ModTime()
+			logger.Info("config file changed", "path", path)
+			requestReload()
+		}
+	}
+}
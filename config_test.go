@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+keybase:
+  location: /usr/bin/keybase
+  home_dir: /var/lib/bot
+log:
+  level: warn
+workers: 2
+http:
+  timeout: 10s
+  retries: 0
+home_assistant:
+  url: https://home.example:8123
+  token: fileToken
+  instances:
+    cabin:
+      url: https://cabin.example:8123
+acl:
+  default: deny
+  rules:
+    - action: allow
+      commands: ["*"]
+      users: [janik]
+channels:
+  notify: [home#general]
+alerts:
+  - instance: cabin
+    entity: binary_sensor.*_door
+    channel: home#alerts
+ip:
+  providers: [ipify6]
+ddns:
+  - hostname: home.duckdns.org
+    backend: duckdns
+    token: secret
+rate_limits:
+  user: 20/1m
+  commands:
+    home: 5/10s
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+// useGlobals restores every setting touched by Config.apply when the test
+// ends.
+func useGlobals(t *testing.T) {
+	useRequestCtx(t)
+	savedLoc, savedHome, savedPath := kbLoc, kbHomeDir, configPath
+	savedWorkers, savedDepth, savedReconnect := workerCount, queueDepth, reconnectPolicy
+	savedTimeout, savedConnect, savedRetries := httpTimeout, httpConnectTimeout, httpRetries
+	savedHass, savedAcl, savedNotify := hassInstances, acl, notifyChannels
+	savedRules, savedProviders, savedConsensus := alertRules, ipProviders, ipConsensus
+	savedInterval, savedIpNotify, savedDdns := ipWatchInterval, ipNotifyChannels, ddnsRecords
+	savedJobs, savedReminders, savedLocation := scheduledJobs, reminders, reminderLocation
+	savedStorage, savedSettings, savedListen := stateStorage, stateSettings, monitoringListen
+	savedLimiter, savedUsername, savedClient := limiter, botUsername, sharedClient
+	t.Cleanup(func() {
+		kbLoc, kbHomeDir, configPath = savedLoc, savedHome, savedPath
+		workerCount, queueDepth, reconnectPolicy = savedWorkers, savedDepth, savedReconnect
+		httpTimeout, httpConnectTimeout, httpRetries = savedTimeout, savedConnect, savedRetries
+		hassInstances, acl, notifyChannels = savedHass, savedAcl, savedNotify
+		alertRules, ipProviders, ipConsensus = savedRules, savedProviders, savedConsensus
+		ipWatchInterval, ipNotifyChannels, ddnsRecords = savedInterval, savedIpNotify, savedDdns
+		scheduledJobs, reminders, reminderLocation = savedJobs, savedReminders, savedLocation
+		stateStorage, stateSettings, monitoringListen = savedStorage, savedSettings, savedListen
+		limiter, botUsername, sharedClient = savedLimiter, savedUsername, savedClient
+		setupLogger("", "")
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, testConfig), fakeEnv(map[string]string{
+		"WORKERS":            "8",
+		"LOG_LEVEL":          "debug",
+		"HASS_CABIN_API_KEY": "cabinToken",
+		"IP_NOTIFY_CHANNELS": "janik",
+		"STATE_BACKEND":      "keybase",
+		"STATE_TEAM":         "home.bot",
+		"RATE_LIMIT_USER":    "10/1m",
+	}))
+	require.Nil(t, err)
+
+	require.Equal(t, "/usr/bin/keybase", config.Keybase.Location)
+	require.Equal(t, "/var/lib/bot", config.Keybase.HomeDir)
+	require.Equal(t, LevelDebug, config.logLevel)
+	require.Equal(t, 8, config.Workers)
+	require.Equal(t, queueDepth, config.QueueDepth)
+	require.Equal(t, 10*time.Second, config.HTTP.Timeout)
+	require.Equal(t, httpConnectTimeout, config.HTTP.ConnectTimeout)
+	require.Equal(t, 0, config.HTTP.Retries)
+
+	require.Len(t, config.hass, 2)
+	require.Equal(t, "fileToken", config.hass[""].Token)
+	require.Equal(t, "https://cabin.example:8123", config.hass["cabin"].Url)
+	require.Equal(t, "cabinToken", config.hass["cabin"].Token)
+
+	require.Equal(t, aclDeny, config.ACL.Default)
+	require.Equal(t, []chat1.ChatChannel{{Name: "home", MembersType: "team", TopicName: "general", TopicType: "chat"}}, config.notifyChannels)
+	require.Equal(t, []chat1.ChatChannel{{Name: "janik"}}, config.ipNotifyChannels)
+	require.Len(t, config.Alerts, 1)
+	require.Equal(t, []ipProvider{builtinIpProviders["ipify6"]}, config.ipProviders)
+	require.Equal(t, 1, config.IP.Consensus)
+	require.Equal(t, defaultDdnsInterval, config.IP.WatchInterval)
+	require.Len(t, config.DDNS, 1)
+	require.Equal(t, &rateLimit{10, time.Minute}, config.RateLimits.User)
+	require.Equal(t, &rateLimit{5, 10 * time.Second}, config.RateLimits.Commands["home"])
+	require.Equal(t, storageSettings{Backend: storageKeybase, File: "state.json", Team: "home.bot"}, config.State)
+	require.Nil(t, config.openState())
+	require.Equal(t, "home.bot", *config.storage.(*keybaseStorage).team)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := loadConfig("", fakeEnv(nil))
+	require.Nil(t, err)
+
+	require.Equal(t, LevelInfo, config.logLevel)
+	require.Equal(t, defaultConfig.Workers, config.Workers)
+	require.Equal(t, defaultConfig.HTTP.Retries, config.HTTP.Retries)
+	require.Equal(t, aclAllow, config.ACL.Default)
+	require.Equal(t, defaultHassUrl, config.hass[""].Url)
+	require.Equal(t, defaultConfig.ipProviders, config.ipProviders)
+	require.Equal(t, time.Duration(0), config.IP.WatchInterval)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		content       string
+		env           map[string]string
+		expectedError string
+	}{
+		{"workers: [1]\n", nil, "could not parse config file"},
+		{"wrokers: 1\n", nil, "field wrokers not found"},
+		{"log:\n  level: loud\n", nil, `log: unknown log level "loud"`},
+		{"log:\n  format: xml\n", nil, `log: unknown format "xml"`},
+		{"workers: 0\n", nil, "workers and queue_depth must be at least 1"},
+		{"http:\n  timeout: -1s\n", nil, "http: timeouts must be positive"},
+		{"home_assistant:\n  instances:\n    cabin: {}\n", nil, `home_assistant: instance "cabin": no URL given`},
+		{"acl:\n  default: maybe\n", nil, `acl: invalid ACL default "maybe"`},
+		{"alerts:\n  - entity: light.*\n", nil, "alerts: alert rule 1: no channel given"},
+		{"alerts:\n  - instance: cabin\n    entity: light.*\n    channel: home\n", nil, `alerts: unknown Home Assistant instance "cabin"`},
+		{"ip:\n  providers: [nope]\n", nil, `ip: unknown IP provider "nope"`},
+		{"ddns:\n  - hostname: home.example\n    backend: nope\n", nil, `ddns: DDNS record 1: unknown backend "nope"`},
+		{"reminders:\n  timezone: Mars/Olympus\n", nil, `reminders: unknown timezone "Mars/Olympus"`},
+		{"monitoring:\n  listen: \"9090\"\n", nil, `monitoring: invalid listen address "9090"`},
+		{"rate_limits:\n  commands:\n    bye: 1/1m\n", nil, `rate_limits: unknown command "bye", give the name rather than an alias`},
+		{"", map[string]string{"RATE_LIMIT_CONVERSATION": "many"}, `invalid RATE_LIMIT_CONVERSATION "many", expected e.g. 10/1m`},
+		{"state:\n  backend: etcd\n", nil, `state: unknown backend "etcd"`},
+		{"state:\n  file: \"\"\n", nil, "state: the file backend needs a file"},
+		{"", map[string]string{"WORKERS": "many"}, `invalid WORKERS "many"`},
+		{"", map[string]string{"IP_WATCH_INTERVAL": "soon"}, `invalid IP_WATCH_INTERVAL "soon"`},
+		{"", map[string]string{"ACL_FILE": "itdoesnotexist.yaml"}, "could not read ACL file"},
+	}
+
+	for _, c := range cases {
+		_, err := loadConfig(writeConfig(t, c.content), fakeEnv(c.env))
+		require.NotNil(t, err, c.content)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+
+	_, err := loadConfig("itdoesnotexist.yaml", fakeEnv(nil))
+	require.Contains(t, err.Error(), "could not read config file")
+}
+
+func TestConfigApply(t *testing.T) {
+	useGlobals(t)
+
+	config, err := loadConfig(writeConfig(t, testConfig), fakeEnv(nil))
+	require.Nil(t, err)
+	config.apply()
+
+	require.Equal(t, "/usr/bin/keybase", kbLoc)
+	require.Equal(t, "/var/lib/bot", kbHomeDir)
+	require.Equal(t, 2, workerCount)
+	require.Equal(t, 10*time.Second, httpTimeout)
+	require.Equal(t, 0, httpRetries)
+	require.Equal(t, aclDeny, acl.Default)
+	require.Equal(t, "fileToken", hassInstances[""].Token)
+	require.Len(t, ddnsRecords, 1)
+
+	fakeStdout := captureOutput(t, func() { logger.Info("hidden") })
+	require.Empty(t, fakeStdout)
+}
+
+func TestReloadConfig(t *testing.T) {
+	useGlobals(t)
+	configPath = writeConfig(t, "acl:\n  default: deny\n")
+
+	started := 0
+	start := func() *background {
+		started++
+		return startBackground(context.Background(), mocks.NewKeyBaseChat(t), mocks.NewRequests(t))
+	}
+
+	bg := start()
+	fakeStdout := captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	require.Contains(t, fakeStdout, "configuration reloaded")
+	require.Equal(t, 2, started)
+	require.Equal(t, aclDeny, acl.Default)
+
+	require.Nil(t, os.WriteFile(configPath, []byte("acl:\n  default: maybe\n"), 0o600))
+	fakeStdout = captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	require.Contains(t, fakeStdout, "config reload failed")
+	require.Equal(t, 2, started)
+	require.Equal(t, aclDeny, acl.Default)
+	bg.stop()
+}
+
+func TestReloadConfigKeepsStorage(t *testing.T) {
+	useGlobals(t)
+	configPath = writeConfig(t, "state:\n  backend: memory\n")
+	start := func() *background {
+		return startBackground(context.Background(), mocks.NewKeyBaseChat(t), mocks.NewRequests(t))
+	}
+
+	bg := start()
+	captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	storage, store := stateStorage, reminders
+
+	// only a change of the state settings opens a new storage
+	captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	require.True(t, storage == stateStorage)
+	require.True(t, store == reminders)
+
+	file := filepath.Join(t.TempDir(), "state.json")
+	require.Nil(t, os.WriteFile(configPath, []byte("state:\n  backend: file\n  file: "+file+"\n"), 0o600))
+	captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	require.Equal(t, file, stateStorage.(*localStorage).path)
+	require.True(t, store != reminders)
+	bg.stop()
+}
+
+func TestReloadConfigHttp(t *testing.T) {
+	useGlobals(t)
+	configPath = writeConfig(t, "http:\n  timeout: 10s\n")
+	start := func() *background {
+		return startBackground(context.Background(), mocks.NewKeyBaseChat(t), mocks.NewRequests(t))
+	}
+
+	bg := start()
+	captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	client := snapshotConfig().httpReq
+	require.Equal(t, 10*time.Second, client.client.Timeout)
+
+	// the shared client is only replaced when the http settings change
+	captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	require.True(t, client == snapshotConfig().httpReq)
+
+	require.Nil(t, os.WriteFile(configPath, []byte("http:\n  timeout: 20s\n  retries: 4\nmonitoring:\n  listen: 127.0.0.1:9102\n"), 0o600))
+	fakeStdout := captureOutput(t, func() { bg = reloadConfig(bg, start) })
+	require.Equal(t, 20*time.Second, snapshotConfig().httpReq.client.Timeout)
+	require.Equal(t, 4, snapshotConfig().httpReq.retries)
+	require.Contains(t, fakeStdout, "monitoring.listen changes take effect after a restart")
+	bg.stop()
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	saved := configPollInterval
+	t.Cleanup(func() { configPollInterval = saved })
+	configPollInterval = 10 * time.Millisecond
+
+	path := writeConfig(t, "workers: 1\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfigFile(ctx, path)
+
+	time.Sleep(30 * time.Millisecond)
+	require.Len(t, reloadRequests, 0)
+
+	later := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(path, later, later))
+	require.Eventually(t, func() bool { return len(reloadRequests) == 1 }, time.Second, 10*time.Millisecond)
+	<-reloadRequests
+}
+
+func TestMainLoopReload(t *testing.T) {
+	useGlobals(t)
+	configPath = writeConfig(t, "acl:\n  default: deny\n")
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("ListenForNewTextMessages").Return(kbchat.NewSubscription(), nil)
+
+	fakeStdout := captureOutput(t, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		requestReload()
+		require.Nil(t, mainLoop(ctx, kbc, mocks.NewRequests(t)))
+	})
+
+	require.Contains(t, fakeStdout, "configuration reloaded")
+	require.Equal(t, aclDeny, acl.Default)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are shorthands for common schedules.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	cronWeekdays = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day
+// of month, month and day of week. Each field is a bit set of the values
+// it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// restricted day fields are combined with OR, as in cron(8), where a
+	// field starting with "*", such as "*/2", is not restricted
+	domRestricted, dowRestricted bool
+}
+
+// parseCron reads a cron expression such as "*/15 8-18 * * mon-fri" or a
+// macro such as "@daily".
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", expr)
+	}
+
+	s := new(cronSchedule)
+	specs := []struct {
+		target   *uint64
+		min, max int
+		names    map[string]int
+	}{
+		{&s.minute, 0, 59, nil},
+		{&s.hour, 0, 23, nil},
+		{&s.dom, 1, 31, nil},
+		{&s.month, 1, 12, cronMonths},
+		{&s.dow, 0, 7, cronWeekdays},
+	}
+	for i, spec := range specs {
+		bits, err := parseCronField(fields[i], spec.min, spec.max, spec.names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s", expr, err.Error())
+		}
+		*spec.target = bits
+	}
+
+	// 7 is another name for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = cronValue(from, min, max, names); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = cronValue(to, min, max, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				high = max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(raw string, min int, max int, names map[string]int) (int, error) {
+	if value, ok := names[strings.ToLower(raw)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("invalid value %q, expected %d-%d", raw, min, max)
+	}
+	return value, nil
+}
+
+// errNoCronMatch is returned for schedules that never match, such as
+// "0 0 30 2 *".
+var errNoCronMatch = errors.New("schedule never matches")
+
+// next returns the first time after t matching the schedule, in t's
+// location.
+func (s *cronSchedule) next(t time.Time) (time.Time, error) {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location()).Add(time.Minute)
+
+	// every schedule that can match does so within a leap year cycle
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, errNoCronMatch
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
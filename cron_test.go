@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	// a Sunday
+	start := time.Date(2026, 10, 18, 8, 59, 30, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"30 9 * * *", time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 12 13 * fri", time.Date(2026, 10, 23, 12, 0, 0, 0, time.UTC)},
+		// a stepped day field is not restricted, so both must match
+		{"0 12 */2 * tue", time.Date(2026, 10, 27, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * */3", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		{"5-10/5 9 * * *", time.Date(2026, 10, 18, 9, 5, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		schedule, err := parseCron(c.expr)
+		require.Nil(t, err, c.expr)
+		next, err := schedule.next(start)
+		require.Nil(t, err, c.expr)
+		require.Equal(t, c.expected, next, c.expr)
+	}
+}
+
+func TestCronNextLocation(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+
+	schedule, err := parseCron("0 9 * * *")
+	require.Nil(t, err)
+	next, err := schedule.next(time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC).In(berlin))
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), next.UTC())
+}
+
+func TestParseCronErrors(t *testing.T) {
+	cases := []struct {
+		expr          string
+		expectedError string
+	}{
+		{"* * * *", "expected 5 fields"},
+		{"60 * * * *", `invalid value "60", expected 0-59`},
+		{"* * 0 * *", `invalid value "0", expected 1-31`},
+		{"* * * foo *", `invalid value "foo", expected 1-12`},
+		{"*/0 * * * *", `invalid step "0"`},
+		{"10-5 * * * *", `invalid range "10-5"`},
+	}
+
+	for _, c := range cases {
+		_, err := parseCron(c.expr)
+		require.NotNil(t, err, c.expr)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+
+	schedule, err := parseCron("0 0 30 2 *")
+	require.Nil(t, err)
+	_, err = schedule.next(time.Now())
+	require.Equal(t, errNoCronMatch, err)
+}
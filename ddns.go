@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultDdnsInterval is how often the public IP is checked when dynamic
+// DNS records are configured but IP_WATCH_INTERVAL is not set.
+const defaultDdnsInterval = 5 * time.Minute
+
+// ddnsBackend pushes the public IP of one hostname to a DNS provider.
+type ddnsBackend interface {
+	Update(httpReq Requests, ip publicIp) error
+}
+
+// ddnsBackends builds a backend by name from a record's settings,
+// validating them.
+var ddnsBackends = map[string]func(r *ddnsRecord) (ddnsBackend, error){
+	"rfc2136":    newRfc2136Backend,
+	"cloudflare": newCloudflareBackend,
+	"duckdns":    newDuckDnsBackend,
+}
+
+// ddnsRecord is one hostname kept in sync with the public IP. Which of the
+// settings apply depends on Backend.
+type ddnsRecord struct {
+	Hostname string `yaml:"hostname"`
+	Backend  string `yaml:"backend"`
+	TTL      int    `yaml:"ttl"`
+
+	// rfc2136
+	Server        string `yaml:"server"`
+	Zone          string `yaml:"zone"`
+	TsigName      string `yaml:"tsig_name"`
+	TsigSecret    string `yaml:"tsig_secret"`
+	TsigAlgorithm string `yaml:"tsig_algorithm"`
+
+	// cloudflare and duckdns
+	Url    string `yaml:"url"`
+	ZoneId string `yaml:"zone_id"`
+	Token  string `yaml:"token"`
+	Domain string `yaml:"domain"`
+
+	backend ddnsBackend
+
+	mu         sync.Mutex
+	lastIp     publicIp
+	lastErr    error
+	lastUpdate time.Time
+}
+
+type ddnsConfig struct {
+	Records []*ddnsRecord `yaml:"records"`
+}
+
+var ddnsRecords []*ddnsRecord
+
+func loadDdnsRecords(path string) ([]*ddnsRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read DDNS file: %s", err.Error())
+	}
+
+	config := new(ddnsConfig)
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("could not parse DDNS file: %s", err.Error())
+	}
+
+	if err := validateDdnsRecords(config.Records); err != nil {
+		return nil, err
+	}
+	return config.Records, nil
+}
+
+func validateDdnsRecords(records []*ddnsRecord) error {
+	for i, record := range records {
+		if err := record.validate(); err != nil {
+			return fmt.Errorf("DDNS record %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *ddnsRecord) validate() error {
+	if r.Hostname == "" {
+		return errors.New("no hostname given")
+	}
+	r.Hostname = strings.TrimSuffix(strings.ToLower(r.Hostname), ".")
+	if r.TTL == 0 {
+		r.TTL = 300
+	}
+
+	newBackend, ok := ddnsBackends[strings.ToLower(r.Backend)]
+	if !ok {
+		return fmt.Errorf("unknown backend %q, expected cloudflare, duckdns or rfc2136", r.Backend)
+	}
+	backend, err := newBackend(r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", r.Hostname, err.Error())
+	}
+	r.backend = backend
+	return nil
+}
+
+// inherit keeps what old, the record for the same hostname and backend
+// before a reload, last pushed, so a reload does not update it again.
+func (r *ddnsRecord) inherit(old *ddnsRecord) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	r.lastIp, r.lastErr, r.lastUpdate = old.lastIp, old.lastErr, old.lastUpdate
+}
+
+// sync updates the record when ip differs from what was last pushed or
+// the last update failed.
+func (r *ddnsRecord) sync(httpReq Requests, ip publicIp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastErr == nil && r.lastIp == ip {
+		return
+	}
+
+	err := r.backend.Update(httpReq, ip)
+	r.lastUpdate = timeNow()
+	r.lastErr = err
+	if err != nil {
+		logger.Warn("DDNS update failed", "hostname", r.Hostname, "backend", r.Backend, "error", err)
+		return
+	}
+	r.lastIp = ip
+	logger.Info("DDNS record updated", "hostname", r.Hostname, "backend", r.Backend, "ipv4", ip.V4, "ipv6", ip.V6)
+}
+
+func (r *ddnsRecord) status(now time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := fmt.Sprintf("- %s (%s):", r.Hostname, r.Backend)
+	switch {
+	case r.lastUpdate.IsZero():
+		return prefix + " not updated yet"
+	case r.lastErr != nil:
+		return fmt.Sprintf("%s failed %s: %s", prefix, relativeTime(r.lastUpdate, now), r.lastErr.Error())
+	}
+
+	var addresses []string
+	for _, address := range []string{r.lastIp.V4, r.lastIp.V6} {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return fmt.Sprintf("%s updated %s to %s", prefix, relativeTime(r.lastUpdate, now), strings.Join(addresses, ", "))
+}
+
+// syncDdns brings every configured record in line with ip.
+func syncDdns(httpReq Requests, ip publicIp) {
+	for _, record := range snapshotConfig().ddnsRecords {
+		record.sync(httpReq, ip)
+	}
+}
+
+func ddnsCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	if len(args) > 0 && !strings.EqualFold(args[0], "status") {
+		return inputError("usage: ddns [status]")
+	}
+	records := snapshotConfig().ddnsRecords
+	if len(records) == 0 {
+		return reply(kbc, msg, "No dynamic DNS records are configured.")
+	}
+
+	now := timeNow()
+	lines := []string{"Dynamic DNS records:"}
+	for _, record := range records {
+		lines = append(lines, record.status(now))
+	}
+	return reply(kbc, msg, strings.Join(lines, "\n"))
+}
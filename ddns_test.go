@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDdnsBackend records the addresses it is asked to publish.
+type fakeDdnsBackend struct {
+	updates []publicIp
+	err     error
+}
+
+func (f *fakeDdnsBackend) Update(httpReq Requests, ip publicIp) error {
+	f.updates = append(f.updates, ip)
+	return f.err
+}
+
+func useDdnsRecords(t *testing.T, records ...*ddnsRecord) {
+	saved := ddnsRecords
+	t.Cleanup(func() { ddnsRecords = saved })
+	ddnsRecords = records
+}
+
+func TestLoadDdnsRecords(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ddns.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(`
+records:
+  - hostname: Home.Example.com.
+    backend: rfc2136
+    server: ns1.example.com
+    zone: example.com
+  - hostname: myhome.duckdns.org
+    backend: duckdns
+    token: abc
+    ttl: 60
+`), 0600))
+
+	records, err := loadDdnsRecords(file)
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "home.example.com", records[0].Hostname)
+	require.Equal(t, 300, records[0].TTL)
+	require.IsType(t, &rfc2136Backend{}, records[0].backend)
+	require.Equal(t, "myhome", records[1].Domain)
+	require.Equal(t, defaultDuckDnsUrl, records[1].Url)
+
+	cases := map[string]string{
+		"records:\n  - backend: duckdns\n":                    "DDNS record 1: no hostname given",
+		"records:\n  - hostname: a.b\n    backend: route53\n": `DDNS record 1: unknown backend "route53", expected cloudflare, duckdns or rfc2136`,
+		"records:\n  - hostname: a.b\n    backend: duckdns\n": "DDNS record 1: a.b: duckdns needs token",
+		"records:\n  - hostname: a.b\n    typo: 1\n":          "could not parse DDNS file",
+	}
+	for content, expected := range cases {
+		require.Nil(t, os.WriteFile(file, []byte(content), 0600))
+		_, err := loadDdnsRecords(file)
+		require.NotNil(t, err, content)
+		require.Contains(t, err.Error(), expected)
+	}
+
+	_, err = loadDdnsRecords("itdoesnotexist.yaml")
+	require.Contains(t, err.Error(), "could not read DDNS file")
+}
+
+func TestDdnsSync(t *testing.T) {
+	useFakeClock(t, testNow)
+
+	backend := &fakeDdnsBackend{}
+	record := &ddnsRecord{Hostname: "home.example.com", Backend: "fake", backend: backend}
+	useDdnsRecords(t, record)
+
+	require.Equal(t, "- home.example.com (fake): not updated yet", record.status(testNow))
+
+	first := publicIp{V4: "203.0.113.7", V6: "2001:db8::1"}
+	syncDdns(nil, first)
+	syncDdns(nil, first)
+	require.Equal(t, []publicIp{first}, backend.updates)
+	require.Equal(t, "- home.example.com (fake): updated 5m ago to 203.0.113.7, 2001:db8::1", record.status(testNow.Add(5*time.Minute)))
+
+	backend.err = errors.New("zone is frozen")
+	second := publicIp{V4: "198.51.100.2"}
+	syncDdns(nil, second)
+	require.Equal(t, "- home.example.com (fake): failed just now: zone is frozen", record.status(testNow))
+
+	// failed updates are retried even when the address did not change
+	backend.err = nil
+	syncDdns(nil, second)
+	require.Equal(t, []publicIp{first, second, second}, backend.updates)
+	require.Equal(t, "- home.example.com (fake): updated just now to 198.51.100.2", record.status(testNow))
+}
+
+func TestDdnsCommand(t *testing.T) {
+	useFakeClock(t, testNow)
+	msg := createTextMessage("ddns status")
+
+	useDdnsRecords(t)
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "No dynamic DNS records are configured.").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, ddnsCommand(kbc, msg, nil, []string{"status"}))
+
+	useDdnsRecords(t,
+		&ddnsRecord{Hostname: "home.example.com", Backend: "cloudflare", lastIp: publicIp{V4: "203.0.113.7"}, lastUpdate: testNow.Add(-2 * time.Hour)},
+		&ddnsRecord{Hostname: "myhome.duckdns.org", Backend: "duckdns"},
+	)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "Dynamic DNS records:\n- home.example.com (cloudflare): updated 2h ago to 203.0.113.7\n- myhome.duckdns.org (duckdns): not updated yet").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, ddnsCommand(kbc, msg, nil, nil))
+
+	require.EqualError(t, ddnsCommand(kbc, msg, nil, []string{"update"}), "usage: ddns [status]")
+}
+
+func TestDdnsStateSurvivesReload(t *testing.T) {
+	useGlobals(t)
+	useFakeClock(t, testNow)
+
+	backend := &fakeDdnsBackend{}
+	old := &ddnsRecord{Hostname: "home.example.com", Backend: "duckdns", backend: backend}
+	ddnsRecords = []*ddnsRecord{old}
+	ip := publicIp{V4: "203.0.113.7"}
+	old.sync(nil, ip)
+
+	config := defaultConfig
+	same := &ddnsRecord{Hostname: "home.example.com", Backend: "DuckDNS", backend: backend}
+	moved := &ddnsRecord{Hostname: "home.example.com", Backend: "cloudflare", backend: backend}
+	config.DDNS = []*ddnsRecord{same, moved}
+	config.apply()
+
+	require.Equal(t, "- home.example.com (DuckDNS): updated just now to 203.0.113.7", same.status(testNow))
+	require.Equal(t, "- home.example.com (cloudflare): not updated yet", moved.status(testNow))
+
+	// only the record with a new backend is pushed again
+	syncDdns(nil, ip)
+	require.Len(t, backend.updates, 2)
+}
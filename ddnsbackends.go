@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCloudflareUrl = "https://api.cloudflare.com/client/v4"
+	defaultDuckDnsUrl    = "https://www.duckdns.org/update"
+)
+
+// tsigAlgorithms are the TSIG algorithms accepted for RFC 2136 updates.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// addressRecords pairs each address in ip with its DNS record type.
+func addressRecords(ip publicIp) map[string]string {
+	records := make(map[string]string)
+	if ip.V4 != "" {
+		records["A"] = ip.V4
+	}
+	if ip.V6 != "" {
+		records["AAAA"] = ip.V6
+	}
+	return records
+}
+
+// rfc2136Backend sends DNS UPDATE messages, optionally signed with TSIG,
+// straight to the zone's primary server.
+type rfc2136Backend struct {
+	record    *ddnsRecord
+	algorithm string
+	client    *dns.Client
+}
+
+func newRfc2136Backend(r *ddnsRecord) (ddnsBackend, error) {
+	if r.Server == "" || r.Zone == "" {
+		return nil, errors.New("rfc2136 needs server and zone")
+	}
+	if _, _, err := net.SplitHostPort(r.Server); err != nil {
+		r.Server = net.JoinHostPort(r.Server, "53")
+	}
+	if (r.TsigName == "") != (r.TsigSecret == "") {
+		return nil, errors.New("tsig_name and tsig_secret must be given together")
+	}
+
+	algorithm := strings.TrimSuffix(strings.ToLower(r.TsigAlgorithm), ".")
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	fqdnAlgorithm, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", r.TsigAlgorithm)
+	}
+
+	client := &dns.Client{Timeout: httpTimeout}
+	if r.TsigName != "" {
+		client.TsigSecret = map[string]string{dns.Fqdn(r.TsigName): r.TsigSecret}
+	}
+	return &rfc2136Backend{record: r, algorithm: fqdnAlgorithm, client: client}, nil
+}
+
+func (b *rfc2136Backend) Update(httpReq Requests, ip publicIp) error {
+	name := dns.Fqdn(b.record.Hostname)
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(b.record.Zone))
+	for recordType, address := range addressRecords(ip) {
+		header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: uint32(b.record.TTL)}
+		var rr dns.RR
+		if recordType == "A" {
+			header.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: header, A: net.ParseIP(address)}
+		} else {
+			header.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: header, AAAA: net.ParseIP(address)}
+		}
+		msg.RemoveRRset([]dns.RR{rr})
+		msg.Insert([]dns.RR{rr})
+	}
+	if b.record.TsigName != "" {
+		msg.SetTsig(dns.Fqdn(b.record.TsigName), b.algorithm, 300, time.Now().Unix())
+	}
+
+	response, _, err := b.client.Exchange(msg, b.record.Server)
+	if err != nil {
+		return fmt.Errorf("DNS update failed: %s", err.Error())
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS server answered %s", dns.RcodeToString[response.Rcode])
+	}
+	return nil
+}
+
+// cloudflareBackend updates records through a Cloudflare-style REST API,
+// creating them when they do not exist yet.
+type cloudflareBackend struct {
+	record *ddnsRecord
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func newCloudflareBackend(r *ddnsRecord) (ddnsBackend, error) {
+	if r.ZoneId == "" || r.Token == "" {
+		return nil, errors.New("cloudflare needs zone_id and token")
+	}
+	if r.Url == "" {
+		r.Url = defaultCloudflareUrl
+	}
+	r.Url = strings.TrimSuffix(r.Url, "/")
+	return &cloudflareBackend{record: r}, nil
+}
+
+func (b *cloudflareBackend) Update(httpReq Requests, ip publicIp) error {
+	recordsUrl := fmt.Sprintf("%s/zones/%s/dns_records", b.record.Url, url.PathEscape(b.record.ZoneId))
+
+	for recordType, address := range addressRecords(ip) {
+		query := url.Values{"type": {recordType}, "name": {b.record.Hostname}}
+		var existing []struct {
+			Id string `json:"id"`
+		}
+		if err := b.call(httpReq, "GET", recordsUrl+"?"+query.Encode(), nil, &existing); err != nil {
+			return fmt.Errorf("could not look up %s record: %s", recordType, err.Error())
+		}
+
+		payload := map[string]interface{}{
+			"type":    recordType,
+			"name":    b.record.Hostname,
+			"content": address,
+			"ttl":     b.record.TTL,
+		}
+		method, target := "POST", recordsUrl
+		if len(existing) > 0 {
+			method, target = "PUT", recordsUrl+"/"+url.PathEscape(existing[0].Id)
+		}
+		if err := b.call(httpReq, method, target, payload, nil); err != nil {
+			return fmt.Errorf("could not update %s record: %s", recordType, err.Error())
+		}
+	}
+	return nil
+}
+
+// call sends one API request and decodes the result into v when it is not
+// nil.
+func (b *cloudflareBackend) call(httpReq Requests, method string, target string, payload interface{}, v interface{}) error {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := httpReq.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header = map[string][]string{
+		"Authorization": {fmt.Sprintf("Bearer %s", b.record.Token)},
+		"Content-Type":  {"application/json"},
+	}
+
+	res, err := httpReq.Do(req)
+	if err != nil {
+		return stripUrl(err)
+	}
+	defer res.Body.Close()
+
+	var decoded cloudflareResponse
+	if err := json.NewDecoder(res.Body).Decode(&decoded); err != nil {
+		return fmt.Errorf("received status %s", res.Status)
+	}
+	if !decoded.Success {
+		var messages []string
+		for _, e := range decoded.Errors {
+			messages = append(messages, fmt.Sprintf("%s (%d)", e.Message, e.Code))
+		}
+		if len(messages) == 0 {
+			messages = append(messages, res.Status)
+		}
+		return errors.New(strings.Join(messages, "; "))
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(decoded.Result, v); err != nil {
+			return fmt.Errorf("error decoding response: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// duckDnsBackend updates records through a DuckDNS-style GET endpoint
+// answering "OK" or "KO".
+type duckDnsBackend struct {
+	record *ddnsRecord
+}
+
+func newDuckDnsBackend(r *ddnsRecord) (ddnsBackend, error) {
+	if r.Token == "" {
+		return nil, errors.New("duckdns needs token")
+	}
+	if r.Url == "" {
+		r.Url = defaultDuckDnsUrl
+	}
+	if r.Domain == "" {
+		r.Domain = strings.TrimSuffix(r.Hostname, ".duckdns.org")
+	}
+	return &duckDnsBackend{record: r}, nil
+}
+
+func (b *duckDnsBackend) Update(httpReq Requests, ip publicIp) error {
+	query := url.Values{"domains": {b.record.Domain}, "token": {b.record.Token}}
+	if ip.V4 != "" {
+		query.Set("ip", ip.V4)
+	}
+	if ip.V6 != "" {
+		query.Set("ipv6", ip.V6)
+	}
+
+	req, err := httpReq.NewRequest("GET", b.record.Url+"?"+query.Encode(), http.NoBody)
+	if err != nil {
+		return stripUrl(err)
+	}
+	res, err := httpReq.Do(req)
+	if err != nil {
+		return stripUrl(err)
+	}
+	defer res.Body.Close()
+
+	answer, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("received status %s", res.Status)
+	}
+	if result := strings.TrimSpace(string(answer)); !strings.HasPrefix(result, "OK") {
+		return fmt.Errorf("update rejected: %q", result)
+	}
+	return nil
+}
+
+// stripUrl drops the request URL from err, since it may carry a token.
+func stripUrl(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request failed: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testTsigSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+// startDnsServer runs a stand-in primary server accepting updates signed
+// with testTsigSecret under the key name "bot.", and returns its address
+// and the update sections it received.
+func startDnsServer(t *testing.T) (string, func() [][]dns.RR) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	var mu sync.Mutex
+	var updates [][]dns.RR
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		TsigSecret:        map[string]string{"bot.": testTsigSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default accept func turns away UPDATE messages
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			if r.Opcode != dns.OpcodeUpdate || r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.SetRcode(r, dns.RcodeRefused)
+				w.WriteMsg(m)
+				return
+			}
+
+			mu.Lock()
+			updates = append(updates, r.Ns)
+			mu.Unlock()
+
+			m.SetReply(r)
+			m.SetTsig("bot.", dns.HmacSHA256, 300, time.Now().Unix())
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String(), func() [][]dns.RR {
+		mu.Lock()
+		defer mu.Unlock()
+		return updates
+	}
+}
+
+func TestRfc2136Backend(t *testing.T) {
+	addr, updates := startDnsServer(t)
+
+	record := &ddnsRecord{
+		Hostname:   "home.example.com",
+		Backend:    "rfc2136",
+		Server:     addr,
+		Zone:       "example.com",
+		TTL:        60,
+		TsigName:   "bot",
+		TsigSecret: testTsigSecret,
+	}
+	require.Nil(t, record.validate())
+	require.Nil(t, record.backend.Update(nil, publicIp{V4: "203.0.113.7", V6: "2001:db8::1"}))
+
+	received := updates()
+	require.Len(t, received, 1)
+
+	var lines []string
+	for _, rr := range received[0] {
+		lines = append(lines, rr.String())
+	}
+	require.ElementsMatch(t, []string{
+		"home.example.com.\t0\tCLASS255\tA\t",
+		"home.example.com.\t60\tIN\tA\t203.0.113.7",
+		"home.example.com.\t0\tCLASS255\tAAAA\t",
+		"home.example.com.\t60\tIN\tAAAA\t2001:db8::1",
+	}, lines)
+
+	unsigned := &ddnsRecord{Hostname: "home.example.com", Backend: "rfc2136", Server: addr, Zone: "example.com"}
+	require.Nil(t, unsigned.validate())
+	require.EqualError(t, unsigned.backend.Update(nil, publicIp{V4: "203.0.113.7"}), "DNS server answered REFUSED")
+}
+
+func TestRfc2136BackendConfig(t *testing.T) {
+	cases := []struct {
+		record        *ddnsRecord
+		expectedError string
+	}{
+		{&ddnsRecord{Zone: "example.com"}, "rfc2136 needs server and zone"},
+		{&ddnsRecord{Server: "ns1", Zone: "example.com", TsigName: "bot"}, "tsig_name and tsig_secret must be given together"},
+		{&ddnsRecord{Server: "ns1", Zone: "example.com", TsigAlgorithm: "hmac-md5"}, `unsupported TSIG algorithm "hmac-md5"`},
+	}
+	for _, c := range cases {
+		_, err := newRfc2136Backend(c.record)
+		require.EqualError(t, err, c.expectedError)
+	}
+
+	record := &ddnsRecord{Server: "ns1.example.com", Zone: "example.com", TsigAlgorithm: "HMAC-SHA512."}
+	backend, err := newRfc2136Backend(record)
+	require.Nil(t, err)
+	require.Equal(t, "ns1.example.com:53", record.Server)
+	require.Equal(t, dns.HmacSHA512, backend.(*rfc2136Backend).algorithm)
+}
+
+func TestCloudflareBackend(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, fmt.Sprintf("%s %s", r.Method, r.URL.RequestURI()))
+
+		if r.Header.Get("Authorization") != "Bearer cf-token" {
+			w.WriteHeader(403)
+			fmt.Fprint(w, `{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`)
+			return
+		}
+
+		if r.Method == "GET" {
+			if r.URL.Query().Get("type") == "A" {
+				fmt.Fprint(w, `{"success":true,"result":[{"id":"rec-a"}]}`)
+			} else {
+				fmt.Fprint(w, `{"success":true,"result":[]}`)
+			}
+			return
+		}
+
+		var body map[string]interface{}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		bodies = append(bodies, body)
+		fmt.Fprint(w, `{"success":true,"result":{}}`)
+	}))
+	defer server.Close()
+
+	record := &ddnsRecord{Hostname: "home.example.com", Backend: "cloudflare", Url: server.URL + "/", ZoneId: "zone1", Token: "cf-token"}
+	require.Nil(t, record.validate())
+	require.Nil(t, record.backend.Update(newTestHttpRequests(), publicIp{V4: "203.0.113.7", V6: "2001:db8::1"}))
+
+	require.ElementsMatch(t, []string{
+		"GET /zones/zone1/dns_records?name=home.example.com&type=A",
+		"PUT /zones/zone1/dns_records/rec-a",
+		"GET /zones/zone1/dns_records?name=home.example.com&type=AAAA",
+		"POST /zones/zone1/dns_records",
+	}, calls)
+	require.ElementsMatch(t, []map[string]interface{}{
+		{"type": "A", "name": "home.example.com", "content": "203.0.113.7", "ttl": float64(300)},
+		{"type": "AAAA", "name": "home.example.com", "content": "2001:db8::1", "ttl": float64(300)},
+	}, bodies)
+
+	record.Token = "wrong"
+	err := record.backend.Update(newTestHttpRequests(), publicIp{V4: "203.0.113.7"})
+	require.EqualError(t, err, "could not look up A record: Invalid access token (9109)")
+
+	_, err = newCloudflareBackend(&ddnsRecord{ZoneId: "zone1"})
+	require.EqualError(t, err, "cloudflare needs zone_id and token")
+}
+
+func TestDuckDnsBackend(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Query().Get("token") != "duck-token" {
+			fmt.Fprint(w, "KO")
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	record := &ddnsRecord{Hostname: "myhome.duckdns.org", Backend: "duckdns", Url: server.URL, Token: "duck-token"}
+	require.Nil(t, record.validate())
+	require.Nil(t, record.backend.Update(newTestHttpRequests(), publicIp{V4: "203.0.113.7", V6: "2001:db8::1"}))
+	require.Equal(t, "domains=myhome&ip=203.0.113.7&ipv6=2001%3Adb8%3A%3A1&token=duck-token", query)
+
+	record.Token = "wrong"
+	require.EqualError(t, record.backend.Update(newTestHttpRequests(), publicIp{V4: "203.0.113.7"}), `update rejected: "KO"`)
+
+	offline := &ddnsRecord{Hostname: "myhome.duckdns.org", Backend: "duckdns", Url: "http://127.0.0.1:1/update", Token: "secret-token"}
+	require.Nil(t, offline.validate())
+	err := offline.backend.Update(newTestHttpRequests(), publicIp{V4: "203.0.113.7"})
+	require.NotNil(t, err)
+	require.NotContains(t, err.Error(), "secret-token")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrorKind says who a command failure is meant for and whether trying
+// again may help.
+type ErrorKind int
+
+const (
+	// KindInternal is an unexpected failure; the user only learns that
+	// something went wrong, the details go to the log.
+	KindInternal ErrorKind = iota
+	// KindInput means the user asked for something invalid.
+	KindInput
+	// KindUnavailable means a service the bot depends on failed and the
+	// command may succeed if retried.
+	KindUnavailable
+)
+
+// BotError is a command failure with a message that is safe to show in
+// chat. Err holds the underlying cause, which is only logged.
+type BotError struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *BotError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", strings.TrimSuffix(e.Message, "."), e.Err.Error())
+}
+
+func (e *BotError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether running the command again may succeed.
+func (e *BotError) Retryable() bool {
+	return e.Kind == KindUnavailable
+}
+
+// inputError reports a problem with what the user asked for.
+func inputError(format string, v ...any) error {
+	return &BotError{Kind: KindInput, Message: fmt.Sprintf(format, v...)}
+}
+
+// unavailableError reports that a dependency failed with err.
+func unavailableError(message string, err error) error {
+	return &BotError{Kind: KindUnavailable, Message: message, Err: err}
+}
+
+// errReplyFailed marks errors from sending a reply, which are not worth
+// another reply.
+var errReplyFailed = errors.New("error sending reply")
+
+// newErrorId returns the correlation ID quoted to the user and logged
+// with a failure. It is a variable so tests can fix it.
+var newErrorId = func() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(id)
+}
+
+// classifyError turns any error returned by a command into a BotError,
+// recognising Home Assistant responses and network failures.
+func classifyError(err error) *BotError {
+	var botErr *BotError
+	if errors.As(err, &botErr) {
+		return botErr
+	}
+
+	var statusErr *hassStatusError
+	if errors.As(err, &statusErr) {
+		return classifyHassStatus(statusErr, err)
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return &BotError{Kind: KindUnavailable, Message: "The service has been failing, so requests to it are paused for a moment.", Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return &BotError{Kind: KindUnavailable, Message: "The service could not be reached.", Err: err}
+	}
+	return &BotError{Kind: KindInternal, Message: "Something went wrong.", Err: err}
+}
+
+func classifyHassStatus(statusErr *hassStatusError, err error) *BotError {
+	switch code := statusErr.StatusCode; {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return &BotError{Kind: KindInternal, Message: "Home Assistant rejected the bot's access token.", Err: err}
+	case code == http.StatusNotFound:
+		return &BotError{Kind: KindInput, Message: "Home Assistant could not find that.", Err: err}
+	case code == http.StatusBadRequest && statusErr.Message != "":
+		return &BotError{Kind: KindInput, Message: statusErr.Message, Err: err}
+	case code >= 500:
+		return &BotError{Kind: KindUnavailable, Message: fmt.Sprintf("Home Assistant answered %s.", statusErr.Status), Err: err}
+	}
+	return &BotError{Kind: KindInternal, Message: fmt.Sprintf("Home Assistant answered %s.", statusErr.Status), Err: err}
+}
+
+// renderError is the chat reply for a failed command. Input errors are
+// shown as they are; anything else quotes id so the log lines can be
+// found.
+func renderError(botErr *BotError, id string) string {
+	if botErr.Kind == KindInput {
+		return botErr.Message
+	}
+	if botErr.Retryable() {
+		return fmt.Sprintf("%s Please try again in a minute. (error %s)", botErr.Message, id)
+	}
+	return fmt.Sprintf("%s (error %s)", botErr.Message, id)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+func useErrorId(t *testing.T, id string) {
+	saved := newErrorId
+	t.Cleanup(func() { newErrorId = saved })
+	newErrorId = func() string { return id }
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err       error
+		kind      ErrorKind
+		retryable bool
+		rendered  string
+	}{
+		{
+			inputError("invalid pattern %q", "["),
+			KindInput,
+			false,
+			`invalid pattern "["`,
+		},
+		{
+			fmt.Errorf("wrapped: %w", unavailableError("The weather service is down.", errors.New("timeout"))),
+			KindUnavailable,
+			true,
+			"The weather service is down. Please try again in a minute. (error 1234abcd)",
+		},
+		{
+			fmt.Errorf("error communicating with Home Assistant: %w", &hassStatusError{Status: "401 Unauthorized", StatusCode: 401}),
+			KindInternal,
+			false,
+			"Home Assistant rejected the bot's access token. (error 1234abcd)",
+		},
+		{
+			fmt.Errorf("error communicating with Home Assistant: %w", &hassStatusError{Status: "404 Not Found", StatusCode: 404, Message: "Entity not found."}),
+			KindInput,
+			false,
+			"Home Assistant could not find that.",
+		},
+		{
+			&hassStatusError{Status: "400 Bad Request", StatusCode: 400, Message: "Error rendering template"},
+			KindInput,
+			false,
+			"Error rendering template",
+		},
+		{
+			&hassStatusError{Status: "502 Bad Gateway", StatusCode: 502},
+			KindUnavailable,
+			true,
+			"Home Assistant answered 502 Bad Gateway. Please try again in a minute. (error 1234abcd)",
+		},
+		{
+			fmt.Errorf("error with Home Assistant response: %w", fmt.Errorf("home.lan: %w", errCircuitOpen)),
+			KindUnavailable,
+			true,
+			"The service has been failing, so requests to it are paused for a moment. Please try again in a minute. (error 1234abcd)",
+		},
+		{
+			fmt.Errorf("could not get ip address: %w", context.DeadlineExceeded),
+			KindUnavailable,
+			true,
+			"The service could not be reached. Please try again in a minute. (error 1234abcd)",
+		},
+		{
+			errors.New("error decoding response: unexpected EOF"),
+			KindInternal,
+			false,
+			"Something went wrong. (error 1234abcd)",
+		},
+	}
+
+	for _, c := range cases {
+		botErr := classifyError(c.err)
+		require.Equal(t, c.kind, botErr.Kind, c.err.Error())
+		require.Equal(t, c.retryable, botErr.Retryable(), c.err.Error())
+		require.Equal(t, c.rendered, renderError(botErr, "1234abcd"))
+	}
+
+	require.Len(t, newErrorId(), 8)
+}
+
+func TestHandleMessageErrors(t *testing.T) {
+	useErrorId(t, "1234abcd")
+
+	cases := []struct {
+		input         string
+		statusCode    int
+		expectedReply string
+		expectedLog   string
+	}{
+		{"home states [", 200, `invalid pattern "["`, `INFO command rejected conversation=test#c sender="" command=home`},
+		{"home config", 401, "Home Assistant rejected the bot's access token. (error 1234abcd)", "ERROR command failed"},
+		{"home config", 503, "Home Assistant answered 503 Service Unavailable. Please try again in a minute. (error 1234abcd)", "error_id=1234abcd retryable=true"},
+	}
+
+	for _, c := range cases {
+		msg := createTextMessage(c.input)
+		httpReq := mocks.NewRequests(t)
+		if c.statusCode != http.StatusOK {
+			httpReq = mockHassGet(t, "http://home-assistant.home.lan:8123/api/config", c.statusCode, "")
+		}
+
+		kbc := mocks.NewKeyBaseChat(t)
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, c.expectedReply).Return(kbchat.SendResponse{}, nil)
+
+		output := captureOutput(t, func() { handleMessage(kbc, msg, httpReq) })
+		require.Contains(t, output, c.expectedLog)
+	}
+
+	msg := createTextMessage("home config")
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "HASS says: \n```\n{}\n\n```").Return(kbchat.SendResponse{}, errors.New("chat down"))
+
+	httpReq := mockHassGet(t, "http://home-assistant.home.lan:8123/api/config", http.StatusOK, "{}")
+	output := captureOutput(t, func() { handleMessage(kbc, msg, httpReq) })
+	require.Contains(t, output, `ERROR command failed conversation=test#c sender="" command=home`)
+	require.NotContains(t, output, "error_id")
+}
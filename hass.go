@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// hassState is one entity state as returned by the Home Assistant REST API.
+type hassState struct {
+	EntityId    string                 `json:"entity_id"`
+	State       string                 `json:"state"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	LastChanged time.Time              `json:"last_changed"`
+	LastUpdated time.Time              `json:"last_updated"`
+}
+
+// homeHandlerFunc runs a `home` subcommand against the addressed instance.
+type homeHandlerFunc func(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error
+
+// homeSubcommands are the `home` arguments handled specially instead of
+// being passed through as an API path.
+var homeSubcommands = map[string]homeHandlerFunc{
+	"call":     homeCallCommand,
+	"history":  homeHistoryCommand,
+	"logbook":  homeLogbookCommand,
+	"state":    homeStateCommand,
+	"states":   homeStatesCommand,
+	"template": homeTemplateCommand,
+}
+
+func homeCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	hass, err := hassInstanceFor(msg)
+	if err != nil {
+		return inputError("%s", err.Error())
+	}
+	httpReq = hass.requests(httpReq)
+
+	if len(args) > 0 {
+		if sub, ok := homeSubcommands[strings.ToLower(args[0])]; ok {
+			return sub(kbc, msg, httpReq, hass, args[1:])
+		}
+	}
+
+	hassOutput, err := getFromHass(httpReq, hass.endpoint(strings.Join(args, "/")), hass.Token)
+	if err != nil {
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+	logger.Debug("Home Assistant response", "instance", hass.Name, "bytes", len(hassOutput))
+	return reply(kbc, msg, hassOutput)
+}
+
+func homeCallCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error {
+	if len(args) == 0 {
+		return inputError("usage: home call <domain.service> [key=value...]")
+	}
+
+	domain, service, err := splitService(args[0])
+	if err != nil {
+		return inputError("%s", err.Error())
+	}
+
+	data, err := parseServiceData(args[1:])
+	if err != nil {
+		return inputError("%s", err.Error())
+	}
+
+	hassUrl := hass.endpoint(fmt.Sprintf("services/%s/%s", domain, service))
+	responseBody, err := postToHass(httpReq, hassUrl, hass.Token, data)
+	if err != nil {
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+
+	var changed []hassState
+	if err := json.Unmarshal(responseBody, &changed); err != nil {
+		return fmt.Errorf("error decoding response: %s", err.Error())
+	}
+
+	return reply(kbc, msg, summarizeServiceCall(args[0], changed))
+}
+
+// splitService splits "light.turn_on" into its domain and service.
+func splitService(name string) (string, string, error) {
+	domain, service, ok := strings.Cut(name, ".")
+	if !ok || domain == "" || service == "" {
+		return "", "", fmt.Errorf("invalid service %q, expected <domain>.<service>", name)
+	}
+	return domain, service, nil
+}
+
+// parseServiceData turns key=value arguments into a service call body.
+// Values that are valid JSON (numbers, booleans, lists) keep their type;
+// anything else is sent as a string.
+func parseServiceData(args []string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid argument %q, expected key=value", arg)
+		}
+
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+			decoded = value
+		}
+		data[key] = decoded
+	}
+	return data, nil
+}
+
+func summarizeServiceCall(service string, changed []hassState) string {
+	if len(changed) == 0 {
+		return fmt.Sprintf("Called %s, no states changed", service)
+	}
+
+	lines := []string{fmt.Sprintf("Called %s, changed states:", service)}
+	for _, state := range changed {
+		lines = append(lines, fmt.Sprintf("- %s: %s", state.EntityId, state.State))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServiceData(t *testing.T) {
+	data, err := parseServiceData([]string{"entity_id=light.kitchen", "brightness=128", "rgb_color=[255,0,0]", "transition=true"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{
+		"entity_id":  "light.kitchen",
+		"brightness": float64(128),
+		"rgb_color":  []interface{}{float64(255), float64(0), float64(0)},
+		"transition": true,
+	}, data)
+
+	_, err = parseServiceData([]string{"brightness"})
+	require.EqualError(t, err, `invalid argument "brightness", expected key=value`)
+
+	_, err = parseServiceData([]string{"=1"})
+	require.NotNil(t, err)
+}
+
+func TestSplitService(t *testing.T) {
+	domain, service, err := splitService("light.turn_on")
+	require.Nil(t, err)
+	require.Equal(t, "light", domain)
+	require.Equal(t, "turn_on", service)
+
+	for _, name := range []string{"light", ".turn_on", "light."} {
+		_, _, err := splitService(name)
+		require.NotNil(t, err, name)
+	}
+}
+
+func TestHomeCallCommand(t *testing.T) {
+	serviceUrl := "http://home-assistant.home.lan:8123/api/services/light/turn_on"
+	serviceUrlAsUrl, _ := url.Parse(serviceUrl)
+
+	cases := []struct {
+		input         string
+		response      string
+		statusCode    int
+		doError       error
+		expectedReply string
+		expectedError string
+	}{
+		{
+			"home call light.turn_on entity_id=light.kitchen brightness=128",
+			`[{"entity_id":"light.kitchen","state":"on"}]`,
+			200,
+			nil,
+			"Called light.turn_on, changed states:\n- light.kitchen: on",
+			"",
+		},
+		{
+			"home call light.turn_on",
+			`[]`,
+			200,
+			nil,
+			"Called light.turn_on, no states changed",
+			"",
+		},
+		{
+			"home call light.turn_on",
+			`401: Unauthorized`,
+			401,
+			nil,
+			"",
+			"error communicating with Home Assistant: error: received status 401 Unauthorized",
+		},
+		{
+			"home call light.turn_on",
+			``,
+			0,
+			errors.New("doError"),
+			"",
+			"error communicating with Home Assistant: error with Home Assistant response: doError",
+		},
+		{
+			"home call light.turn_on",
+			`{"not":"a list"}`,
+			200,
+			nil,
+			"",
+			"error decoding response",
+		},
+		{
+			"home call light",
+			``,
+			0,
+			nil,
+			"",
+			`invalid service "light", expected <domain>.<service>`,
+		},
+		{
+			"home call light.turn_on brightness",
+			``,
+			0,
+			nil,
+			"",
+			`invalid argument "brightness", expected key=value`,
+		},
+		{
+			"home call",
+			``,
+			0,
+			nil,
+			"",
+			"usage: home call <domain.service> [key=value...]",
+		},
+	}
+
+	for _, c := range cases {
+		msg := createTextMessage(c.input)
+		_, args, _ := commands.Match(c.input)
+
+		hassReq := &http.Request{Method: "POST", URL: serviceUrlAsUrl}
+
+		httpReq := mocks.NewRequests(t)
+		httpReq.On("NewRequest", "POST", serviceUrl, mock.Anything).Return(hassReq, nil).Maybe()
+		httpReq.On("Do", hassReq).Return(&http.Response{
+			Status:     fmt.Sprintf("%d %s", c.statusCode, http.StatusText(c.statusCode)),
+			StatusCode: c.statusCode,
+			Body:       io.NopCloser(strings.NewReader(c.response)),
+		}, c.doError).Maybe()
+
+		kbc := mocks.NewKeyBaseChat(t)
+		if c.expectedReply != "" {
+			kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, c.expectedReply).Return(kbchat.SendResponse{}, nil)
+		}
+
+		err := homeCommand(kbc, msg, httpReq, args)
+		if c.expectedError != "" {
+			require.Contains(t, err.Error(), c.expectedError)
+		} else {
+			require.Nil(t, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+const defaultHassUrl = "http://home-assistant.home.lan:8123"
+
+// hassInstance is one Home Assistant server the bot can talk to.
+type hassInstance struct {
+	Name  string
+	Url   string
+	Token string
+
+	// httpReq and tlsConfig are set when the instance needs its own TLS
+	// settings.
+	httpReq   Requests
+	tlsConfig *tls.Config
+}
+
+// hassInstances holds every configured instance by name; the unnamed
+// instance is stored under "".
+var hassInstances = map[string]*hassInstance{
+	"": {Url: defaultHassUrl},
+}
+
+// endpoint returns the API URL for path on this instance.
+func (h *hassInstance) endpoint(path string) string {
+	return fmt.Sprintf("%s/api/%s", h.Url, path)
+}
+
+// websocketUrl returns the address of the instance's WebSocket API.
+func (h *hassInstance) websocketUrl() string {
+	if strings.HasPrefix(h.Url, "https://") {
+		return "wss://" + strings.TrimPrefix(h.Url, "https://") + "/api/websocket"
+	}
+	return "ws://" + strings.TrimPrefix(h.Url, "http://") + "/api/websocket"
+}
+
+// requests returns the instance's own client if it has one, otherwise
+// fallback.
+func (h *hassInstance) requests(fallback Requests) Requests {
+	if h.httpReq != nil {
+		return h.httpReq
+	}
+	return fallback
+}
+
+func (h *hassInstance) configureTLS(caFile string, insecure bool) error {
+	if caFile == "" && !insecure {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("could not read CA bundle: %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	h.tlsConfig = tlsConfig
+	h.newClient()
+	return nil
+}
+
+// newClient (re)builds the instance's own client from its TLS settings,
+// picking up the current HTTP timeouts.
+func (h *hassInstance) newClient() {
+	if h.tlsConfig == nil {
+		return
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = h.tlsConfig
+	h.httpReq = newHttpRequests(transport)
+}
+
+// hassSettings configures one instance in the config file. Each field can
+// be overridden from the environment, see hassSettingsFromEnv.
+type hassSettings struct {
+	Url                string `yaml:"url"`
+	Token              string `yaml:"token"`
+	CaFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// hassSettingsFromEnv overlays the environment on base, which maps
+// instance names to settings with the unnamed instance under "". The
+// default instance uses HASS_URL, HASS_API_KEY, HASS_CA_FILE and
+// HASS_INSECURE_SKIP_VERIFY; each name listed in HASS_INSTANCES uses the
+// same variables with the upper-cased name inserted, e.g. HASS_CABIN_URL.
+func hassSettingsFromEnv(base map[string]hassSettings, getenv func(string) string) (map[string]hassSettings, error) {
+	settings := map[string]hassSettings{"": base[""]}
+	for name, instance := range base {
+		settings[strings.ToLower(name)] = instance
+	}
+	for _, name := range strings.Split(getenv("HASS_INSTANCES"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			settings[name] = settings[name]
+		}
+	}
+
+	for name, instance := range settings {
+		prefix := "HASS_"
+		if name != "" {
+			prefix = fmt.Sprintf("HASS_%s_", strings.ToUpper(name))
+		}
+
+		if value := getenv(prefix + "URL"); value != "" {
+			instance.Url = value
+		}
+		if value := getenv(prefix + "API_KEY"); value != "" {
+			instance.Token = value
+		}
+		if value := getenv(prefix + "CA_FILE"); value != "" {
+			instance.CaFile = value
+		}
+		if raw := getenv(prefix + "INSECURE_SKIP_VERIFY"); raw != "" {
+			insecure, err := strconv.ParseBool(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sINSECURE_SKIP_VERIFY: %s", prefix, err.Error())
+			}
+			instance.InsecureSkipVerify = insecure
+		}
+		settings[name] = instance
+	}
+	return settings, nil
+}
+
+func buildHassInstances(settings map[string]hassSettings) (map[string]*hassInstance, error) {
+	instances := make(map[string]*hassInstance)
+	for name, instanceSettings := range settings {
+		instance, err := newHassInstance(name, instanceSettings)
+		if err != nil {
+			if name == "" {
+				return nil, err
+			}
+			return nil, fmt.Errorf("instance %q: %s", name, err.Error())
+		}
+		instances[name] = instance
+	}
+	return instances, nil
+}
+
+func newHassInstance(name string, settings hassSettings) (*hassInstance, error) {
+	rawUrl := settings.Url
+	if rawUrl == "" {
+		if name != "" {
+			return nil, errors.New("no URL given")
+		}
+		rawUrl = defaultHassUrl
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err.Error())
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q: expected http(s)://host[:port]", rawUrl)
+	}
+
+	instance := &hassInstance{
+		Name:  name,
+		Url:   strings.TrimSuffix(strings.TrimSuffix(rawUrl, "/"), "/api"),
+		Token: settings.Token,
+	}
+	if err := instance.configureTLS(settings.CaFile, settings.InsecureSkipVerify); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// commandTarget returns the instance named after "@" in the command
+// keyword of msg, e.g. "cabin" for "home@cabin states".
+func commandTarget(msg kbchat.SubscriptionMessage) string {
+	if msg.Message.Content.Text == nil {
+		return ""
+	}
+
+	fields := strings.Fields(msg.Message.Content.Text.Body)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	_, target, _ := strings.Cut(fields[0], "@")
+	return strings.ToLower(target)
+}
+
+// hassInstanceFor picks the Home Assistant instance addressed by msg.
+func hassInstanceFor(msg kbchat.SubscriptionMessage) (*hassInstance, error) {
+	name := commandTarget(msg)
+	instances := snapshotConfig().hass
+	if instance, ok := instances[name]; ok {
+		return instance, nil
+	}
+
+	var known []string
+	for n := range instances {
+		if n != "" {
+			known = append(known, n)
+		}
+	}
+	sort.Strings(known)
+	if len(known) == 0 {
+		return nil, fmt.Errorf("unknown Home Assistant instance %q", name)
+	}
+	return nil, fmt.Errorf("unknown Home Assistant instance %q, configured: %s", name, strings.Join(known, ", "))
+}
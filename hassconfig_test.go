@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+// hassInstancesFromEnv loads the default configuration with env as the
+// environment and returns its Home Assistant instances.
+func hassInstancesFromEnv(env map[string]string) (map[string]*hassInstance, error) {
+	config, err := loadConfig("", fakeEnv(env))
+	if err != nil {
+		return nil, err
+	}
+	return config.hass, nil
+}
+
+func TestHassInstancesFromEnv(t *testing.T) {
+	instances, err := hassInstancesFromEnv(map[string]string{
+		"HASS_API_KEY":          "defaultToken",
+		"HASS_INSTANCES":        "cabin, Staging",
+		"HASS_CABIN_URL":        "https://cabin.example:8123/",
+		"HASS_CABIN_API_KEY":    "cabinToken",
+		"HASS_STAGING_URL":      "http://staging.lan:8123/api",
+		"HASS_STAGING_API_KEY":  "stagingToken",
+		"HASS_STAGING_INSECURE": "ignored",
+	})
+	require.Nil(t, err)
+	require.Len(t, instances, 3)
+
+	require.Equal(t, "http://home-assistant.home.lan:8123/api/states", instances[""].endpoint("states"))
+	require.Equal(t, "defaultToken", instances[""].Token)
+	require.Equal(t, "https://cabin.example:8123/api/states", instances["cabin"].endpoint("states"))
+	require.Equal(t, "cabinToken", instances["cabin"].Token)
+	require.Equal(t, "http://staging.lan:8123/api/", instances["staging"].endpoint(""))
+	require.Nil(t, instances["cabin"].httpReq)
+}
+
+func TestHassInstancesFromEnvErrors(t *testing.T) {
+	cases := []struct {
+		env           map[string]string
+		expectedError string
+	}{
+		{map[string]string{"HASS_URL": "ftp://home.lan"}, `invalid URL "ftp://home.lan"`},
+		{map[string]string{"HASS_URL": "home.lan:8123"}, "invalid URL"},
+		{map[string]string{"HASS_INSTANCES": "cabin"}, `instance "cabin": no URL given`},
+		{map[string]string{"HASS_INSECURE_SKIP_VERIFY": "maybe"}, "invalid HASS_INSECURE_SKIP_VERIFY"},
+		{map[string]string{"HASS_CA_FILE": "itdoesnotexist.pem"}, "could not read CA bundle"},
+	}
+
+	for _, c := range cases {
+		_, err := hassInstancesFromEnv(c.env)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+}
+
+func TestHassInstanceTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"message":"API running."}`)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.Nil(t, os.WriteFile(caFile, caPem, 0600))
+
+	badCaFile := filepath.Join(t.TempDir(), "bad.pem")
+	require.Nil(t, os.WriteFile(badCaFile, []byte("not a certificate"), 0600))
+
+	cases := []struct {
+		env         map[string]string
+		expectError bool
+	}{
+		{map[string]string{"HASS_URL": server.URL, "HASS_CA_FILE": caFile}, false},
+		{map[string]string{"HASS_URL": server.URL, "HASS_INSECURE_SKIP_VERIFY": "true"}, false},
+		{map[string]string{"HASS_URL": server.URL}, true},
+	}
+
+	for _, c := range cases {
+		instances, err := hassInstancesFromEnv(c.env)
+		require.Nil(t, err)
+
+		hass := instances[""]
+		output, err := getFromHass(hass.requests(newHttpRequests(nil)), hass.endpoint(""), hass.Token)
+		if c.expectError {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			require.Contains(t, output, "message: API running.")
+		}
+	}
+
+	_, err := hassInstancesFromEnv(map[string]string{"HASS_CA_FILE": badCaFile})
+	require.Contains(t, err.Error(), "no certificates found")
+}
+
+func TestCommandTarget(t *testing.T) {
+	require.Equal(t, "cabin", commandTarget(createTextMessage("home@cabin states")))
+	require.Equal(t, "cabin", commandTarget(createTextMessage("!home@Cabin")))
+	require.Equal(t, "", commandTarget(createTextMessage("home states")))
+	require.Equal(t, "", commandTarget(createNonTextMessage("")))
+
+	cmd, args, ok := commands.Match("home@cabin states")
+	require.True(t, ok)
+	require.Equal(t, "home", cmd.Name())
+	require.Equal(t, []string{"states"}, args)
+}
+
+func TestHomeCommandInstance(t *testing.T) {
+	saved := hassInstances
+	t.Cleanup(func() { hassInstances = saved })
+
+	hassInstances = map[string]*hassInstance{
+		"":      {Url: "http://default.lan:8123", Token: "defaultToken"},
+		"cabin": {Name: "cabin", Url: "https://cabin.example:8123", Token: "cabinToken"},
+	}
+
+	msg := createTextMessage("home@cabin config")
+
+	httpReq := mocks.NewRequests(t)
+	hassReq, _ := http.NewRequest("GET", "https://cabin.example:8123/api/config", http.NoBody)
+	httpReq.On("NewRequest", "GET", "https://cabin.example:8123/api/config", mock.Anything).Return(hassReq, nil)
+	httpReq.On("Do", hassReq).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(`{"location_name":"Cabin"}`)),
+	}, nil)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "HASS says: \n```\nlocation_name: Cabin\n\n```").Return(kbchat.SendResponse{}, nil)
+
+	require.Nil(t, homeCommand(kbc, msg, httpReq, []string{"config"}))
+	require.Equal(t, []string{"Bearer cabinToken"}, hassReq.Header["Authorization"])
+
+	unknown := createTextMessage("home@beach config")
+	err := homeCommand(kbc, unknown, httpReq, []string{"config"})
+	require.EqualError(t, err, `unknown Home Assistant instance "beach", configured: cabin`)
+	require.Equal(t, KindInput, classifyError(err).Kind)
+}
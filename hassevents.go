@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultAlertMessage = "{{.Name}} changed from {{.OldState}} to {{.State}}"
+
+// alertRule posts a message to Channel when Home Assistant reports a
+// matching event. A rule either filters state_changed events by Entity (a
+// glob), From and To, or hands Trigger to Home Assistant as-is through
+// subscribe_trigger. Message is a text/template over alertEvent.
+type alertRule struct {
+	Instance string                 `yaml:"instance"`
+	Entity   string                 `yaml:"entity"`
+	From     string                 `yaml:"from"`
+	To       string                 `yaml:"to"`
+	Trigger  map[string]interface{} `yaml:"trigger"`
+	Channel  string                 `yaml:"channel"`
+	Message  string                 `yaml:"message"`
+
+	channel  chat1.ChatChannel
+	template *template.Template
+}
+
+type alertConfig struct {
+	Rules []*alertRule `yaml:"rules"`
+}
+
+// alertEvent is what an alert message template is rendered with.
+type alertEvent struct {
+	Instance   string
+	Entity     string
+	Name       string
+	State      string
+	OldState   string
+	Attributes map[string]interface{}
+}
+
+var (
+	alertRules []*alertRule
+
+	// eventsPolicy controls how quickly a lost event subscription is
+	// re-opened. Alerts retry forever.
+	eventsPolicy = backoffPolicy{
+		Initial:    time.Second,
+		Max:        2 * time.Minute,
+		Multiplier: 2,
+	}
+)
+
+func loadAlertRules(path string) ([]*alertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read alerts file: %s", err.Error())
+	}
+
+	config := new(alertConfig)
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("could not parse alerts file: %s", err.Error())
+	}
+
+	if err := validateAlertRules(config.Rules); err != nil {
+		return nil, err
+	}
+	return config.Rules, nil
+}
+
+func validateAlertRules(rules []*alertRule) error {
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("alert rule %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *alertRule) validate() error {
+	if r.Channel == "" {
+		return errors.New("no channel given")
+	}
+	r.channel = parseChannel(r.Channel)
+	r.Instance = strings.ToLower(r.Instance)
+
+	if r.Trigger != nil {
+		if r.Entity != "" || r.From != "" || r.To != "" {
+			return errors.New("entity, from and to cannot be combined with trigger")
+		}
+		r.Trigger = jsonMap(r.Trigger).(map[string]interface{})
+	} else {
+		if r.Entity == "" {
+			return errors.New("either entity or trigger must be given")
+		}
+		if _, err := path.Match(r.Entity, ""); err != nil {
+			return fmt.Errorf("invalid entity pattern %q", r.Entity)
+		}
+	}
+
+	message := r.Message
+	if message == "" {
+		message = defaultAlertMessage
+	}
+	tmpl, err := template.New("alert").Parse(message)
+	if err != nil {
+		return fmt.Errorf("invalid message: %s", err.Error())
+	}
+	r.template = tmpl
+	return nil
+}
+
+// jsonMap converts the map[interface{}]interface{} values produced by the
+// YAML decoder into maps that encoding/json can marshal.
+func jsonMap(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonMap(item)
+		}
+		return converted
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonMap(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonMap(item)
+		}
+		return v
+	}
+	return value
+}
+
+// matches reports whether a state change of entity from oldState to
+// newState should fire this rule. Changes that only touch attributes never
+// fire.
+func (r *alertRule) matches(entity string, oldState string, newState string) bool {
+	if r.Trigger != nil || oldState == newState {
+		return false
+	}
+	if ok, _ := path.Match(r.Entity, entity); !ok {
+		return false
+	}
+	if r.From != "" && r.From != oldState {
+		return false
+	}
+	return r.To == "" || r.To == newState
+}
+
+func (r *alertRule) render(event alertEvent) (string, error) {
+	var b strings.Builder
+	if err := r.template.Execute(&b, event); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func newAlertEvent(instance string, entity string, oldState *hassState, newState *hassState) alertEvent {
+	event := alertEvent{Instance: instance, Entity: entity, Name: entity}
+	if oldState != nil {
+		event.OldState = oldState.State
+	}
+	if newState != nil {
+		event.State = newState.State
+		event.Attributes = newState.Attributes
+		if name, ok := newState.Attributes["friendly_name"].(string); ok && name != "" {
+			event.Name = name
+		}
+	}
+	return event
+}
+
+// hassWsMessage is any message received from the Home Assistant WebSocket
+// API.
+type hassWsMessage struct {
+	Id      int    `json:"id"`
+	Type    string `json:"type"`
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Event json.RawMessage `json:"event"`
+}
+
+type hassStateChange struct {
+	EventType string `json:"event_type"`
+	Data      struct {
+		EntityId string     `json:"entity_id"`
+		OldState *hassState `json:"old_state"`
+		NewState *hassState `json:"new_state"`
+	} `json:"data"`
+}
+
+type hassTriggerEvent struct {
+	Variables struct {
+		Trigger struct {
+			EntityId    string     `json:"entity_id"`
+			Description string     `json:"description"`
+			FromState   *hassState `json:"from_state"`
+			ToState     *hassState `json:"to_state"`
+		} `json:"trigger"`
+	} `json:"variables"`
+}
+
+var errHassAuth = errors.New("Home Assistant rejected the access token")
+
+// hassEventStream is one authenticated connection to the WebSocket API of
+// a Home Assistant instance.
+type hassEventStream struct {
+	hass *hassInstance
+	conn *websocket.Conn
+
+	nextId int
+	// rules holds the rules served by each subscription id.
+	rules map[int][]*alertRule
+}
+
+// dialHassEvents connects to hass and completes the auth handshake.
+func dialHassEvents(ctx context.Context, hass *hassInstance) (*hassEventStream, error) {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: httpConnectTimeout,
+		TLSClientConfig:  hass.tlsConfig,
+	}
+	conn, _, err := dialer.DialContext(ctx, hass.websocketUrl(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %s", err.Error())
+	}
+
+	stream := &hassEventStream{hass: hass, conn: conn, rules: make(map[int][]*alertRule)}
+	if err := stream.authenticate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *hassEventStream) authenticate() error {
+	s.conn.SetReadDeadline(time.Now().Add(httpTimeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	var msg hassWsMessage
+	if err := s.conn.ReadJSON(&msg); err != nil {
+		return fmt.Errorf("could not read auth request: %s", err.Error())
+	}
+	if msg.Type != "auth_required" {
+		return fmt.Errorf("unexpected %q message during auth", msg.Type)
+	}
+
+	if err := s.conn.WriteJSON(map[string]string{"type": "auth", "access_token": s.hass.Token}); err != nil {
+		return fmt.Errorf("could not send auth: %s", err.Error())
+	}
+
+	if err := s.conn.ReadJSON(&msg); err != nil {
+		return fmt.Errorf("could not read auth result: %s", err.Error())
+	}
+	switch msg.Type {
+	case "auth_ok":
+		return nil
+	case "auth_invalid":
+		return fmt.Errorf("%w: %s", errHassAuth, msg.Message)
+	}
+	return fmt.Errorf("unexpected %q message during auth", msg.Type)
+}
+
+// subscribe asks for state_changed events on behalf of all entity rules
+// and for one trigger per trigger rule.
+func (s *hassEventStream) subscribe(rules []*alertRule) error {
+	var entityRules []*alertRule
+	for _, rule := range rules {
+		if rule.Trigger == nil {
+			entityRules = append(entityRules, rule)
+			continue
+		}
+		if err := s.send(map[string]interface{}{"type": "subscribe_trigger", "trigger": rule.Trigger}, rule); err != nil {
+			return err
+		}
+	}
+
+	if len(entityRules) > 0 {
+		return s.send(map[string]interface{}{"type": "subscribe_events", "event_type": "state_changed"}, entityRules...)
+	}
+	return nil
+}
+
+func (s *hassEventStream) send(request map[string]interface{}, rules ...*alertRule) error {
+	s.nextId++
+	request["id"] = s.nextId
+	if err := s.conn.WriteJSON(request); err != nil {
+		return fmt.Errorf("could not send %s: %s", request["type"], err.Error())
+	}
+	s.rules[s.nextId] = rules
+	return nil
+}
+
+// run reads events until the connection fails, posting an alert to kbc
+// for every rule they fire. A rejected subscription ends the stream.
+func (s *hassEventStream) run(kbc KeyBaseChat) error {
+	for {
+		var msg hassWsMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("connection lost: %s", err.Error())
+		}
+
+		switch msg.Type {
+		case "result":
+			if !msg.Success {
+				reason := "unknown error"
+				if msg.Error != nil {
+					reason = msg.Error.Message
+				}
+				return fmt.Errorf("subscription %d rejected: %s", msg.Id, reason)
+			}
+		case "event":
+			s.dispatch(kbc, msg)
+		}
+	}
+}
+
+func (s *hassEventStream) dispatch(kbc KeyBaseChat, msg hassWsMessage) {
+	rules := s.rules[msg.Id]
+	if len(rules) == 0 {
+		return
+	}
+
+	if rules[0].Trigger != nil {
+		var event hassTriggerEvent
+		if err := json.Unmarshal(msg.Event, &event); err != nil {
+			logger.Warn("could not decode trigger event", "instance", s.hass.Name, "error", err)
+			return
+		}
+		trigger := event.Variables.Trigger
+		alert := newAlertEvent(s.hass.Name, trigger.EntityId, trigger.FromState, trigger.ToState)
+		if trigger.EntityId == "" {
+			alert.Name = trigger.Description
+		}
+		postAlert(kbc, rules[0], alert)
+		return
+	}
+
+	var event hassStateChange
+	if err := json.Unmarshal(msg.Event, &event); err != nil {
+		logger.Warn("could not decode state change", "instance", s.hass.Name, "error", err)
+		return
+	}
+	alert := newAlertEvent(s.hass.Name, event.Data.EntityId, event.Data.OldState, event.Data.NewState)
+	for _, rule := range rules {
+		if rule.matches(alert.Entity, alert.OldState, alert.State) {
+			postAlert(kbc, rule, alert)
+		}
+	}
+}
+
+func (s *hassEventStream) close() {
+	s.conn.Close()
+}
+
+func postAlert(kbc KeyBaseChat, rule *alertRule, event alertEvent) {
+	text, err := rule.render(event)
+	if err != nil {
+		logger.Warn("could not render alert", "entity", event.Entity, "error", err)
+		return
+	}
+	if _, err := kbc.SendMessage(rule.channel, redactSecrets(text)); err != nil {
+		logger.Warn("could not post alert", "entity", event.Entity, "channel", rule.Channel, "error", err)
+		return
+	}
+	logger.Info("alert posted", "entity", event.Entity, "channel", rule.Channel)
+}
+
+// watchEvents subscribes to every instance that alert rules refer to and
+// posts alerts until ctx is cancelled.
+func watchEvents(ctx context.Context, kbc KeyBaseChat, rules []*alertRule) {
+	byInstance := make(map[string][]*alertRule)
+	for _, rule := range rules {
+		byInstance[rule.Instance] = append(byInstance[rule.Instance], rule)
+	}
+
+	var wg sync.WaitGroup
+	for name, instanceRules := range byInstance {
+		hass, ok := hassInstances[name]
+		if !ok {
+			logger.Error("alert rules refer to unknown Home Assistant instance", "instance", name)
+			continue
+		}
+
+		wg.Add(1)
+		go func(hass *hassInstance, rules []*alertRule) {
+			defer wg.Done()
+			watchInstance(ctx, kbc, hass, rules)
+		}(hass, instanceRules)
+	}
+	wg.Wait()
+}
+
+// watchInstance keeps an event subscription to hass open, reconnecting
+// with eventsPolicy, until ctx is cancelled.
+func watchInstance(ctx context.Context, kbc KeyBaseChat, hass *hassInstance, rules []*alertRule) {
+	attempt := 0
+	for {
+		stream, err := dialHassEvents(ctx, hass)
+		if err == nil {
+			err = stream.subscribe(rules)
+		}
+		if err == nil {
+			logger.Info("subscribed to Home Assistant events", "instance", hass.Name, "rules", len(rules))
+			attempt = 0
+
+			stop := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					stream.close()
+				case <-stop:
+				}
+			}()
+			err = stream.run(kbc)
+			close(stop)
+		}
+		if stream != nil {
+			stream.close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := eventsPolicy.delay(attempt)
+		attempt++
+		logger.Warn("Home Assistant event subscription lost", "instance", hass.Name, "error", err, "delay", wait.Round(time.Millisecond), "attempt", attempt)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
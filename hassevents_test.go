@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHassWs is a stand-in for the Home Assistant WebSocket API. It
+// accepts the token "test-token", acknowledges subscriptions and then
+// hands the connection to session along with the subscribe requests it
+// received.
+type fakeHassWs struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	sessions int
+	session  func(n int, conn *websocket.Conn, subscriptions []map[string]interface{})
+	expected int
+}
+
+func newFakeHassWs(t *testing.T, expected int, session func(n int, conn *websocket.Conn, subscriptions []map[string]interface{})) *fakeHassWs {
+	fake := &fakeHassWs{session: session, expected: expected}
+	upgrader := websocket.Upgrader{}
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/websocket", r.URL.Path)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(map[string]string{"type": "auth_required", "ha_version": "2022.4.0"})
+		var auth map[string]string
+		if conn.ReadJSON(&auth) != nil {
+			return
+		}
+		if auth["type"] != "auth" || auth["access_token"] != "test-token" {
+			conn.WriteJSON(map[string]string{"type": "auth_invalid", "message": "Invalid access token or password"})
+			return
+		}
+		conn.WriteJSON(map[string]string{"type": "auth_ok"})
+
+		var subscriptions []map[string]interface{}
+		for len(subscriptions) < fake.expected {
+			var sub map[string]interface{}
+			if conn.ReadJSON(&sub) != nil {
+				return
+			}
+			subscriptions = append(subscriptions, sub)
+		}
+
+		fake.mu.Lock()
+		fake.sessions++
+		n := fake.sessions
+		fake.mu.Unlock()
+		fake.session(n, conn, subscriptions)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeHassWs) instance(token string) *hassInstance {
+	return &hassInstance{Url: f.URL, Token: token}
+}
+
+func acknowledge(conn *websocket.Conn, sub map[string]interface{}) {
+	conn.WriteJSON(map[string]interface{}{"id": sub["id"], "type": "result", "success": true, "result": nil})
+}
+
+func stateChanged(id interface{}, entity string, from string, to string, name string) map[string]interface{} {
+	state := func(value string) map[string]interface{} {
+		return map[string]interface{}{
+			"entity_id":  entity,
+			"state":      value,
+			"attributes": map[string]interface{}{"friendly_name": name},
+		}
+	}
+	return map[string]interface{}{
+		"id":   id,
+		"type": "event",
+		"event": map[string]interface{}{
+			"event_type": "state_changed",
+			"data":       map[string]interface{}{"entity_id": entity, "old_state": state(from), "new_state": state(to)},
+		},
+	}
+}
+
+func writeAlertRules(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "alerts.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func mustLoadAlertRules(t *testing.T, content string) []*alertRule {
+	rules, err := loadAlertRules(writeAlertRules(t, content))
+	require.Nil(t, err)
+	return rules
+}
+
+func useEventsPolicy(t *testing.T) {
+	saved := eventsPolicy
+	t.Cleanup(func() { eventsPolicy = saved })
+	eventsPolicy = backoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+}
+
+func TestLoadAlertRules(t *testing.T) {
+	rules := mustLoadAlertRules(t, `
+rules:
+  - entity: binary_sensor.*_door
+    to: "on"
+    channel: home#alerts
+    message: "{{.Name}} opened"
+  - instance: Cabin
+    trigger:
+      platform: numeric_state
+      entity_id: sensor.power
+      above: 3000
+    channel: janik
+`)
+	require.Len(t, rules, 2)
+
+	require.Equal(t, chat1.ChatChannel{Name: "home", MembersType: "team", TopicName: "alerts", TopicType: "chat"}, rules[0].channel)
+	require.True(t, rules[0].matches("binary_sensor.front_door", "off", "on"))
+	require.False(t, rules[0].matches("binary_sensor.front_door", "on", "off"))
+	require.False(t, rules[0].matches("binary_sensor.front_door", "on", "on"))
+	require.False(t, rules[0].matches("binary_sensor.window", "off", "on"))
+
+	require.Equal(t, "cabin", rules[1].Instance)
+	require.False(t, rules[1].matches("sensor.power", "1", "2"))
+	trigger, err := json.Marshal(rules[1].Trigger)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"platform":"numeric_state","entity_id":"sensor.power","above":3000}`, string(trigger))
+
+	text, err := rules[1].render(alertEvent{Name: "Power", OldState: "2000", State: "3500"})
+	require.Nil(t, err)
+	require.Equal(t, "Power changed from 2000 to 3500", text)
+}
+
+func TestLoadAlertRulesErrors(t *testing.T) {
+	cases := []struct {
+		content       string
+		expectedError string
+	}{
+		{"rules:\n  - entity: light.*\n", "alert rule 1: no channel given"},
+		{"rules:\n  - channel: home\n", "either entity or trigger must be given"},
+		{"rules:\n  - channel: home\n    entity: light.x\n    trigger: {platform: state}\n", "cannot be combined with trigger"},
+		{"rules:\n  - channel: home\n    entity: \"light.[\"\n", "invalid entity pattern"},
+		{"rules:\n  - channel: home\n    entity: light.x\n    message: \"{{.Name\"\n", "invalid message"},
+		{"rules:\n  - channel: home\n    entity: light.x\n    typo: true\n", "could not parse alerts file"},
+	}
+
+	for _, c := range cases {
+		_, err := loadAlertRules(writeAlertRules(t, c.content))
+		require.NotNil(t, err, c.content)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+
+	_, err := loadAlertRules("itdoesnotexist.yaml")
+	require.Contains(t, err.Error(), "could not read alerts file")
+}
+
+func TestDialHassEventsAuth(t *testing.T) {
+	fake := newFakeHassWs(t, 0, func(int, *websocket.Conn, []map[string]interface{}) {})
+
+	stream, err := dialHassEvents(context.Background(), fake.instance("test-token"))
+	require.Nil(t, err)
+	stream.close()
+
+	_, err = dialHassEvents(context.Background(), fake.instance("wrong"))
+	require.True(t, errors.Is(err, errHassAuth))
+	require.Contains(t, err.Error(), "Invalid access token")
+
+	_, err = dialHassEvents(context.Background(), &hassInstance{Url: "http://127.0.0.1:1"})
+	require.Contains(t, err.Error(), "could not connect")
+}
+
+func TestHassEventStreamRejectedSubscription(t *testing.T) {
+	rules := mustLoadAlertRules(t, "rules:\n  - channel: home\n    trigger: {platform: bogus}\n")
+	fake := newFakeHassWs(t, 1, func(n int, conn *websocket.Conn, subscriptions []map[string]interface{}) {
+		conn.WriteJSON(map[string]interface{}{
+			"id":      subscriptions[0]["id"],
+			"type":    "result",
+			"success": false,
+			"error":   map[string]string{"code": "invalid_format", "message": "Invalid platform 'bogus'"},
+		})
+		var ignored interface{}
+		conn.ReadJSON(&ignored)
+	})
+
+	stream, err := dialHassEvents(context.Background(), fake.instance("test-token"))
+	require.Nil(t, err)
+	defer stream.close()
+
+	require.Nil(t, stream.subscribe(rules))
+	err = stream.run(mocks.NewKeyBaseChat(t))
+	require.Contains(t, err.Error(), "subscription 1 rejected: Invalid platform 'bogus'")
+}
+
+func TestWatchInstance(t *testing.T) {
+	useEventsPolicy(t)
+
+	rules := mustLoadAlertRules(t, `
+rules:
+  - entity: binary_sensor.*_door
+    to: "on"
+    channel: home#alerts
+    message: "{{.Name}} opened"
+  - trigger:
+      platform: numeric_state
+      entity_id: sensor.power
+      above: 3000
+    channel: janik
+    message: "Power is at {{.State}} W"
+`)
+
+	var requests [][]map[string]interface{}
+	fake := newFakeHassWs(t, 2, func(n int, conn *websocket.Conn, subscriptions []map[string]interface{}) {
+		requests = append(requests, subscriptions)
+		trigger, events := subscriptions[0], subscriptions[1]
+		acknowledge(conn, trigger)
+		acknowledge(conn, events)
+
+		if n == 1 {
+			conn.WriteJSON(stateChanged(events["id"], "binary_sensor.front_door", "off", "on", "Front door"))
+			conn.WriteJSON(stateChanged(events["id"], "binary_sensor.front_door", "on", "on", "Front door"))
+			conn.WriteJSON(stateChanged(events["id"], "light.kitchen", "off", "on", "Kitchen"))
+			conn.WriteJSON(map[string]interface{}{
+				"id":   trigger["id"],
+				"type": "event",
+				"event": map[string]interface{}{
+					"variables": map[string]interface{}{
+						"trigger": map[string]interface{}{
+							"platform":   "numeric_state",
+							"entity_id":  "sensor.power",
+							"from_state": map[string]interface{}{"entity_id": "sensor.power", "state": "2800"},
+							"to_state":   map[string]interface{}{"entity_id": "sensor.power", "state": "3100"},
+						},
+					},
+				},
+			})
+			// drop the connection to force a reconnect
+			return
+		}
+
+		conn.WriteJSON(stateChanged(events["id"], "binary_sensor.back_door", "off", "on", "Back door"))
+		var ignored interface{}
+		conn.ReadJSON(&ignored)
+	})
+
+	posted := make(chan string, 10)
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", parseChannel("home#alerts"), mock.Anything).Return(kbchat.SendResponse{}, nil).Run(func(args mock.Arguments) {
+		posted <- args.String(1)
+	})
+	kbc.On("SendMessage", parseChannel("janik"), mock.Anything).Return(kbchat.SendResponse{}, nil).Run(func(args mock.Arguments) {
+		posted <- args.String(1)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchInstance(ctx, kbc, fake.instance("test-token"), rules)
+		close(done)
+	}()
+
+	for _, expected := range []string{"Front door opened", "Power is at 3100 W", "Back door opened"} {
+		select {
+		case text := <-posted:
+			require.Equal(t, expected, text)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchInstance did not stop")
+	}
+
+	require.Len(t, requests, 2)
+	require.Equal(t, "subscribe_trigger", requests[0][0]["type"])
+	require.Equal(t, map[string]interface{}{"platform": "numeric_state", "entity_id": "sensor.power", "above": float64(3000)}, requests[0][0]["trigger"])
+	require.Equal(t, "subscribe_events", requests[0][1]["type"])
+	require.Equal(t, "state_changed", requests[0][1]["event_type"])
+	require.Equal(t, float64(2), requests[1][1]["id"])
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+const (
+	defaultHistorySince = 24 * time.Hour
+
+	// maxHistoryLines caps the transitions and logbook entries listed.
+	maxHistoryLines = 15
+	// maxSparkWidth caps the blocks in a sparkline, so a busy sensor
+	// still fits in one message.
+	maxSparkWidth = 48
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// hassLogbookEntry is one entry returned by /api/logbook.
+type hassLogbookEntry struct {
+	When     time.Time `json:"when"`
+	Name     string    `json:"name"`
+	Message  string    `json:"message"`
+	State    string    `json:"state"`
+	EntityId string    `json:"entity_id"`
+}
+
+func homeHistoryCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error {
+	since, rest, err := parseSince(args)
+	if err != nil || len(rest) != 1 {
+		return inputError("usage: home history <entity_id> [since <duration>]")
+	}
+	entity := rest[0]
+
+	now := timeNow()
+	query := url.Values{"filter_entity_id": {entity}, "end_time": {now.UTC().Format(time.RFC3339)}}
+	hassUrl := hass.endpoint(fmt.Sprintf("history/period/%s?%s", now.Add(-since).UTC().Format(time.RFC3339), query.Encode()))
+
+	var history [][]hassState
+	if err := fetchFromHass(httpReq, hassUrl, hass.Token, &history); err != nil {
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+
+	var states []hassState
+	if len(history) > 0 {
+		states = history[0]
+	}
+	if len(states) == 0 {
+		return reply(kbc, msg, fmt.Sprintf("no history for %s in the last %s", entity, formatSince(since)))
+	}
+	return reply(kbc, msg, summarizeHistory(entity, states, since, now))
+}
+
+func homeLogbookCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error {
+	since, rest, err := parseSince(args)
+	if err != nil || len(rest) > 1 {
+		return inputError("usage: home logbook [entity_id] [since <duration>]")
+	}
+
+	now := timeNow()
+	query := url.Values{"end_time": {now.UTC().Format(time.RFC3339)}}
+	if len(rest) == 1 {
+		query.Set("entity", rest[0])
+	}
+	hassUrl := hass.endpoint(fmt.Sprintf("logbook/%s?%s", now.Add(-since).UTC().Format(time.RFC3339), query.Encode()))
+
+	var entries []hassLogbookEntry
+	if err := fetchFromHass(httpReq, hassUrl, hass.Token, &entries); err != nil {
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return reply(kbc, msg, fmt.Sprintf("no logbook entries in the last %s", formatSince(since)))
+	}
+	return reply(kbc, msg, renderLogbook(entries, now))
+}
+
+// parseSince removes a trailing "since <duration>" or bare duration from
+// args. Durations accept Go syntax plus a "d" suffix for days.
+func parseSince(args []string) (time.Duration, []string, error) {
+	if len(args) == 0 {
+		return defaultHistorySince, args, nil
+	}
+
+	last := args[len(args)-1]
+	rest := args[:len(args)-1]
+	if len(rest) > 0 && strings.EqualFold(rest[len(rest)-1], "since") {
+		rest = rest[:len(rest)-1]
+	} else if _, err := parseDuration(last); err != nil {
+		// not a duration, so the last argument is not a "since" clause
+		return defaultHistorySince, args, nil
+	}
+
+	since, err := parseDuration(last)
+	if err != nil {
+		return 0, nil, err
+	}
+	return since, rest, nil
+}
+
+func parseDuration(raw string) (time.Duration, error) {
+	if strings.HasSuffix(raw, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(raw, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", raw)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", raw)
+	}
+	return d, nil
+}
+
+func formatSince(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
+
+// summarizeHistory lists the state transitions of entity, prefixed with a
+// sparkline when every state is numeric.
+func summarizeHistory(entity string, states []hassState, since time.Duration, now time.Time) string {
+	var transitions []hassState
+	for i, state := range states {
+		if i == 0 || state.State != states[i-1].State {
+			transitions = append(transitions, state)
+		}
+	}
+
+	changes := fmt.Sprintf("%d changes", len(transitions)-1)
+	if len(transitions) == 2 {
+		changes = "1 change"
+	}
+	lines := []string{fmt.Sprintf("%s over the last %s: %s", entity, formatSince(since), changes)}
+
+	if values, ok := numericStates(states); ok {
+		low, high := values[0], values[0]
+		for _, v := range values {
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+		lines = append(lines, fmt.Sprintf("`%s` min %g, max %g, now %g", sparkline(values), low, high, values[len(values)-1]))
+	}
+
+	start := 0
+	if len(transitions) > maxHistoryLines {
+		start = len(transitions) - maxHistoryLines
+		lines = append(lines, fmt.Sprintf("(%d earlier changes omitted)", start))
+	}
+	for _, state := range transitions[start:] {
+		lines = append(lines, fmt.Sprintf("- %s: %s", relativeTime(state.LastChanged, now), state.State))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// numericStates parses every state as a number, skipping unavailable and
+// unknown states; ok is false if any other state is not numeric.
+func numericStates(states []hassState) ([]float64, bool) {
+	var values []float64
+	for _, state := range states {
+		if state.State == "unavailable" || state.State == "unknown" {
+			continue
+		}
+		v, err := strconv.ParseFloat(state.State, 64)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, len(values) > 0
+}
+
+// sparkline draws values as block characters scaled between their minimum
+// and maximum, averaging neighbours when there are more than
+// maxSparkWidth.
+func sparkline(values []float64) string {
+	values = downsample(values, maxSparkWidth)
+	low, high := values[0], values[0]
+	for _, v := range values {
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if high > low {
+			i = int(math.Round((v - low) / (high - low) * float64(len(sparkBlocks)-1)))
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+	return b.String()
+}
+
+// downsample splits values into width buckets of consecutive values and
+// returns the average of each.
+func downsample(values []float64, width int) []float64 {
+	if len(values) <= width {
+		return values
+	}
+
+	averages := make([]float64, width)
+	for i := range averages {
+		bucket := values[i*len(values)/width : (i+1)*len(values)/width]
+		sum := 0.0
+		for _, v := range bucket {
+			sum += v
+		}
+		averages[i] = sum / float64(len(bucket))
+	}
+	return averages
+}
+
+func renderLogbook(entries []hassLogbookEntry, now time.Time) string {
+	var lines []string
+	start := 0
+	if len(entries) > maxHistoryLines {
+		start = len(entries) - maxHistoryLines
+		lines = append(lines, fmt.Sprintf("(%d earlier entries omitted)", start))
+	}
+
+	for _, entry := range entries[start:] {
+		text := entry.Message
+		if text == "" {
+			text = fmt.Sprintf("changed to %s", entry.State)
+		}
+		lines = append(lines, fmt.Sprintf("- %s: %s %s", relativeTime(entry.When, now), entry.Name, text))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSince(t *testing.T) {
+	cases := []struct {
+		args          []string
+		expectedSince time.Duration
+		expectedRest  []string
+		expectError   bool
+	}{
+		{[]string{}, defaultHistorySince, []string{}, false},
+		{[]string{"sensor.temp"}, defaultHistorySince, []string{"sensor.temp"}, false},
+		{[]string{"sensor.temp", "since", "6h"}, time.Hour * 6, []string{"sensor.temp"}, false},
+		{[]string{"sensor.temp", "90m"}, time.Minute * 90, []string{"sensor.temp"}, false},
+		{[]string{"since", "2d"}, time.Hour * 48, []string{}, false},
+		{[]string{"sensor.temp", "since", "yesterday"}, 0, nil, true},
+		{[]string{"since", "-1h"}, 0, nil, true},
+	}
+
+	for _, c := range cases {
+		since, rest, err := parseSince(c.args)
+		if c.expectError {
+			require.NotNil(t, err, c.args)
+			continue
+		}
+		require.Nil(t, err, c.args)
+		require.Equal(t, c.expectedSince, since, c.args)
+		require.Equal(t, c.expectedRest, rest, c.args)
+	}
+}
+
+func TestFormatSince(t *testing.T) {
+	require.Equal(t, "6h", formatSince(time.Hour*6))
+	require.Equal(t, "1h30m", formatSince(time.Minute*90))
+	require.Equal(t, "30s", formatSince(time.Second*30))
+	require.Equal(t, "2d", formatSince(time.Hour*48))
+}
+
+func TestSparkline(t *testing.T) {
+	require.Equal(t, "▁▅█", sparkline([]float64{0, 5, 10}))
+	require.Equal(t, "▁▁▁", sparkline([]float64{3, 3, 3}))
+
+	// a busy sensor is averaged down to a fixed width
+	values := make([]float64, 5000)
+	for i := range values {
+		values[i] = float64(i % 7)
+	}
+	values[4999] = 100
+	line := []rune(sparkline(values))
+	require.Len(t, line, maxSparkWidth)
+	require.Equal(t, '█', line[maxSparkWidth-1])
+	require.Equal(t, []float64{1.5, 3.5}, downsample([]float64{1, 2, 3, 4}, 2))
+}
+
+func TestSummarizeHistoryLong(t *testing.T) {
+	states := make([]hassState, 5000)
+	for i := range states {
+		states[i] = hassState{State: strconv.Itoa(200 + i%50), LastChanged: testNow.Add(time.Duration(i-5000) * 15 * time.Second)}
+	}
+
+	summary := summarizeHistory("sensor.power", states, defaultHistorySince, testNow)
+	require.Less(t, len(summary), 2000)
+	require.Contains(t, summary, "(4985 earlier changes omitted)")
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	states := []hassState{
+		{State: "10", LastChanged: testNow.Add(-time.Hour * 5)},
+		{State: "10", LastChanged: testNow.Add(-time.Hour * 4)},
+		{State: "unavailable", LastChanged: testNow.Add(-time.Hour * 3)},
+		{State: "20", LastChanged: testNow.Add(-time.Hour * 2)},
+		{State: "15", LastChanged: testNow.Add(-time.Minute * 10)},
+	}
+
+	expected := "sensor.power over the last 6h: 3 changes\n" +
+		"`▁▁█▅` min 10, max 20, now 15\n" +
+		"- 5h ago: 10\n" +
+		"- 3h ago: unavailable\n" +
+		"- 2h ago: 20\n" +
+		"- 10m ago: 15"
+	require.Equal(t, expected, summarizeHistory("sensor.power", states, time.Hour*6, testNow))
+
+	door := []hassState{
+		{State: "closed", LastChanged: testNow.Add(-time.Hour * 5)},
+		{State: "open", LastChanged: testNow.Add(-time.Hour * 2)},
+	}
+	require.Equal(t, "cover.garage over the last 1d: 1 change\n- 5h ago: closed\n- 2h ago: open", summarizeHistory("cover.garage", door, time.Hour*24, testNow))
+
+	var many []hassState
+	for i := 0; i < maxHistoryLines+5; i++ {
+		state := "on"
+		if i%2 == 1 {
+			state = "off"
+		}
+		many = append(many, hassState{State: state, LastChanged: testNow})
+	}
+	require.Contains(t, summarizeHistory("light.kitchen", many, time.Hour, testNow), "(5 earlier changes omitted)")
+}
+
+func TestHomeHistoryCommand(t *testing.T) {
+	useFakeClock(t, testNow)
+
+	hassUrl := "http://home-assistant.home.lan:8123/api/history/period/2022-04-01T06:00:00Z?end_time=2022-04-01T12%3A00%3A00Z&filter_entity_id=cover.garage"
+	msg := createTextMessage("home history cover.garage since 6h")
+
+	httpReq := mockHassGet(t, hassUrl, 200, `[[
+		{"entity_id":"cover.garage","state":"closed","last_changed":"2022-04-01T06:00:00Z"},
+		{"entity_id":"cover.garage","state":"open","last_changed":"2022-04-01T11:30:00Z"}
+	]]`)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "cover.garage over the last 6h: 1 change\n- 6h ago: closed\n- 30m ago: open").Return(kbchat.SendResponse{}, nil)
+
+	require.Nil(t, homeCommand(kbc, msg, httpReq, []string{"history", "cover.garage", "since", "6h"}))
+
+	empty := mockHassGet(t, hassUrl, 200, `[]`)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "no history for cover.garage in the last 6h").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, homeCommand(kbc, msg, empty, []string{"history", "cover.garage", "6h"}))
+
+	err := homeCommand(kbc, msg, mocks.NewRequests(t), []string{"history"})
+	require.EqualError(t, err, "usage: home history <entity_id> [since <duration>]")
+}
+
+func TestHomeLogbookCommand(t *testing.T) {
+	useFakeClock(t, testNow)
+
+	hassUrl := "http://home-assistant.home.lan:8123/api/logbook/2022-03-31T12:00:00Z?end_time=2022-04-01T12%3A00%3A00Z&entity=cover.garage"
+	msg := createTextMessage("home logbook cover.garage")
+
+	httpReq := mockHassGet(t, hassUrl, 200, `[
+		{"when":"2022-04-01T07:00:00Z","name":"Garage door","message":"was opened","entity_id":"cover.garage"},
+		{"when":"2022-04-01T07:10:00Z","name":"Garage door","state":"closed","entity_id":"cover.garage"}
+	]`)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "- 5h ago: Garage door was opened\n- 4h ago: Garage door changed to closed").Return(kbchat.SendResponse{}, nil)
+
+	require.Nil(t, homeCommand(kbc, msg, httpReq, []string{"logbook", "cover.garage"}))
+
+	all := mockHassGet(t, "http://home-assistant.home.lan:8123/api/logbook/2022-04-01T10:00:00Z?end_time=2022-04-01T12%3A00%3A00Z", 200, `[]`)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "no logbook entries in the last 2h").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, homeCommand(kbc, msg, all, []string{"logbook", "since", "2h"}))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// maxStateRows keeps `home states` replies below Keybase's message limit.
+const maxStateRows = 50
+
+// timeNow is the clock used for relative times; tests replace it.
+var timeNow = time.Now
+
+func homeStateCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error {
+	if len(args) != 1 {
+		return inputError("usage: home state <entity_id>")
+	}
+
+	var state hassState
+	hassUrl := hass.endpoint("states/" + url.PathEscape(args[0]))
+	if err := fetchFromHass(httpReq, hassUrl, hass.Token, &state); err != nil {
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+
+	return reply(kbc, msg, renderStates([]hassState{state}, timeNow()))
+}
+
+func homeStatesCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error {
+	if len(args) > 1 {
+		return inputError("usage: home states [pattern]")
+	}
+
+	pattern := "*"
+	if len(args) == 1 {
+		pattern = args[0]
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return inputError("invalid pattern %q", pattern)
+	}
+
+	var states []hassState
+	if err := fetchFromHass(httpReq, hass.endpoint("states"), hass.Token, &states); err != nil {
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+
+	matched := filterStates(states, pattern)
+	if len(matched) == 0 {
+		return reply(kbc, msg, fmt.Sprintf("no entities match %q", pattern))
+	}
+	return reply(kbc, msg, renderStates(matched, timeNow()))
+}
+
+// filterStates keeps states whose entity ID matches the glob pattern,
+// sorted by entity ID.
+func filterStates(states []hassState, pattern string) []hassState {
+	var matched []hassState
+	for _, state := range states {
+		if ok, _ := path.Match(pattern, state.EntityId); ok {
+			matched = append(matched, state)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].EntityId < matched[j].EntityId
+	})
+	return matched
+}
+
+// renderStates formats states as an aligned table in a code block.
+func renderStates(states []hassState, now time.Time) string {
+	var b strings.Builder
+	b.WriteString("```\n")
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTITY\tSTATE\tUNIT\tCHANGED")
+	for i, state := range states {
+		if i == maxStateRows {
+			break
+		}
+		unit, _ := state.Attributes["unit_of_measurement"].(string)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", state.EntityId, state.State, unit, relativeTime(state.LastChanged, now))
+	}
+	w.Flush()
+
+	if len(states) > maxStateRows {
+		fmt.Fprintf(&b, "... and %d more\n", len(states)-maxStateRows)
+	}
+	b.WriteString("```")
+	return b.String()
+}
+
+// relativeTime describes t relative to now, e.g. "5m ago".
+func relativeTime(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testNow = time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+
+const testStates = `[
+	{"entity_id":"sensor.outdoor_temp","state":"12.5","attributes":{"unit_of_measurement":"°C"},"last_changed":"2022-04-01T11:55:00Z"},
+	{"entity_id":"light.kitchen","state":"on","attributes":{},"last_changed":"2022-04-01T09:00:00Z"},
+	{"entity_id":"light.bedroom","state":"off","attributes":{},"last_changed":"2022-03-29T12:00:00Z"}
+]`
+
+func useFakeClock(t *testing.T, now time.Time) {
+	saved := timeNow
+	t.Cleanup(func() { timeNow = saved })
+	timeNow = func() time.Time { return now }
+}
+
+func mockHassGet(t *testing.T, hassUrl string, status int, body string) *mocks.Requests {
+	hassReq, _ := http.NewRequest("GET", hassUrl, http.NoBody)
+
+	httpReq := mocks.NewRequests(t)
+	httpReq.On("NewRequest", "GET", hassUrl, mock.Anything).Return(hassReq, nil)
+	httpReq.On("Do", hassReq).Return(&http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}, nil)
+	return httpReq
+}
+
+func TestRelativeTime(t *testing.T) {
+	cases := []struct {
+		ago      time.Duration
+		expected string
+	}{
+		{time.Second * 10, "just now"},
+		{time.Minute * 5, "5m ago"},
+		{time.Hour*3 + time.Minute*59, "3h ago"},
+		{time.Hour * 50, "2d ago"},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, relativeTime(testNow.Add(-c.ago), testNow))
+	}
+	require.Equal(t, "-", relativeTime(time.Time{}, testNow))
+}
+
+func TestRenderStates(t *testing.T) {
+	states := []hassState{
+		{EntityId: "sensor.outdoor_temp", State: "12.5", Attributes: map[string]interface{}{"unit_of_measurement": "°C"}, LastChanged: testNow.Add(-time.Minute * 5)},
+		{EntityId: "light.kitchen", State: "on", LastChanged: testNow.Add(-time.Hour * 3)},
+	}
+
+	expected := "```\n" +
+		"ENTITY               STATE  UNIT  CHANGED\n" +
+		"sensor.outdoor_temp  12.5   °C    5m ago\n" +
+		"light.kitchen        on           3h ago\n" +
+		"```"
+	require.Equal(t, expected, renderStates(states, testNow))
+
+	many := make([]hassState, maxStateRows+3)
+	for i := range many {
+		many[i] = hassState{EntityId: fmt.Sprintf("sensor.s%d", i), State: "1"}
+	}
+	rendered := renderStates(many, testNow)
+	require.Contains(t, rendered, "... and 3 more\n```")
+	require.Equal(t, maxStateRows, strings.Count(rendered, "sensor."))
+}
+
+func TestFilterStates(t *testing.T) {
+	states := []hassState{{EntityId: "light.kitchen"}, {EntityId: "sensor.temp"}, {EntityId: "light.bedroom"}}
+
+	require.Equal(t, []hassState{{EntityId: "light.bedroom"}, {EntityId: "light.kitchen"}}, filterStates(states, "light.*"))
+	require.Len(t, filterStates(states, "*"), 3)
+	require.Empty(t, filterStates(states, "switch.*"))
+}
+
+func TestHomeStatesCommand(t *testing.T) {
+	useFakeClock(t, testNow)
+
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"home states light.*", "```\nENTITY         STATE  UNIT  CHANGED\nlight.bedroom  off          3d ago\nlight.kitchen  on           3h ago\n```"},
+		{"home states switch.*", `no entities match "switch.*"`},
+	}
+
+	for _, c := range cases {
+		msg := createTextMessage(c.input)
+		_, args, _ := commands.Match(c.input)
+
+		httpReq := mockHassGet(t, "http://home-assistant.home.lan:8123/api/states", 200, testStates)
+
+		kbc := mocks.NewKeyBaseChat(t)
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, c.expected).Return(kbchat.SendResponse{}, nil)
+
+		require.Nil(t, homeCommand(kbc, msg, httpReq, args))
+	}
+
+	msg := createTextMessage("home states [")
+	err := homeCommand(mocks.NewKeyBaseChat(t), msg, mocks.NewRequests(t), []string{"states", "["})
+	require.EqualError(t, err, `invalid pattern "["`)
+}
+
+func TestHomeStateCommand(t *testing.T) {
+	useFakeClock(t, testNow)
+
+	hassUrl := "http://home-assistant.home.lan:8123/api/states/sensor.outdoor_temp"
+	msg := createTextMessage("home state sensor.outdoor_temp")
+
+	httpReq := mockHassGet(t, hassUrl, 200, `{"entity_id":"sensor.outdoor_temp","state":"12.5","attributes":{"unit_of_measurement":"°C"},"last_changed":"2022-04-01T11:55:00Z"}`)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "```\nENTITY               STATE  UNIT  CHANGED\nsensor.outdoor_temp  12.5   °C    5m ago\n```").Return(kbchat.SendResponse{}, nil)
+
+	require.Nil(t, homeCommand(kbc, msg, httpReq, []string{"state", "sensor.outdoor_temp"}))
+
+	missing := mockHassGet(t, "http://home-assistant.home.lan:8123/api/states/sensor.nope", 404, `{"message":"Entity not found."}`)
+	err := homeCommand(kbc, msg, missing, []string{"state", "sensor.nope"})
+	require.EqualError(t, err, "error communicating with Home Assistant: error: received status 404 Not Found: Entity not found.")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// maxTemplateOutput caps how much rendered template text is sent back to
+// the chat.
+const maxTemplateOutput = 4000
+
+// homeTemplateCommand renders a Jinja template on Home Assistant, e.g.
+// `home template {{ states('sensor.power') }} W`. The template is taken
+// from the raw message so its spacing survives.
+func homeTemplateCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, hass *hassInstance, args []string) error {
+	template := rawArgs(msg, 2)
+	if len(args) == 0 || template == "" {
+		return inputError("usage: home template <template>")
+	}
+
+	rendered, err := postToHass(httpReq, hass.endpoint("template"), hass.Token, map[string]string{"template": template})
+	if err != nil {
+		// a 400 carries Home Assistant's explanation, which is shown as-is
+		return fmt.Errorf("error communicating with Home Assistant: %w", err)
+	}
+
+	return reply(kbc, msg, truncateOutput(string(rendered), maxTemplateOutput))
+}
+
+// truncateOutput shortens text to at most limit bytes without splitting a
+// character, noting how much was cut.
+func truncateOutput(text string, limit int) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "(empty result)"
+	}
+	if len(text) <= limit {
+		return text
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n... (%d more bytes)", text[:cut], len(text)-cut)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomeTemplateCommand(t *testing.T) {
+	templateUrl := "http://home-assistant.home.lan:8123/api/template"
+
+	cases := []struct {
+		input         string
+		statusCode    int
+		response      string
+		expectedBody  string
+		expectedReply string
+		expectedError string
+	}{
+		{
+			"home template {{ states('sensor.power') }} W",
+			200,
+			"3500 W",
+			`{"template":"{{ states('sensor.power') }} W"}`,
+			"3500 W",
+			"",
+		},
+		{
+			"!home  template   {%  if is_state('light.kitchen', 'on') %}on{% endif %}",
+			200,
+			"",
+			`{"template":"{%  if is_state('light.kitchen', 'on') %}on{% endif %}"}`,
+			"(empty result)",
+			"",
+		},
+		{
+			"home template {{ states(",
+			400,
+			`{"message":"Error rendering template: TemplateSyntaxError: unexpected end of template"}`,
+			`{"template":"{{ states("}`,
+			"",
+			"error communicating with Home Assistant: error: received status 400 Bad Request: Error rendering template: TemplateSyntaxError: unexpected end of template",
+		},
+		{
+			"home template {{ 1 }}",
+			500,
+			`500: Internal Server Error`,
+			`{"template":"{{ 1 }}"}`,
+			"",
+			"error communicating with Home Assistant: error: received status 500 Internal Server Error: 500: Internal Server Error",
+		},
+	}
+
+	for _, c := range cases {
+		msg := createTextMessage(c.input)
+		_, args, _ := commands.Match(c.input)
+
+		hassReq, _ := http.NewRequest("POST", templateUrl, http.NoBody)
+
+		var sentBody []byte
+		httpReq := mocks.NewRequests(t)
+		httpReq.On("NewRequest", "POST", templateUrl, mock.Anything).Run(func(args mock.Arguments) {
+			sentBody, _ = io.ReadAll(args.Get(2).(io.Reader))
+		}).Return(hassReq, nil)
+		httpReq.On("Do", hassReq).Return(&http.Response{
+			Status:     fmt.Sprintf("%d %s", c.statusCode, http.StatusText(c.statusCode)),
+			StatusCode: c.statusCode,
+			Body:       io.NopCloser(strings.NewReader(c.response)),
+		}, nil)
+
+		kbc := mocks.NewKeyBaseChat(t)
+		if c.expectedReply != "" {
+			kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, c.expectedReply).Return(kbchat.SendResponse{}, nil)
+		}
+
+		err := homeCommand(kbc, msg, httpReq, args)
+		require.JSONEq(t, c.expectedBody, string(sentBody))
+		if c.expectedError != "" {
+			require.EqualError(t, err, c.expectedError)
+			if c.statusCode == 400 {
+				require.Equal(t, "Error rendering template: TemplateSyntaxError: unexpected end of template", renderError(classifyError(err), ""))
+			}
+		} else {
+			require.Nil(t, err)
+		}
+	}
+
+	msg := createTextMessage("home template")
+	err := homeCommand(mocks.NewKeyBaseChat(t), msg, mocks.NewRequests(t), []string{"template"})
+	require.EqualError(t, err, "usage: home template <template>")
+}
+
+func TestTruncateOutput(t *testing.T) {
+	require.Equal(t, "3500 W", truncateOutput(" 3500 W\n", 10))
+	require.Equal(t, "(empty result)", truncateOutput("\n", 10))
+	require.Equal(t, "abcde\n... (5 more bytes)", truncateOutput("abcdefghij", 5))
+	require.Equal(t, "ab\n... (4 more bytes)", truncateOutput("ab°°", 3))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// maxSuggestions caps how many "did you mean" candidates are offered.
+const maxSuggestions = 3
+
+func helpHandler(r *CommandRegistry) HandlerFunc {
+	return func(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+		if len(args) == 0 {
+			return reply(kbc, msg, renderHelp(r.Commands()))
+		}
+
+		cmd, ok := r.Lookup(args[0])
+		if !ok {
+			return reply(kbc, msg, unknownCommand(r, args[0]))
+		}
+		return reply(kbc, msg, renderHelp([]Command{cmd}))
+	}
+}
+
+// renderHelp formats cmds as a Markdown table.
+func renderHelp(cmds []Command) string {
+	var b strings.Builder
+	b.WriteString("| Command | Aliases | Usage | Description |\n")
+	b.WriteString("|---|---|---|---|\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "| %s | %s | `%s` | %s |\n",
+			cmd.Name(),
+			strings.Join(cmd.Aliases(), ", "),
+			usage(cmd),
+			cmd.Description(),
+		)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// unknownCommand builds the reply for a keyword that matched nothing.
+func unknownCommand(r *CommandRegistry, keyword string) string {
+	keyword = strings.ToLower(strings.TrimPrefix(keyword, commandPrefix))
+	text := fmt.Sprintf("unknown command %q", keyword)
+
+	suggestions := r.Suggest(keyword)
+	if len(suggestions) > 0 {
+		quoted := make([]string, len(suggestions))
+		for i, s := range suggestions {
+			quoted[i] = fmt.Sprintf("`%s`", s)
+		}
+		return fmt.Sprintf("%s, did you mean %s?", text, strings.Join(quoted, " or "))
+	}
+	return fmt.Sprintf("%s, type `help` to list commands", text)
+}
+
+// Suggest returns registered keywords close to keyword by edit distance,
+// nearest first.
+func (r *CommandRegistry) Suggest(keyword string) []string {
+	type candidate struct {
+		keyword  string
+		distance int
+	}
+
+	maxDistance := len(keyword) / 2
+	if maxDistance > 2 {
+		maxDistance = 2
+	}
+
+	var candidates []candidate
+	for k := range r.keywords {
+		if d := levenshtein(keyword, k); d > 0 && d <= maxDistance {
+			candidates = append(candidates, candidate{k, d})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].keyword < candidates[j].keyword
+	})
+
+	var suggestions []string
+	for _, c := range candidates {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, c.keyword)
+	}
+	return suggestions
+}
+
+func levenshtein(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	curr := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		curr[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(br)]
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"ip", "ip", 0},
+		{"hme", "home", 1},
+		{"hoem", "home", 2},
+		{"kitten", "sitting", 3},
+		{"", "bye", 3},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.distance, levenshtein(c.a, c.b), "%s/%s", c.a, c.b)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	require.Equal(t, []string{"home"}, commands.Suggest("hme"))
+	require.Equal(t, []string{"help"}, commands.Suggest("hepl"))
+	require.Equal(t, []string{"hass"}, commands.Suggest("has"))
+	require.Empty(t, commands.Suggest("x"))
+	require.Empty(t, commands.Suggest("weather"))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	require.Equal(t, "unknown command \"hme\", did you mean `home`?", unknownCommand(commands, "hme"))
+	require.Equal(t, "unknown command \"byw\", did you mean `bye`?", unknownCommand(commands, "!byw"))
+	require.Equal(t, "unknown command \"weather\", type `help` to list commands", unknownCommand(commands, "weather"))
+}
+
+func TestRenderHelp(t *testing.T) {
+	cmd := &SimpleCommand{
+		CommandName: "home",
+		AliasNames:  []string{"hass", "ha"},
+		ArgSpecs:    []ArgSpec{{Name: "path", Optional: true, Variadic: true}},
+		Summary:     "Query the Home Assistant API",
+	}
+
+	expected := "| Command | Aliases | Usage | Description |\n" +
+		"|---|---|---|---|\n" +
+		"| home | hass, ha | `home [path...]` | Query the Home Assistant API |"
+
+	require.Equal(t, expected, renderHelp([]Command{cmd}))
+}
+
+func TestHelpCommand(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"help", renderHelp(commands.Commands())},
+		{"!help ip", renderHelp([]Command{commands.commands[0]})},
+		{"? hme", "unknown command \"hme\", did you mean `home`?"},
+		{"hme", "unknown command \"hme\", did you mean `home`?"},
+	}
+
+	for _, c := range cases {
+		msg := createTextMessage(c.input)
+
+		kbc := mocks.NewKeyBaseChat(t)
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, c.expected).Return(kbchat.SendResponse{}, nil)
+
+		handleMessage(kbc, msg, mocks.NewRequests(t))
+	}
+}
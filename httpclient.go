@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	httpConnectTimeout = 5 * time.Second
+	httpTimeout        = 30 * time.Second
+	httpRetries        = 2
+
+	httpRetryPolicy = backoffPolicy{
+		Initial:    200 * time.Millisecond,
+		Max:        2 * time.Second,
+		Multiplier: 2,
+	}
+
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// requestCtx is the parent of every outgoing request; drain calls
+// cancelRequests to abort whatever is still in flight when the bot stops.
+var requestCtx, cancelRequests = context.WithCancel(context.Background())
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// sharedClient sends every request that does not go to a Home Assistant
+// instance with its own TLS settings. apply replaces it when the http
+// settings change.
+var sharedClient = newHttpRequests(nil)
+
+// configuredRequests sends requests with the client of the running
+// configuration, so reloaded http settings apply to later requests.
+type configuredRequests struct{}
+
+func (configuredRequests) Get(url string) (*http.Response, error) {
+	return snapshotConfig().httpReq.Get(url)
+}
+
+func (configuredRequests) NewRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	return snapshotConfig().httpReq.NewRequest(method, url, body)
+}
+
+func (configuredRequests) Do(req *http.Request) (*http.Response, error) {
+	return snapshotConfig().httpReq.Do(req)
+}
+
+// httpRequests is the Requests implementation used outside of tests. It
+// adds timeouts, retries of idempotent requests and a per-host circuit
+// breaker on top of net/http.
+type httpRequests struct {
+	client  *http.Client
+	ctx     context.Context
+	retries int
+	backoff backoffPolicy
+	breaker *circuitBreaker
+}
+
+// newHttpRequests builds a client using transport, or a default transport
+// when it is nil.
+func newHttpRequests(transport *http.Transport) *httpRequests {
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.DialContext = (&net.Dialer{Timeout: httpConnectTimeout}).DialContext
+	transport.TLSHandshakeTimeout = httpConnectTimeout
+
+	return &httpRequests{
+		client:  &http.Client{Transport: transport, Timeout: httpTimeout},
+		ctx:     requestCtx,
+		retries: httpRetries,
+		backoff: httpRetryPolicy,
+		breaker: newCircuitBreaker(breakerThreshold, breakerCooldown),
+	}
+}
+
+func (h *httpRequests) Get(url string) (resp *http.Response, err error) {
+	req, err := h.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	return h.Do(req)
+}
+
+func (h *httpRequests) NewRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(h.ctx, method, url, body)
+}
+
+// Do sends req, retrying network errors and 5xx responses for idempotent
+// methods. The last response or error is returned once retries run out.
+func (h *httpRequests) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	attempts := 1
+	if isIdempotent(req.Method) {
+		attempts += h.retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := h.breaker.allow(host); err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+
+		res, err := h.client.Do(req)
+		failed := err != nil || res.StatusCode >= 500
+		h.breaker.record(host, !failed)
+
+		if !failed || attempt+1 >= attempts || req.Context().Err() != nil {
+			return res, err
+		}
+
+		retry, rewindErr := rewind(req)
+		if rewindErr != nil {
+			return res, err
+		}
+		req = retry
+		if res != nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(h.backoff.delay(attempt)):
+		}
+	}
+}
+
+// rewind returns a copy of req whose body can be sent again.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	return retry, nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// circuitBreaker stops sending requests to a host after threshold
+// consecutive failures. Once cooldown has passed it lets a single trial
+// request through, which closes the circuit if it succeeds and opens it
+// for another cooldown if it fails.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*breakerState
+	now       func() time.Time
+}
+
+type breakerState struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*breakerState),
+		now:       time.Now,
+	}
+}
+
+func (b *circuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.hosts[host]
+	if !ok || state.failures < b.threshold {
+		return nil
+	}
+	if state.probing || b.now().Sub(state.openedAt) < b.cooldown {
+		return errCircuitOpen
+	}
+	state.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) record(host string, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		delete(b.hosts, host)
+		return
+	}
+
+	state, ok := b.hosts[host]
+	if !ok {
+		state = new(breakerState)
+		b.hosts[host] = state
+	}
+	state.failures++
+	if state.failures >= b.threshold {
+		state.openedAt = b.now()
+		state.probing = false
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// useRequestCtx gives the test its own request context, since drain
+// cancels it.
+func useRequestCtx(t *testing.T) {
+	saved, savedCancel := requestCtx, cancelRequests
+	requestCtx, cancelRequests = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancelRequests()
+		requestCtx, cancelRequests = saved, savedCancel
+	})
+}
+
+func newTestHttpRequests() *httpRequests {
+	h := newHttpRequests(nil)
+	h.backoff = backoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 2}
+	return h
+}
+
+func TestHttpRequestsRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	defer server.Close()
+
+	h := newTestHttpRequests()
+
+	res, err := h.Get(server.URL)
+	require.Nil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	require.Equal(t, "GET ", string(body))
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	req, _ := h.NewRequest("PUT", server.URL, strings.NewReader("payload"))
+	res, err = h.Do(req)
+	require.Nil(t, err)
+	body, _ = io.ReadAll(res.Body)
+	require.Equal(t, "PUT payload", string(body))
+
+	atomic.StoreInt32(&calls, 0)
+	req, _ = h.NewRequest("POST", server.URL, strings.NewReader("payload"))
+	res, err = h.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// retries run out before the server recovers
+	atomic.StoreInt32(&calls, 0)
+	h.retries = 1
+	res, err = h.Get(server.URL)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestHttpRequestsCircuitBreaker(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	h := newTestHttpRequests()
+	h.retries = 0
+	h.breaker = newCircuitBreaker(3, time.Minute)
+	h.breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		res, err := h.Get(server.URL)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	}
+
+	_, err := h.Get(server.URL)
+	require.True(t, errors.Is(err, errCircuitOpen))
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	now = now.Add(time.Minute)
+	_, err = h.Get(server.URL)
+	require.Nil(t, err)
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	_, err = h.Get(server.URL)
+	require.True(t, errors.Is(err, errCircuitOpen))
+}
+
+func TestCircuitBreakerRecovers(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	b.record("a", false)
+	b.record("a", false)
+	require.Equal(t, errCircuitOpen, b.allow("a"))
+	require.Nil(t, b.allow("b"))
+
+	// a single trial request goes through after the cooldown
+	now = now.Add(time.Minute)
+	require.Nil(t, b.allow("a"))
+	require.Equal(t, errCircuitOpen, b.allow("a"))
+	b.record("a", false)
+	require.Equal(t, errCircuitOpen, b.allow("a"))
+
+	now = now.Add(time.Minute)
+	require.Nil(t, b.allow("a"))
+	b.record("a", true)
+	require.Nil(t, b.allow("a"))
+	require.Nil(t, b.allow("a"))
+}
+
+func TestHttpRequestsBodyNotReplayable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	h := newTestHttpRequests()
+	req, err := h.NewRequest("PUT", server.URL, io.NopCloser(strings.NewReader("payload")))
+	require.Nil(t, err)
+	res, err := h.Do(req)
+	require.Nil(t, res)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "connection refused")
+}
+
+func TestHttpRequestsCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newTestHttpRequests()
+	h.ctx = ctx
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := h.Get(server.URL)
+	require.True(t, errors.Is(err, context.Canceled), err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestHttpRequestsTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	h := newTestHttpRequests()
+	h.retries = 0
+	h.client.Timeout = time.Millisecond * 50
+
+	_, err := h.Get(server.URL)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Client.Timeout exceeded")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	familyIpv4 = "ipv4"
+	familyIpv6 = "ipv6"
+)
+
+// ipProvider is a "what is my IP" endpoint answering with the caller's
+// address as plain text.
+type ipProvider struct {
+	Name   string
+	Url    string
+	Family string
+}
+
+// builtinIpProviders can be listed by name in IP_PROVIDERS.
+var builtinIpProviders = map[string]ipProvider{
+	"ipify":      {"ipify", "https://api.ipify.org", familyIpv4},
+	"ipify6":     {"ipify6", "https://api6.ipify.org", familyIpv6},
+	"icanhazip":  {"icanhazip", "https://ipv4.icanhazip.com", familyIpv4},
+	"icanhazip6": {"icanhazip6", "https://ipv6.icanhazip.com", familyIpv6},
+}
+
+var (
+	// ipProviders are asked in order until ipConsensus of them agree on
+	// an address for each family.
+	ipProviders = []ipProvider{
+		builtinIpProviders["ipify"],
+		builtinIpProviders["icanhazip"],
+		builtinIpProviders["ipify6"],
+		builtinIpProviders["icanhazip6"],
+	}
+	ipConsensus = 1
+
+	// ipWatchInterval is how often the public IP is checked for changes;
+	// 0 disables the watcher. Changes are posted to ipNotifyChannels.
+	ipWatchInterval  time.Duration
+	ipNotifyChannels []chat1.ChatChannel
+)
+
+// publicIp holds the public address of each family; an address is empty
+// when it could not be determined.
+type publicIp struct {
+	V4 string
+	V6 string
+}
+
+func (p publicIp) address(family string) string {
+	if family == familyIpv6 {
+		return p.V6
+	}
+	return p.V4
+}
+
+// parseIpProviders reads a comma-separated provider list. Entries are
+// either builtin names such as "ipify6" or a custom endpoint written as
+// "ipv4=<url>" or "ipv6=<url>".
+func parseIpProviders(raw string) ([]ipProvider, error) {
+	var providers []ipProvider
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if family, url, ok := strings.Cut(entry, "="); ok {
+			family = strings.ToLower(family)
+			if family != familyIpv4 && family != familyIpv6 {
+				return nil, fmt.Errorf("invalid IP provider %q, expected ipv4=<url> or ipv6=<url>", entry)
+			}
+			if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+				return nil, fmt.Errorf("invalid IP provider URL %q", url)
+			}
+			providers = append(providers, ipProvider{Name: url, Url: url, Family: family})
+			continue
+		}
+
+		provider, ok := builtinIpProviders[strings.ToLower(entry)]
+		if !ok {
+			return nil, fmt.Errorf("unknown IP provider %q", entry)
+		}
+		providers = append(providers, provider)
+	}
+
+	if len(providers) == 0 {
+		return nil, errors.New("no IP providers given")
+	}
+	return providers, nil
+}
+
+// families returns the address families that have providers, IPv4 first.
+func families(providers []ipProvider) []string {
+	var found []string
+	for _, family := range []string{familyIpv4, familyIpv6} {
+		for _, provider := range providers {
+			if provider.Family == family {
+				found = append(found, family)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// askIpProvider returns the address reported by provider, checking that
+// it belongs to the provider's family.
+func askIpProvider(httpReq Requests, provider ipProvider) (string, error) {
+	answer, err := getUrl(httpReq, provider.Url)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(answer))
+	if ip == nil {
+		return "", fmt.Errorf("not an IP address: %q", strings.TrimSpace(answer))
+	}
+	if (ip.To4() != nil) != (provider.Family == familyIpv4) {
+		return "", fmt.Errorf("answered %s, expected an %s address", ip, provider.Family)
+	}
+	return ip.String(), nil
+}
+
+// lookupAddress asks the providers of family in order until consensus of
+// them report the same address.
+func lookupAddress(httpReq Requests, providers []ipProvider, family string, consensus int) (string, error) {
+	votes := make(map[string]int)
+	var failures []string
+	for _, provider := range providers {
+		if provider.Family != family {
+			continue
+		}
+
+		address, err := askIpProvider(httpReq, provider)
+		if err != nil {
+			logger.Warn("IP provider failed", "provider", provider.Name, "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %s", provider.Name, err.Error()))
+			continue
+		}
+
+		votes[address]++
+		if votes[address] >= consensus {
+			return address, nil
+		}
+	}
+
+	if len(votes) == 0 {
+		return "", fmt.Errorf("no %s provider answered (%s)", family, strings.Join(failures, "; "))
+	}
+
+	var answers []string
+	for address, count := range votes {
+		answers = append(answers, fmt.Sprintf("%s (%d)", address, count))
+	}
+	sort.Strings(answers)
+	return "", fmt.Errorf("no %d %s providers agree: %s", consensus, family, strings.Join(answers, ", "))
+}
+
+// lookupPublicIp determines the public address of every configured
+// family. It only fails when no family could be determined.
+func lookupPublicIp(httpReq Requests) (publicIp, error) {
+	logger.Info("looking up public IP address")
+
+	cfg := snapshotConfig()
+	var result publicIp
+	var failures []string
+	for _, family := range families(cfg.ipProviders) {
+		address, err := lookupAddress(httpReq, cfg.ipProviders, family, cfg.ipConsensus)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		if family == familyIpv4 {
+			result.V4 = address
+		} else {
+			result.V6 = address
+		}
+	}
+
+	if result.V4 == "" && result.V6 == "" {
+		return result, unavailableError("Could not determine the public IP address.", errors.New(strings.Join(failures, "; ")))
+	}
+	return result, nil
+}
+
+func renderPublicIp(ip publicIp) string {
+	var lines []string
+	for _, family := range families(snapshotConfig().ipProviders) {
+		address := ip.address(family)
+		if address == "" {
+			address = "unavailable"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", familyLabel(family), address))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func familyLabel(family string) string {
+	if family == familyIpv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func ipCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	ip, err := lookupPublicIp(httpReq)
+	if err != nil {
+		return fmt.Errorf("could not get ip address: %w", err)
+	}
+	return reply(kbc, msg, renderPublicIp(ip))
+}
+
+// ipNamespace holds the last known public IP under "last", so a change
+// while the bot was down is announced on start.
+const ipNamespace = "ip"
+
+var (
+	lastIpMu sync.Mutex
+	lastIp   publicIp
+)
+
+// watchIp checks the public IP every ipWatchInterval until ctx is
+// cancelled, announces changes and keeps DDNS records in sync. Nothing is
+// announced when no address was known before.
+func watchIp(ctx context.Context, kbc KeyBaseChat, httpReq Requests) {
+	if ipWatchInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(ipWatchInterval)
+	defer ticker.Stop()
+
+	lastIpMu.Lock()
+	if lastIp == (publicIp{}) {
+		if _, err := getJson(stateStorage, ipNamespace, "last", &lastIp); err != nil {
+			logger.Warn("could not read last known IP", "error", err)
+		}
+	}
+	lastIpMu.Unlock()
+
+	for {
+		if current, err := lookupPublicIp(httpReq); err != nil {
+			logger.Warn("could not check public IP", "error", err)
+		} else {
+			lastIpMu.Lock()
+			previous := lastIp
+			lastIp = mergeIp(previous, current)
+			merged := lastIp
+			lastIpMu.Unlock()
+
+			if merged != previous {
+				if previous != (publicIp{}) {
+					onIpChange(kbc, previous, current)
+				}
+				if err := putJson(stateStorage, ipNamespace, "last", merged, 0); err != nil {
+					logger.Warn("could not save last known IP", "error", err)
+				}
+			}
+			syncDdns(httpReq, merged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mergeIp keeps the previous address of a family that could not be
+// determined this time, so a failing provider is not mistaken for a
+// change.
+func mergeIp(previous publicIp, current publicIp) publicIp {
+	if current.V4 == "" {
+		current.V4 = previous.V4
+	}
+	if current.V6 == "" {
+		current.V6 = previous.V6
+	}
+	return current
+}
+
+func onIpChange(kbc KeyBaseChat, previous publicIp, current publicIp) {
+	var changes []string
+	for _, family := range families(snapshotConfig().ipProviders) {
+		before, after := previous.address(family), current.address(family)
+		if after == "" || before == after {
+			continue
+		}
+		if before == "" {
+			before = "none"
+		}
+		changes = append(changes, fmt.Sprintf("%s %s → %s", familyLabel(family), before, after))
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	logger.Info("public IP changed", "changes", strings.Join(changes, ", "))
+	text := "Public IP changed: " + strings.Join(changes, ", ")
+	for _, channel := range ipNotifyChannels {
+		if _, err := kbc.SendMessage(channel, redactSecrets(text)); err != nil {
+			logger.Warn("could not post IP change", "channel", channel.Name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func useIpProviders(t *testing.T, providers ...ipProvider) {
+	saved, savedConsensus := ipProviders, ipConsensus
+	t.Cleanup(func() {
+		ipProviders = saved
+		ipConsensus = savedConsensus
+	})
+	ipProviders = providers
+	ipConsensus = 1
+}
+
+func ipResponse(body string) *http.Response {
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestParseIpProviders(t *testing.T) {
+	providers, err := parseIpProviders("icanhazip, ipify6 ,ipv4=https://ip.example/plain")
+	require.Nil(t, err)
+	require.Equal(t, []ipProvider{
+		builtinIpProviders["icanhazip"],
+		builtinIpProviders["ipify6"],
+		{Name: "https://ip.example/plain", Url: "https://ip.example/plain", Family: familyIpv4},
+	}, providers)
+	require.Equal(t, []string{familyIpv4, familyIpv6}, families(providers))
+
+	cases := map[string]string{
+		"whatismyip":       `unknown IP provider "whatismyip"`,
+		"ipv5=https://a.b": `invalid IP provider "ipv5=https://a.b", expected ipv4=<url> or ipv6=<url>`,
+		"ipv6=ftp://a.b":   `invalid IP provider URL "ftp://a.b"`,
+		" , ":              "no IP providers given",
+	}
+	for raw, expected := range cases {
+		_, err := parseIpProviders(raw)
+		require.EqualError(t, err, expected)
+	}
+}
+
+func TestLookupAddress(t *testing.T) {
+	providers := []ipProvider{
+		{Name: "a", Url: "https://a.example", Family: familyIpv4},
+		{Name: "b", Url: "https://b.example", Family: familyIpv4},
+		{Name: "c", Url: "https://c.example", Family: familyIpv4},
+		{Name: "six", Url: "https://six.example", Family: familyIpv6},
+	}
+
+	cases := []struct {
+		answers   map[string]string
+		consensus int
+		expected  string
+		err       string
+	}{
+		{map[string]string{"a": "1.1.1.1\n"}, 1, "1.1.1.1", ""},
+		{map[string]string{"a": "", "b": "2.2.2.2"}, 1, "2.2.2.2", ""},
+		{map[string]string{"a": "1.1.1.1", "b": "2.2.2.2", "c": "1.1.1.1"}, 2, "1.1.1.1", ""},
+		{map[string]string{"a": "1.1.1.1", "b": "2.2.2.2", "c": "3.3.3.3"}, 2, "", "no 2 ipv4 providers agree: 1.1.1.1 (1), 2.2.2.2 (1), 3.3.3.3 (1)"},
+		{map[string]string{"a": "2001:db8::1", "b": "oops", "c": "error"}, 1, "", `no ipv4 provider answered (a: answered 2001:db8::1, expected an ipv4 address; b: not an IP address: "oops"; c: error getting document: down)`},
+	}
+
+	for _, c := range cases {
+		httpReq := mocks.NewRequests(t)
+		for _, name := range []string{"a", "b", "c"} {
+			answer, ok := c.answers[name]
+			if !ok {
+				continue
+			}
+			if answer == "error" {
+				httpReq.On("Get", "https://"+name+".example").Return(nil, errors.New("down"))
+			} else {
+				httpReq.On("Get", "https://"+name+".example").Return(ipResponse(answer), nil)
+			}
+		}
+
+		address, err := lookupAddress(httpReq, providers, familyIpv4, c.consensus)
+		if c.err != "" {
+			require.EqualError(t, err, c.err)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, c.expected, address)
+		}
+	}
+}
+
+func TestIpCommand(t *testing.T) {
+	useIpProviders(t, builtinIpProviders["ipify"], builtinIpProviders["ipify6"])
+
+	msg := createTextMessage("ip")
+	httpReq := mocks.NewRequests(t)
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse("203.0.113.7"), nil).Once()
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse("203.0.113.7"), nil).Once()
+	httpReq.On("Get", "https://api6.ipify.org").Return(ipResponse("2001:0db8:0000::0001"), nil).Once()
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "IPv4: 203.0.113.7\nIPv6: 2001:db8::1").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, ipCommand(kbc, msg, httpReq, nil))
+
+	httpReq.On("Get", "https://api6.ipify.org").Return(nil, errors.New("no route to host"))
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "IPv4: 203.0.113.7\nIPv6: unavailable").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, ipCommand(kbc, msg, httpReq, nil))
+
+	failing := mocks.NewRequests(t)
+	failing.On("Get", mock.Anything).Return(nil, errors.New("offline"))
+	err := ipCommand(kbc, msg, failing, nil)
+	require.True(t, classifyError(err).Retryable())
+}
+
+func TestWatchIp(t *testing.T) {
+	useIpProviders(t, builtinIpProviders["ipify"], builtinIpProviders["ipify6"])
+
+	savedInterval, savedChannels := ipWatchInterval, ipNotifyChannels
+	t.Cleanup(func() {
+		ipWatchInterval = savedInterval
+		ipNotifyChannels = savedChannels
+		lastIp = publicIp{}
+	})
+	storage := useStorage(t)
+	require.Nil(t, putJson(storage, ipNamespace, "last", publicIp{V4: "203.0.113.7", V6: "2001:db8::1"}, 0))
+	ipWatchInterval = time.Millisecond
+	ipNotifyChannels = parseChannels("home#alerts")
+
+	httpReq := mocks.NewRequests(t)
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse("203.0.113.7"), nil).Once()
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse("203.0.113.7"), nil).Once()
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse("198.51.100.2"), nil).Once()
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse(""), nil)
+	httpReq.On("Get", "https://api6.ipify.org").Return(ipResponse("2001:db8::1"), nil).Once()
+	httpReq.On("Get", "https://api6.ipify.org").Return(nil, errors.New("no route to host"))
+
+	posted := make(chan string, 10)
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", parseChannel("home#alerts"), mock.Anything).Return(kbchat.SendResponse{}, nil).Run(func(args mock.Arguments) {
+		posted <- args.String(1)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchIp(ctx, kbc, httpReq)
+		close(done)
+	}()
+
+	select {
+	case text := <-posted:
+		require.Equal(t, "Public IP changed: IPv4 203.0.113.7 → 198.51.100.2", text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no IP change posted")
+	}
+	cancel()
+	<-done
+
+	require.Empty(t, posted)
+	require.Equal(t, publicIp{V4: "198.51.100.2", V6: "2001:db8::1"}, lastIp)
+	var saved publicIp
+	_, err := getJson(storage, ipNamespace, "last", &saved)
+	require.Nil(t, err)
+	require.Equal(t, lastIp, saved)
+}
+
+func TestWatchIpAnnouncesChangeWhileDown(t *testing.T) {
+	useIpProviders(t, builtinIpProviders["ipify"])
+	savedInterval, savedChannels := ipWatchInterval, ipNotifyChannels
+	t.Cleanup(func() {
+		ipWatchInterval = savedInterval
+		ipNotifyChannels = savedChannels
+		lastIp = publicIp{}
+	})
+	storage := useStorage(t)
+	require.Nil(t, putJson(storage, ipNamespace, "last", publicIp{V4: "203.0.113.7"}, 0))
+	ipWatchInterval = time.Hour
+	ipNotifyChannels = parseChannels("home#alerts")
+
+	httpReq := mocks.NewRequests(t)
+	httpReq.On("Get", "https://api.ipify.org").Return(ipResponse("198.51.100.2"), nil).Once()
+	posted := make(chan string, 1)
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", parseChannel("home#alerts"), "Public IP changed: IPv4 203.0.113.7 → 198.51.100.2").Return(kbchat.SendResponse{}, nil).Run(func(args mock.Arguments) {
+		posted <- args.String(1)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchIp(ctx, kbc, httpReq)
+		close(done)
+	}()
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no IP change posted")
+	}
+	cancel()
+	<-done
+}
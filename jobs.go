@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// job runs a bot command on a cron schedule and posts its output to a
+// conversation.
+type job struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule"`
+	Command  string `yaml:"command"`
+	Channel  string `yaml:"channel"`
+	Timezone string `yaml:"timezone"`
+	Paused   bool   `yaml:"paused"`
+
+	schedule *cronSchedule
+	location *time.Location
+	channel  chat1.ChatChannel
+	cmd      Command
+	args     []string
+
+	mu      sync.Mutex
+	paused  bool
+	next    time.Time
+	lastRun time.Time
+	lastErr error
+}
+
+var scheduledJobs []*job
+
+// clock tells the scheduler the time, so tests can move it by hand.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var schedulerClock clock = systemClock{}
+
+func validateJobs(jobs []*job) error {
+	names := make(map[string]bool)
+	for i, j := range jobs {
+		if err := j.validate(); err != nil {
+			return fmt.Errorf("job %d: %s", i+1, err.Error())
+		}
+		if names[j.Name] {
+			return fmt.Errorf("job %d: duplicate name %q", i+1, j.Name)
+		}
+		names[j.Name] = true
+	}
+	return nil
+}
+
+func (j *job) validate() error {
+	j.Name = strings.ToLower(strings.TrimSpace(j.Name))
+	if j.Name == "" || strings.ContainsAny(j.Name, " \t") {
+		return errors.New("name must be a single word")
+	}
+	if j.Channel == "" {
+		return fmt.Errorf("%s: no channel given", j.Name)
+	}
+	j.channel = parseChannel(j.Channel)
+
+	schedule, err := parseCron(j.Schedule)
+	if err != nil {
+		return fmt.Errorf("%s: %s", j.Name, err.Error())
+	}
+	j.schedule = schedule
+
+	j.location = time.Local
+	if j.Timezone != "" {
+		if j.location, err = time.LoadLocation(j.Timezone); err != nil {
+			return fmt.Errorf("%s: unknown timezone %q", j.Name, j.Timezone)
+		}
+	}
+	if _, err := schedule.next(time.Now().In(j.location)); err != nil {
+		return fmt.Errorf("%s: %s", j.Name, err.Error())
+	}
+
+	cmd, args, ok := commands.Match(j.Command)
+	if !ok {
+		return fmt.Errorf("%s: unknown command %q", j.Name, j.Command)
+	}
+	if err := checkArgs(cmd, args); err != nil {
+		return fmt.Errorf("%s: %s", j.Name, err.Error())
+	}
+	j.cmd, j.args = cmd, args
+	j.paused = j.Paused
+	return nil
+}
+
+// inherit keeps the run-time state of old, the same job before a reload.
+func (j *job) inherit(old *job) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	j.lastRun, j.lastErr = old.lastRun, old.lastErr
+	if old.paused != old.Paused {
+		// paused or resumed from chat since the last load
+		j.paused = old.paused
+	}
+}
+
+func (j *job) setPaused(paused bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.paused = paused
+}
+
+// jobChat posts replies as plain messages, since a scheduled command has
+// no message to reply to.
+type jobChat struct {
+	KeyBaseChat
+}
+
+func (c jobChat) SendReply(channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...interface{}) (kbchat.SendResponse, error) {
+	return c.SendMessage(channel, body, args...)
+}
+
+// run executes the job's command and posts its output, or what went
+// wrong, to the job's conversation.
+func (j *job) run(kbc KeyBaseChat, httpReq Requests) error {
+	msg := kbchat.SubscriptionMessage{
+		Message: chat1.MsgSummary{
+			Channel: j.channel,
+			Content: chat1.MsgContent{
+				TypeName: "text",
+				Text:     &chat1.MsgTextContent{Body: j.Command},
+			},
+		},
+	}
+	fields := []any{"job", j.Name, "command", j.cmd.Name()}
+
+	start := time.Now()
+	err := j.cmd.Run(jobChat{kbc}, msg, httpReq, j.args)
+	fields = append(fields, "latency", time.Since(start).Round(time.Millisecond))
+
+	j.mu.Lock()
+	j.lastRun, j.lastErr = schedulerClock.Now(), err
+	j.mu.Unlock()
+
+	if err != nil {
+		reportError(jobChat{kbc}, msg, err, fields)
+		return err
+	}
+	logger.Info("job ran", fields...)
+	return nil
+}
+
+// runScheduler runs jobs when they are due until ctx is cancelled. Jobs
+// run one at a time, and runs missed while a job was running are skipped.
+func runScheduler(ctx context.Context, kbc KeyBaseChat, httpReq Requests, jobs []*job, clk clock) {
+	if len(jobs) == 0 {
+		return
+	}
+
+	schedule := func(j *job, now time.Time) {
+		next, _ := j.schedule.next(now.In(j.location))
+		j.mu.Lock()
+		j.next = next
+		j.mu.Unlock()
+	}
+	for _, j := range jobs {
+		schedule(j, clk.Now())
+	}
+
+	for {
+		var wake time.Time
+		for _, j := range jobs {
+			j.mu.Lock()
+			if !j.next.IsZero() && (wake.IsZero() || j.next.Before(wake)) {
+				wake = j.next
+			}
+			j.mu.Unlock()
+		}
+		if wake.IsZero() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(wake.Sub(clk.Now())):
+		}
+
+		now := clk.Now()
+		for _, j := range jobs {
+			j.mu.Lock()
+			due, paused := !j.next.IsZero() && !j.next.After(now), j.paused
+			j.mu.Unlock()
+			if !due {
+				continue
+			}
+
+			if paused {
+				logger.Debug("skipping paused job", "job", j.Name)
+			} else {
+				j.run(kbc, httpReq)
+			}
+			schedule(j, clk.Now())
+		}
+	}
+}
+
+func findJob(name string) (*job, error) {
+	for _, j := range snapshotConfig().jobs {
+		if strings.EqualFold(j.Name, name) {
+			return j, nil
+		}
+	}
+	return nil, inputError("No job named %q, see `jobs list`.", name)
+}
+
+func jobsCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	if len(args) == 0 || strings.EqualFold(args[0], "list") {
+		return reply(kbc, msg, renderJobs(schedulerClock.Now()))
+	}
+	if len(args) != 2 {
+		return inputError("usage: jobs [list] | jobs pause|resume|run-now <name>")
+	}
+
+	j, err := findJob(args[1])
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(args[0]) {
+	case "pause":
+		j.setPaused(true)
+		logger.Info("job paused", "job", j.Name)
+		return reply(kbc, msg, fmt.Sprintf("Paused job %s.", j.Name))
+	case "resume":
+		j.setPaused(false)
+		logger.Info("job resumed", "job", j.Name)
+		return reply(kbc, msg, fmt.Sprintf("Resumed job %s.", j.Name))
+	case "run-now":
+		// the job runs for the sender, who must be allowed its command
+		cfg := snapshotConfig()
+		fields := []any{"conversation", conversationKey(msg), "sender", msg.Message.Sender.Username, "command", j.cmd.Name()}
+		if throttled(kbc, msg, cfg.limiter, j.cmd.Name(), fields) || !authorize(kbc, msg, cfg.acl, j.cmd, j.args) {
+			return nil
+		}
+		if err := j.run(kbc, httpReq); err != nil {
+			return reply(kbc, msg, fmt.Sprintf("Job %s failed, see %s.", j.Name, j.Channel))
+		}
+		if j.channel == msg.Message.Channel {
+			return nil
+		}
+		return reply(kbc, msg, fmt.Sprintf("Ran job %s, output posted to %s.", j.Name, j.Channel))
+	}
+	return inputError("usage: jobs [list] | jobs pause|resume|run-now <name>")
+}
+
+func renderJobs(now time.Time) string {
+	jobs := snapshotConfig().jobs
+	if len(jobs) == 0 {
+		return "No scheduled jobs are configured."
+	}
+
+	lines := []string{"Scheduled jobs:"}
+	for _, j := range jobs {
+		j.mu.Lock()
+		line := fmt.Sprintf("- %s: `%s` at `%s` to %s", j.Name, j.Command, j.Schedule, j.Channel)
+		switch {
+		case j.paused:
+			line += ", paused"
+		case !j.next.IsZero():
+			line += ", next " + j.next.In(j.location).Format("Mon Jan 2 15:04 MST")
+		}
+		switch {
+		case j.lastErr != nil:
+			line += fmt.Sprintf(", failed %s", relativeTime(j.lastRun, now))
+		case !j.lastRun.IsZero():
+			line += fmt.Sprintf(", last ran %s", relativeTime(j.lastRun, now))
+		}
+		j.mu.Unlock()
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
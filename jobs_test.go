@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeTimer{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, timer := range c.waiters {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func useSchedulerClock(t *testing.T, clk clock) {
+	saved := schedulerClock
+	t.Cleanup(func() { schedulerClock = saved })
+	schedulerClock = clk
+}
+
+func testJobs(t *testing.T) []*job {
+	jobs := []*job{
+		{Name: "DNS", Schedule: "0 21 * * *", Command: "ddns status", Channel: "home#dns", Timezone: "UTC"},
+		{Name: "idle", Schedule: "* * * * *", Command: "ddns", Channel: "janik", Paused: true},
+	}
+	require.Nil(t, validateJobs(jobs))
+	return jobs
+}
+
+func TestRunScheduler(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 18, 20, 59, 30, 0, time.UTC))
+	useSchedulerClock(t, clk)
+	jobs := testJobs(t)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", parseChannel("home#dns"), "No dynamic DNS records are configured.").Return(kbchat.SendResponse{}, nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runScheduler(ctx, kbc, mocks.NewRequests(t), jobs, clk)
+		close(done)
+	}()
+
+	// the paused job is due every minute but never runs
+	require.Eventually(t, func() bool { return clk.waiting() == 1 }, time.Second, time.Millisecond)
+	clk.Advance(30 * time.Second)
+	require.Eventually(t, func() bool {
+		jobs[0].mu.Lock()
+		defer jobs[0].mu.Unlock()
+		return jobs[0].next.Equal(time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC))
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, time.Date(2026, 10, 18, 21, 0, 0, 0, time.UTC), jobs[0].lastRun)
+	require.Nil(t, jobs[0].lastErr)
+	require.True(t, jobs[1].lastRun.IsZero())
+	require.Equal(t, time.Date(2026, 10, 18, 21, 1, 0, 0, time.UTC), jobs[1].next.UTC())
+
+	cancel()
+	<-done
+}
+
+func TestJobRunError(t *testing.T) {
+	useErrorId(t, "abc123")
+	jobs := testJobs(t)
+	jobs[0].args = []string{"nope"}
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", parseChannel("home#dns"), "usage: ddns [status]").Return(kbchat.SendResponse{}, nil).Once()
+
+	fakeStdout := captureOutput(t, func() {
+		require.NotNil(t, jobs[0].run(kbc, mocks.NewRequests(t)))
+	})
+	require.Contains(t, fakeStdout, "command rejected")
+	require.Contains(t, fakeStdout, "job=dns")
+}
+
+func TestJobsCommand(t *testing.T) {
+	useGlobals(t)
+	clk := newFakeClock(time.Date(2026, 10, 18, 21, 30, 0, 0, time.UTC))
+	useSchedulerClock(t, clk)
+	scheduledJobs = testJobs(t)
+	scheduledJobs[0].next = time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	scheduledJobs[0].lastRun = time.Date(2026, 10, 18, 21, 0, 0, 0, time.UTC)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	httpReq := mocks.NewRequests(t)
+	msg := createTextMessage("jobs")
+	expectReply := func(text string) {
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, text).Return(kbchat.SendResponse{}, nil).Once()
+	}
+
+	expectReply("Scheduled jobs:\n" +
+		"- dns: `ddns status` at `0 21 * * *` to home#dns, next Mon Oct 19 21:00 UTC, last ran 30m ago\n" +
+		"- idle: `ddns` at `* * * * *` to janik, paused")
+	require.Nil(t, jobsCommand(kbc, msg, httpReq, nil))
+
+	expectReply("Paused job dns.")
+	require.Nil(t, jobsCommand(kbc, msg, httpReq, []string{"pause", "DNS"}))
+	require.True(t, scheduledJobs[0].paused)
+
+	expectReply("Resumed job idle.")
+	require.Nil(t, jobsCommand(kbc, msg, httpReq, []string{"resume", "idle"}))
+	require.False(t, scheduledJobs[1].paused)
+
+	kbc.On("SendMessage", parseChannel("home#dns"), "No dynamic DNS records are configured.").Return(kbchat.SendResponse{}, nil).Once()
+	expectReply("Ran job dns, output posted to home#dns.")
+	require.Nil(t, jobsCommand(kbc, msg, httpReq, []string{"run-now", "dns"}))
+
+	var botErr *BotError
+	err := jobsCommand(kbc, msg, httpReq, []string{"pause", "nope"})
+	require.True(t, errors.As(err, &botErr))
+	require.Equal(t, "No job named \"nope\", see `jobs list`.", botErr.Message)
+
+	err = jobsCommand(kbc, msg, httpReq, []string{"stop", "dns"})
+	require.True(t, errors.As(err, &botErr))
+	require.Equal(t, KindInput, botErr.Kind)
+}
+
+func TestJobsRunNowChecks(t *testing.T) {
+	useGlobals(t)
+	useSchedulerClock(t, newFakeClock(time.Date(2026, 10, 18, 21, 30, 0, 0, time.UTC)))
+	scheduledJobs = testJobs(t)
+
+	kbc := mocks.NewKeyBaseChat(t)
+	httpReq := mocks.NewRequests(t)
+	msg := createTeamMessage("jobs run-now dns", "mallory", "family", "general")
+	expectReply := func(text string) {
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, text).Return(kbchat.SendResponse{}, nil).Once()
+	}
+
+	// the sender may run jobs, but not the command of this one
+	acl = &ACL{Default: aclAllow, Rules: []ACLRule{{Action: aclDeny, Commands: []string{"ddns"}}}}
+	expectReply("Sorry, you are not authorized to run `ddns`.")
+	fakeStdout := captureOutput(t, func() {
+		require.Nil(t, jobsCommand(kbc, msg, httpReq, []string{"run-now", "dns"}))
+	})
+	require.Contains(t, fakeStdout, "audit: command denied command=ddns sender=mallory")
+
+	acl = &ACL{Default: aclAllow}
+	limiter, _ = newTestLimiter(rateLimits{Commands: map[string]*rateLimit{"ddns": {1, time.Minute}}})
+	kbc.On("SendMessage", parseChannel("home#dns"), "No dynamic DNS records are configured.").Return(kbchat.SendResponse{}, nil).Once()
+	expectReply("Ran job dns, output posted to home#dns.")
+	require.Nil(t, jobsCommand(kbc, msg, httpReq, []string{"run-now", "dns"}))
+
+	expectReply("Slow down! Too many commands, try again in 1m0s.")
+	fakeStdout = captureOutput(t, func() {
+		require.Nil(t, jobsCommand(kbc, msg, httpReq, []string{"run-now", "dns"}))
+	})
+	require.Contains(t, fakeStdout, "rate limited")
+	require.Contains(t, fakeStdout, "limit=command")
+}
+
+func TestJobInherit(t *testing.T) {
+	old := testJobs(t)
+	old[0].setPaused(true)
+	old[0].lastRun = time.Date(2026, 10, 18, 21, 0, 0, 0, time.UTC)
+	old[1].setPaused(true)
+
+	reloaded := testJobs(t)
+	reloaded[1].Paused = false
+	require.Nil(t, validateJobs(reloaded))
+	for i := range reloaded {
+		reloaded[i].inherit(old[i])
+	}
+
+	require.True(t, reloaded[0].paused)
+	require.Equal(t, old[0].lastRun, reloaded[0].lastRun)
+	// paused in the config rather than from chat, so the reload wins
+	require.False(t, reloaded[1].paused)
+}
+
+func TestValidateJobsErrors(t *testing.T) {
+	cases := []struct {
+		job           *job
+		expectedError string
+	}{
+		{&job{Schedule: "@daily", Command: "ip", Channel: "home"}, "job 1: name must be a single word"},
+		{&job{Name: "a", Schedule: "@daily", Command: "ip"}, "job 1: a: no channel given"},
+		{&job{Name: "a", Schedule: "daily", Command: "ip", Channel: "home"}, `a: invalid schedule "daily"`},
+		{&job{Name: "a", Schedule: "0 0 30 2 *", Command: "ip", Channel: "home"}, "a: schedule never matches"},
+		{&job{Name: "a", Schedule: "@daily", Command: "ip", Channel: "home", Timezone: "Mars/Olympus"}, `a: unknown timezone "Mars/Olympus"`},
+		{&job{Name: "a", Schedule: "@daily", Command: "frobnicate", Channel: "home"}, `a: unknown command "frobnicate"`},
+		{&job{Name: "a", Schedule: "@daily", Command: "ip now", Channel: "home"}, "a: usage: ip"},
+	}
+	for _, c := range cases {
+		err := validateJobs([]*job{c.job})
+		require.NotNil(t, err, c.expectedError)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+
+	err := validateJobs([]*job{
+		{Name: "a", Schedule: "@daily", Command: "ip", Channel: "home"},
+		{Name: "A", Schedule: "@hourly", Command: "ip", Channel: "home"},
+	})
+	require.EqualError(t, err, `job 2: duplicate name "a"`)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// keybaseNamespacePrefix keeps the bot's namespaces apart from others in
+// the same KV store.
+const keybaseNamespacePrefix = "keybasebot."
+
+// KVStore is the part of the Keybase KV store API the bot uses.
+type KVStore interface {
+	GetEntry(teamName *string, namespace string, entryKey string) (keybase1.KVGetResult, error)
+	PutEntry(teamName *string, namespace string, entryKey string, entryValue string) (keybase1.KVPutResult, error)
+	DeleteEntry(teamName *string, namespace string, entryKey string) (keybase1.KVDeleteEntryResult, error)
+	ListEntryKeys(teamName *string, namespace string) (keybase1.KVListEntryResult, error)
+}
+
+var (
+	kvStoreMu sync.Mutex
+	// kvStore is the bot's connection to the Keybase service, shared with
+	// the chat API so no second service process is started.
+	kvStore KVStore
+)
+
+func setKVStore(api KVStore) {
+	kvStoreMu.Lock()
+	defer kvStoreMu.Unlock()
+	kvStore = api
+}
+
+// sharedKVStore returns the connection set by setKVStore.
+func sharedKVStore() (KVStore, error) {
+	kvStoreMu.Lock()
+	defer kvStoreMu.Unlock()
+	if kvStore == nil {
+		return nil, errors.New("not connected to Keybase")
+	}
+	return kvStore, nil
+}
+
+// keybaseStorage keeps state in the encrypted Keybase KV store of team, or
+// of the bot's own account when team is nil, so it follows the bot to
+// whichever host it runs on. It uses the bot's connection once there is
+// one.
+type keybaseStorage struct {
+	team    *string
+	now     func() time.Time
+	mu      sync.Mutex
+	api     KVStore
+	connect func() (KVStore, error)
+}
+
+func newKeybaseStorage(team string) *keybaseStorage {
+	s := &keybaseStorage{now: time.Now, connect: sharedKVStore}
+	if team != "" {
+		s.team = &team
+	}
+	return s
+}
+
+func (s *keybaseStorage) client() (KVStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.api == nil {
+		api, err := s.connect()
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the Keybase KV store: %w", err)
+		}
+		s.api = api
+	}
+	return s.api, nil
+}
+
+// entry returns the stored entry of key, which is nil when key is not set.
+func (s *keybaseStorage) entry(api KVStore, namespace string, key string) (*storageEntry, error) {
+	result, err := api.GetEntry(s.team, keybaseNamespacePrefix+namespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s/%s from Keybase: %w", namespace, key, err)
+	}
+	if result.EntryValue == nil || *result.EntryValue == "" {
+		return nil, nil
+	}
+
+	var entry storageEntry
+	if err := json.Unmarshal([]byte(*result.EntryValue), &entry); err != nil {
+		return nil, fmt.Errorf("could not decode %s/%s from Keybase: %s", namespace, key, err.Error())
+	}
+	return &entry, nil
+}
+
+func (s *keybaseStorage) Get(namespace string, key string) ([]byte, error) {
+	api, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := s.entry(api, namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.expired(s.now()) {
+		return nil, errNoEntry
+	}
+	return entry.Value, nil
+}
+
+func (s *keybaseStorage) Put(namespace string, key string, value []byte, ttl time.Duration) error {
+	api, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	entry := storageEntry{Value: value}
+	if ttl > 0 {
+		expires := s.now().Add(ttl)
+		entry.Expires = &expires
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := api.PutEntry(s.team, keybaseNamespacePrefix+namespace, key, string(data)); err != nil {
+		return fmt.Errorf("could not save %s/%s to Keybase: %w", namespace, key, err)
+	}
+	return nil
+}
+
+func (s *keybaseStorage) Delete(namespace string, key string) error {
+	api, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	// Keybase refuses to delete an entry that is not set
+	entry, err := s.entry(api, namespace, key)
+	if err != nil || entry == nil {
+		return err
+	}
+	if _, err := api.DeleteEntry(s.team, keybaseNamespacePrefix+namespace, key); err != nil {
+		return fmt.Errorf("could not delete %s/%s from Keybase: %w", namespace, key, err)
+	}
+	return nil
+}
+
+// List reads every entry to leave out the expired ones, as Keybase does
+// not know about expiry.
+func (s *keybaseStorage) List(namespace string) ([]string, error) {
+	api, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	result, err := api.ListEntryKeys(s.team, keybaseNamespacePrefix+namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s in Keybase: %w", namespace, err)
+	}
+
+	now := s.now()
+	keys := []string{}
+	for _, listed := range result.EntryKeys {
+		entry, err := s.entry(api, namespace, listed.EntryKey)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil && !entry.expired(now) {
+			keys = append(keys, listed.EntryKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newKVStore returns a KVStore mock that behaves like the Keybase KV store
+// of team, keeping its entries in a map.
+func newKVStore(t *testing.T, team string) (*mocks.KVStore, map[string]map[string]string) {
+	entries := make(map[string]map[string]string)
+	api := mocks.NewKVStore(t)
+	teamMatches := mock.MatchedBy(func(teamName *string) bool {
+		return (teamName == nil && team == "") || (teamName != nil && *teamName == team)
+	})
+
+	api.On("GetEntry", teamMatches, mock.Anything, mock.Anything).Maybe().Return(
+		func(_ *string, namespace string, key string) keybase1.KVGetResult {
+			result := keybase1.KVGetResult{Namespace: namespace, EntryKey: key}
+			if value, ok := entries[namespace][key]; ok {
+				result.EntryValue = &value
+			}
+			return result
+		}, nil)
+	api.On("PutEntry", teamMatches, mock.Anything, mock.Anything, mock.Anything).Maybe().Return(
+		func(_ *string, namespace string, key string, value string) keybase1.KVPutResult {
+			if entries[namespace] == nil {
+				entries[namespace] = make(map[string]string)
+			}
+			entries[namespace][key] = value
+			return keybase1.KVPutResult{Namespace: namespace, EntryKey: key}
+		}, nil)
+	api.On("DeleteEntry", teamMatches, mock.Anything, mock.Anything).Maybe().Return(
+		func(_ *string, namespace string, key string) keybase1.KVDeleteEntryResult {
+			delete(entries[namespace], key)
+			return keybase1.KVDeleteEntryResult{Namespace: namespace, EntryKey: key}
+		}, nil)
+	api.On("ListEntryKeys", teamMatches, mock.Anything).Maybe().Return(
+		func(_ *string, namespace string) keybase1.KVListEntryResult {
+			result := keybase1.KVListEntryResult{Namespace: namespace}
+			for key := range entries[namespace] {
+				result.EntryKeys = append(result.EntryKeys, keybase1.KVListEntryKey{EntryKey: key})
+			}
+			return result
+		}, nil)
+	return api, entries
+}
+
+func TestKeybaseStorage(t *testing.T) {
+	api, entries := newKVStore(t, "home.bot")
+	connects := 0
+	s := newKeybaseStorage("home.bot")
+	s.connect = func() (KVStore, error) {
+		connects++
+		return api, nil
+	}
+	clk := newFakeClock(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	s.now = clk.Now
+
+	testStorage(t, s, clk.Advance)
+	require.Equal(t, 1, connects)
+
+	// namespaces are prefixed and expired entries stay until overwritten
+	require.Contains(t, entries, "keybasebot.prefs")
+	require.Contains(t, entries["keybasebot.prefs"], "bob/timezone")
+	require.Contains(t, entries, "keybasebot.ip")
+}
+
+func TestKeybaseStorageOwnAccount(t *testing.T) {
+	api, entries := newKVStore(t, "")
+	s := newKeybaseStorage("")
+	s.connect = func() (KVStore, error) { return api, nil }
+
+	require.Nil(t, putJson(s, ipNamespace, "last", publicIp{V4: "203.0.113.7"}, 0))
+	require.Equal(t, `{"value":"eyJWNCI6IjIwMy4wLjExMy43IiwiVjYiOiIifQ=="}`, entries["keybasebot.ip"]["last"])
+
+	var ip publicIp
+	found, err := getJson(s, ipNamespace, "last", &ip)
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, publicIp{V4: "203.0.113.7"}, ip)
+}
+
+func TestKeybaseStorageErrors(t *testing.T) {
+	s := newKeybaseStorage("home.bot")
+	s.connect = func() (KVStore, error) { return nil, errors.New("keybase is not running") }
+	_, err := s.Get("prefs", "janik/timezone")
+	require.Equal(t, "could not connect to the Keybase KV store: keybase is not running", err.Error())
+
+	api := mocks.NewKVStore(t)
+	s.connect = func() (KVStore, error) { return api, nil }
+	broken := "{"
+	api.On("GetEntry", mock.Anything, "keybasebot.prefs", "janik/timezone").Return(keybase1.KVGetResult{EntryValue: &broken}, nil).Once()
+	_, err = s.Get("prefs", "janik/timezone")
+	require.Contains(t, err.Error(), "could not decode prefs/janik/timezone from Keybase")
+
+	api.On("PutEntry", mock.Anything, "keybasebot.prefs", "janik/timezone", mock.Anything).Return(keybase1.KVPutResult{}, errors.New("team not found")).Once()
+	err = s.Put("prefs", "janik/timezone", []byte("UTC"), 0)
+	require.Equal(t, "could not save prefs/janik/timezone to Keybase: team not found", err.Error())
+
+	// deleting an unset key does not ask Keybase to delete it
+	api.On("GetEntry", mock.Anything, "keybasebot.prefs", "alice/timezone").Return(keybase1.KVGetResult{}, nil).Once()
+	require.Nil(t, s.Delete("prefs", "alice/timezone"))
+
+	api.On("ListEntryKeys", mock.Anything, "keybasebot.reminders").Return(keybase1.KVListEntryResult{}, errors.New("timeout")).Once()
+	_, err = s.List("reminders")
+	require.Equal(t, "could not list reminders in Keybase: timeout", err.Error())
+}
+
+func TestKeybaseStorageSharesConnection(t *testing.T) {
+	t.Cleanup(func() { setKVStore(nil) })
+	s := newKeybaseStorage("home.bot")
+
+	// the chat connection is not up yet
+	_, err := s.Get("prefs", "janik/timezone")
+	require.Equal(t, "could not connect to the Keybase KV store: not connected to Keybase", err.Error())
+
+	api, _ := newKVStore(t, "home.bot")
+	setKVStore(api)
+	require.Nil(t, s.Put("prefs", "janik/timezone", []byte("UTC"), 0))
+	value, err := s.Get("prefs", "janik/timezone")
+	require.Nil(t, err)
+	require.Equal(t, []byte("UTC"), value)
+}
+
+func TestOpenStorage(t *testing.T) {
+	s, err := openStorage(storageSettings{Backend: storageKeybase, Team: "home.bot"})
+	require.Nil(t, err)
+	require.Equal(t, "home.bot", *s.(*keybaseStorage).team)
+
+	s, err = openStorage(storageSettings{Backend: storageMemory})
+	require.Nil(t, err)
+	require.IsType(t, &localStorage{}, s)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// StructuredLogger writes leveled log lines with key-value fields, either
+// as logfmt-style text or as one JSON object per line.
+type StructuredLogger struct {
+	mu    sync.Mutex
+	level Level
+	json  bool
+
+	// out is nil to follow the standard library logger's output.
+	out io.Writer
+	now func() time.Time
+}
+
+func NewStructuredLogger(level Level, format string) (*StructuredLogger, error) {
+	if format != "" && format != "text" && format != "json" {
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return &StructuredLogger{
+		level: level,
+		json:  format == "json",
+		now:   time.Now,
+	}, nil
+}
+
+func (s *StructuredLogger) Printf(format string, v ...any) {
+	s.log(LevelInfo, fmt.Sprintf(format, v...), nil)
+}
+
+func (s *StructuredLogger) Debug(msg string, keyvals ...any) {
+	s.log(LevelDebug, msg, keyvals)
+}
+
+func (s *StructuredLogger) Info(msg string, keyvals ...any) {
+	s.log(LevelInfo, msg, keyvals)
+}
+
+func (s *StructuredLogger) Warn(msg string, keyvals ...any) {
+	s.log(LevelWarn, msg, keyvals)
+}
+
+func (s *StructuredLogger) Error(msg string, keyvals ...any) {
+	s.log(LevelError, msg, keyvals)
+}
+
+// SetOptions changes the level and format of a logger that may be in use.
+func (s *StructuredLogger) SetOptions(level Level, format string) error {
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.level = level
+	s.json = format == "json"
+	return nil
+}
+
+func (s *StructuredLogger) log(level Level, msg string, keyvals []any) {
+	s.mu.Lock()
+	minLevel, asJson := s.level, s.json
+	s.mu.Unlock()
+	if level < minLevel {
+		return
+	}
+
+	fields := make(map[string]any)
+	var keys []string
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value any = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if _, seen := fields[key]; !seen {
+			keys = append(keys, key)
+		}
+		fields[key] = value
+	}
+
+	timestamp := s.now().UTC().Format(time.RFC3339)
+
+	var line string
+	if asJson {
+		fields["time"] = timestamp
+		fields["level"] = level.String()
+		fields["msg"] = msg
+		data, err := json.Marshal(fields)
+		if err != nil {
+			data, _ = json.Marshal(map[string]string{"time": timestamp, "level": "error", "msg": "could not encode log line", "error": err.Error()})
+		}
+		line = string(data)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s %s", timestamp, strings.ToUpper(level.String()), msg)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%s", key, formatValue(fields[key]))
+		}
+		line = b.String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.out
+	if out == nil {
+		out = log.Writer()
+	}
+	fmt.Fprintln(out, redactSecrets(line))
+}
+
+// formatValue renders a field value for text output, quoting it when it
+// contains spaces or quotes.
+func formatValue(value any) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return strconv.Quote(text)
+	}
+	return text
+}
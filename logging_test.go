@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogger(t *testing.T, level Level, format string) (*StructuredLogger, *bytes.Buffer) {
+	l, err := NewStructuredLogger(level, format)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	l.out = &buf
+	l.now = func() time.Time { return time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestStructuredLoggerText(t *testing.T) {
+	l, buf := newTestLogger(t, LevelInfo, "text")
+
+	l.Debug("hidden", "a", 1)
+	l.Info("command handled", "command", "ip", "latency", time.Millisecond*1500, "sender", "")
+	l.Error("command failed", "error", errors.New("no route to host"), "odd")
+	l.Printf("hello %s", "world")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, []string{
+		`2022-04-01T12:00:00Z INFO command handled command=ip latency=1.5s sender=""`,
+		`2022-04-01T12:00:00Z ERROR command failed error="no route to host" odd=(missing)`,
+		`2022-04-01T12:00:00Z INFO hello world`,
+	}, lines)
+}
+
+func TestStructuredLoggerJSON(t *testing.T) {
+	l, buf := newTestLogger(t, LevelWarn, "json")
+
+	l.Info("hidden")
+	l.Warn("queue full, rejecting message", "conversation", "abc", "depth", 16)
+
+	var line map[string]any
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, map[string]any{
+		"time":         "2022-04-01T12:00:00Z",
+		"level":        "warn",
+		"msg":          "queue full, rejecting message",
+		"conversation": "abc",
+		"depth":        float64(16),
+	}, line)
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError} {
+		level, err := parseLevel(name)
+		require.Nil(t, err)
+		require.Equal(t, expected, level)
+	}
+
+	_, err := parseLevel("verbose")
+	require.EqualError(t, err, `unknown log level "verbose"`)
+}
+
+func TestSetupLogger(t *testing.T) {
+	saved := logger
+	t.Cleanup(func() { logger = saved })
+
+	require.Nil(t, setupLogger("debug", "json"))
+	require.Equal(t, LevelDebug, logger.(*StructuredLogger).level)
+	require.True(t, logger.(*StructuredLogger).json)
+
+	require.EqualError(t, setupLogger("loud", ""), `unknown log level "loud"`)
+	require.EqualError(t, setupLogger("", "xml"), `unknown log format "xml", expected text or json`)
+}
+
+func TestHandleMessageLogsFields(t *testing.T) {
+	saved := logger
+	t.Cleanup(func() { logger = saved })
+
+	mockLogger := mocks.NewLogger(t)
+	logger = mockLogger
+
+	msg := createTeamMessage("hme", "alice", "family", "general")
+	mockLogger.On("Info", "unknown command", "conversation", "family#general", "sender", "alice", "keyword", "hme").Return()
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "unknown command \"hme\", did you mean `home`?").Return(kbchat.SendResponse{}, nil)
+
+	handleMessage(kbc, msg, mocks.NewRequests(t))
+}
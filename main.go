@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
-	"regexp"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
@@ -15,50 +15,81 @@ import (
 
 type KeyBaseChat interface {
 	ListenForNewTextMessages() (*kbchat.Subscription, error)
+	SendMessage(channel chat1.ChatChannel, body string, args ...interface{}) (kbchat.SendResponse, error)
 	SendReply(channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...interface{}) (kbchat.SendResponse, error)
 }
 
 type SubReader interface {
 	Read() (kbchat.SubscriptionMessage, error)
+	Shutdown()
 }
 
+// Logger writes leveled log lines. keyvals are alternating keys and
+// values, e.g. logger.Info("command handled", "command", "ip").
 type Logger interface {
 	Printf(format string, v ...any)
-}
-
-type NativeLogger struct{}
-
-func (n NativeLogger) Printf(format string, v ...any) {
-	log.Printf(format, v...)
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
 }
 
 var (
-	kbLoc      string
-	kbc        KeyBaseChat
-	err        error
-	logger     Logger
-	fail       func(string, ...any)
-	hassApiKey string
-	exitFunc   func(int)
+	kbLoc  string
+	logger Logger = &StructuredLogger{level: LevelInfo, now: time.Now}
+
+	// botUsername is the bot's own Keybase user. Its messages are never
+	// handled, so the bot cannot answer its own replies.
+	botUsername string
 )
 
+// dotenv is loaded into the environment before the configuration.
 var dotenv = ".env"
 
-func setupEnv() {
+var errNotText = errors.New("message read failed: not text")
+
+// setupEnv loads the .env file and then the config file at path, or the
+// one named by CONFIG_FILE, and applies it.
+func setupEnv(path string) error {
 	if err := godotenv.Load(dotenv); err != nil {
-		fail("could not load .env file: %s", err.Error())
-		return
+		logger.Error("could not load .env file", "error", err)
 	}
 
-	kbLoc = os.Getenv("KB_LOCATION")
-	hassApiKey = os.Getenv("HASS_API_KEY")
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	configPath = path
+	config, err := loadConfig(configPath, os.Getenv)
+	if err == nil {
+		err = config.openState()
+	}
+	if err != nil {
+		// fail closed rather than leaving every command open
+		acl = &ACL{Default: aclDeny}
+		logger.Error("invalid configuration", "error", err)
+		return err
+	}
+	config.apply()
+	return nil
 }
 
-func init() {
-	setupEnv()
-	logger = new(NativeLogger)
-	fail = logger.Printf
-	exitFunc = os.Exit
+// setupLogger replaces logger with one using the given level and format;
+// empty values keep the defaults of info and text.
+func setupLogger(level string, format string) error {
+	parsed := LevelInfo
+	if level != "" {
+		var err error
+		if parsed, err = parseLevel(level); err != nil {
+			return err
+		}
+	}
+
+	structured, err := NewStructuredLogger(parsed, format)
+	if err != nil {
+		return err
+	}
+	logger = structured
+	return nil
 }
 
 func readSub(sub SubReader) (kbchat.SubscriptionMessage, error) {
@@ -68,7 +99,7 @@ func readSub(sub SubReader) (kbchat.SubscriptionMessage, error) {
 	}
 
 	if msg.Message.Content.TypeName != "text" {
-		return kbchat.SubscriptionMessage{}, errors.New("message read failed: not text")
+		return kbchat.SubscriptionMessage{}, errNotText
 	}
 
 	return msg, nil
@@ -79,71 +110,161 @@ func reply(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, reply string) error
 		return nil
 	}
 
-	_, err := kbc.SendReply(msg.Message.Channel, &msg.Message.Id, reply)
+	_, err := kbc.SendReply(msg.Message.Channel, &msg.Message.Id, redactSecrets(reply))
 	if err != nil {
-		return fmt.Errorf("error sending reply: %s", err.Error())
+		replyFailures.inc()
+		return fmt.Errorf("%w: %s", errReplyFailed, err.Error())
 	}
 	return nil
 }
 
-func parseMessages(kbc KeyBaseChat, sub SubReader, httpReq Requests) {
-	msg, err := readSub(sub)
-
-	if err != nil {
-		fail(err.Error())
+func handleMessage(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests) {
+	if botUsername != "" && strings.EqualFold(msg.Message.Sender.Username, botUsername) {
 		return
 	}
 
 	body := msg.Message.Content.Text.Body
-	input := strings.ToLower(strings.TrimSpace(body))
+	input := strings.TrimSpace(body)
 
-	ip := regexp.MustCompile(`ip`)
-	bye := regexp.MustCompile(`bye`)
-	home := regexp.MustCompile(`home`)
+	fields := []any{
+		"conversation", conversationKey(msg),
+		"sender", msg.Message.Sender.Username,
+	}
 
-	if ip.MatchString(input) {
-		ipAddr, err := getIp(httpReq)
-		if err != nil {
-			fail("could not get ip address: %s", err.Error())
-		}
-		reply(kbc, msg, ipAddr)
-	} else if bye.MatchString(input) {
-		exitFunc(0)
-	} else if home.MatchString(input) {
-		hassStrings := strings.Split(input, " ")
-		hassString := strings.Join(hassStrings[1:], "/")
-		hassUrl := fmt.Sprintf("http://home-assistant.home.lan:8123/api/%s", hassString)
-		hassOutput, err := getFromHass(httpReq, hassUrl)
-		if err != nil {
-			fail("error communicating with Home Assistant: %s", err.Error())
-		}
-		log.Println(hassOutput)
-		reply(kbc, msg, hassOutput)
-	} else {
-		log.Println(input)
+	keyword := strings.Fields(input)
+	if len(keyword) == 0 {
+		return
 	}
-}
 
-func mainLoop(kbc KeyBaseChat, httpReq Requests) {
-	log.Println("bot started")
+	cfg := snapshotConfig()
+	cmd, args, ok := commands.Match(input)
+	name := ""
+	if ok {
+		name = cmd.Name()
+		fields = append(fields, "command", name)
+	}
 
-	sub, err := kbc.ListenForNewTextMessages()
-	if err != nil {
-		fail("could not start subscription: %s", err.Error())
+	// unknown commands count too, as they are answered
+	if throttled(kbc, msg, cfg.limiter, name, fields) {
 		return
 	}
 
-	for {
-		parseMessages(kbc, sub, httpReq)
+	if !ok {
+		logger.Info("unknown command", append(fields, "keyword", keyword[0])...)
+		reply(kbc, msg, unknownCommand(commands, keyword[0]))
+		return
+	}
+
+	if !authorize(kbc, msg, cfg.acl, cmd, args) {
+		return
+	}
+
+	if err := checkArgs(cmd, args); err != nil {
+		reply(kbc, msg, err.Error())
+		return
 	}
+
+	commandsDispatched.inc(cmd.Name())
+	start := time.Now()
+	err := cmd.Run(kbc, msg, httpReq, args)
+	fields = append(fields, "latency", time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		reportError(kbc, msg, err, fields)
+		return
+	}
+	logger.Info("command handled", fields...)
 }
 
-func main() {
-	if kbc, err = kbchat.Start(kbchat.RunOptions{KeybaseLocation: kbLoc}); err != nil {
-		fail("could not start: %s", err.Error())
+// reportError logs a failed command with a correlation ID and tells the
+// user what went wrong.
+func reportError(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, err error, fields []any) {
+	if errors.Is(err, errReplyFailed) {
+		logger.Error("command failed", append(fields, "error", err)...)
 		return
 	}
 
-	httpReq = new(httpRequests)
-	mainLoop(kbc, httpReq)
+	botErr := classifyError(err)
+	if botErr.Kind == KindInput {
+		logger.Info("command rejected", append(fields, "error", err)...)
+		reply(kbc, msg, renderError(botErr, ""))
+		return
+	}
+
+	id := newErrorId()
+	logger.Error("command failed", append(fields, "error", err, "error_id", id, "retryable", botErr.Retryable())...)
+	if err := reply(kbc, msg, renderError(botErr, id)); err != nil {
+		logger.Error("could not report failure", "error_id", id, "error", err)
+	}
+}
+
+// mainLoop handles incoming messages until ctx is cancelled or a shutdown
+// command is received, then drains in-flight commands.
+func mainLoop(ctx context.Context, kbc KeyBaseChat, httpReq Requests) error {
+	logger.Info("bot started")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	setShutdownFunc(cancel)
+	defer setShutdownFunc(nil)
+
+	messages := make(chan kbchat.SubscriptionMessage)
+	listenErr := make(chan error, 1)
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		listenErr <- listen(ctx, kbc, messages)
+	}()
+	defer func() {
+		cancel()
+		<-listening
+	}()
+	go watchConfigFile(ctx, configPath)
+
+	reloading := make(chan struct{})
+	go func() {
+		defer close(reloading)
+		runReloads(ctx, func() *background { return startBackground(ctx, kbc, httpReq) })
+	}()
+	defer func() {
+		cancel()
+		<-reloading
+	}()
+
+	pool := newWorkerPool(workerCount, queueDepth, func(msg kbchat.SubscriptionMessage) {
+		handleMessage(kbc, msg, httpReq)
+	})
+	// stop turns new messages away and waits for the ones in flight
+	stop := func() error {
+		setAccepting(false)
+		pool.close()
+		return drain(kbc, &pool.wg)
+	}
+	setAccepting(true)
+	defer setAccepting(false)
+	for {
+		if ctx.Err() != nil {
+			return stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return stop()
+		case err := <-listenErr:
+			if err != nil {
+				if drainErr := stop(); drainErr != nil {
+					logger.Error("could not drain", "error", drainErr)
+				}
+				return err
+			}
+		case msg := <-messages:
+			if !pool.submit(msg) {
+				logger.Warn("queue full, rejecting message", "conversation", conversationKey(msg), "sender", msg.Message.Sender.Username)
+				reply(kbc, msg, busyReply)
+			}
+		}
+	}
+}
+
+func main() {
+	os.Exit(runCli(os.Args[1:], os.Stdout, os.Stderr))
 }
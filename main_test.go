@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -103,18 +105,29 @@ func TestReadSub(t *testing.T) {
 	}
 }
 
-func captureOutput(t *testing.T, f func()) string {
-	var buf bytes.Buffer
-	log.SetOutput(&buf)
+// syncBuffer is written to by the logger and by kbchat's debug output,
+// which may run on different goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
 
-	fail = func(format string, v ...any) {
-		log.Printf(format, v...)
-	}
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func captureOutput(t *testing.T, f func()) string {
+	buf := new(syncBuffer)
+	log.SetOutput(buf)
 
 	f()
 
-	fakeStdout, err := ioutil.ReadAll(&buf)
 	log.SetOutput(os.Stdout)
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	fakeStdout, err := ioutil.ReadAll(&buf.buf)
 
 	if err != nil {
 		t.Error(err.Error())
@@ -126,20 +139,19 @@ func captureOutput(t *testing.T, f func()) string {
 func TestInitDotenv(t *testing.T) {
 	dotenv = "itdoesnotexist"
 
-	fakeStdout := captureOutput(t, func() { setupEnv() })
+	fakeStdout := captureOutput(t, func() { setupEnv("") })
 
 	require.Contains(t, fakeStdout, "could not load")
 }
 
-func TestParseMessages(t *testing.T) {
+func TestHandleMessage(t *testing.T) {
+	useErrorId(t, "0badc0de")
+	useIpProviders(t, builtinIpProviders["ipify"])
 	kbc := mocks.NewKeyBaseChat(t)
 
-	exitFunc = func(code int) { fmt.Printf("exiting with code %d\n", code) }
-
 	cases := []struct {
 		message           kbchat.SubscriptionMessage
 		expectedOutput    any
-		expectedError     error
 		expectedIpError   error
 		expectedHassError error
 		expectedInput     string
@@ -150,50 +162,28 @@ func TestParseMessages(t *testing.T) {
 			"test",
 			nil,
 			nil,
-			nil,
-			"",
-			"",
-		},
-		{
-			createTextMessage("fail"),
-			"fail",
-			errors.New("fail"),
-			nil,
-			nil,
-			"",
 			"",
+			"unknown command \"test\", type `help` to list commands",
 		},
 		{
 			createTextMessage("ip"),
 			"looking up",
 			nil,
 			nil,
-			nil,
-			"1.1.1.1",
 			"1.1.1.1",
+			"IPv4: 1.1.1.1",
 		},
 		{
 			createTextMessage("ip"),
 			"",
-			nil,
 			errors.New("ip"),
 			nil,
 			"could not get ip address",
-			"could not get ip address: error getting document: ip",
-		},
-		{
-			createNonTextMessage("nontext"),
-			"not text",
-			nil,
-			nil,
-			nil,
-			"nontext",
-			"not text",
+			"Could not determine the public IP address. Please try again in a minute. (error 0badc0de)",
 		},
 		{
 			createTextMessage("home"),
-			"HASS says:",
-			nil,
+			"command handled conversation=test#c sender=\"\" command=home",
 			nil,
 			nil,
 			`{"hello":"world"}`,
@@ -203,37 +193,31 @@ func TestParseMessages(t *testing.T) {
 			createTextMessage("home"),
 			"error communicating with Home Assistant: error with Home Assistant request: hassError",
 			nil,
-			nil,
 			errors.New("hassError"),
 			`{"hello":"world"}`,
-			"HASS says: \n```\nhello: world\n\n```",
+			"Something went wrong. (error 0badc0de)",
 		},
 		{
 			createTextMessage("bye"),
-			"",
-			nil,
+			"audit: command denied command=shutdown",
 			nil,
 			nil,
 			"",
-			"",
+			"Sorry, you are not authorized to run `shutdown`.",
 		},
 	}
 
 	for _, c := range cases {
-		sub := mocks.NewSubReader(t)
-
-		sub.On("Read").Return(c.message, c.expectedError).Maybe()
-
 		kbc.On("SendReply", c.message.Message.Channel, &c.message.Message.Id, c.expectedResponse).Return(
 			kbchat.SendResponse{},
 			nil,
 		).Maybe()
 
 		body, bodyWrite := io.Pipe()
-		go func() {
-			fmt.Fprint(bodyWrite, c.expectedInput)
+		go func(input string) {
+			fmt.Fprint(bodyWrite, input)
 			bodyWrite.Close()
-		}()
+		}(c.expectedInput)
 
 		httpReq := mocks.NewRequests(t)
 		httpReq.On("Get", "https://api.ipify.org").Return(&http.Response{
@@ -244,7 +228,7 @@ func TestParseMessages(t *testing.T) {
 		hassUrl := "http://home-assistant.home.lan:8123/api/"
 
 		header := make(map[string][]string)
-		header["Authorization"] = []string{fmt.Sprintf("Bearer %s", hassApiKey)}
+		header["Authorization"] = []string{fmt.Sprintf("Bearer %s", hassInstances[""].Token)}
 
 		hassUrlAsUrl, _ := url.Parse(hassUrl)
 
@@ -260,7 +244,7 @@ func TestParseMessages(t *testing.T) {
 			Body:       body,
 		}, nil).Maybe()
 
-		fakeStdout := captureOutput(t, func() { parseMessages(kbc, sub, httpReq) })
+		fakeStdout := captureOutput(t, func() { handleMessage(kbc, c.message, httpReq) })
 		require.Contains(t, fakeStdout, c.expectedOutput)
 	}
 }
@@ -294,9 +278,23 @@ func TestReply(t *testing.T) {
 
 }
 
+func TestHandleMessageIgnoresOwnMessages(t *testing.T) {
+	useGlobals(t)
+	botUsername = "homebot"
+
+	// the mock fails the test if anything is sent
+	kbc := mocks.NewKeyBaseChat(t)
+	handleMessage(kbc, createTeamMessage("hello", "HomeBot", "home", "general"), mocks.NewRequests(t))
+}
+
 func TestMainLoop(t *testing.T) {
+	useRequestCtx(t)
 	httpReq := mocks.NewRequests(t)
 
+	saved := reconnectPolicy
+	t.Cleanup(func() { reconnectPolicy = saved })
+	reconnectPolicy = backoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 2, MaxAttempts: 2}
+
 	cases := []struct {
 		sub *kbchat.Subscription
 		err error
@@ -309,27 +307,61 @@ func TestMainLoop(t *testing.T) {
 		kbc := mocks.NewKeyBaseChat(t)
 		kbc.On("ListenForNewTextMessages").Return(c.sub, c.err)
 
+		var loopErr error
 		fakeStdout := captureOutput(t, func() {
-			go mainLoop(kbc, httpReq)
-			func() {
-				time.Sleep(time.Second * 2)
-				reply(kbc, createTextMessage("bye"), "")
-			}()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			loopErr = mainLoop(ctx, kbc, httpReq)
 		})
 
 		require.Contains(t, fakeStdout, "bot started")
+		require.Contains(t, fakeStdout, "shutting down")
 		if c.err != nil {
-			require.Contains(t, fakeStdout, "could not start subscription")
+			require.Contains(t, loopErr.Error(), "could not start subscription")
+		} else {
+			require.Nil(t, loopErr)
 		}
 	}
+}
 
+func TestMainLoopShutdownCommand(t *testing.T) {
+	useGlobals(t)
+	acl = &ACL{Default: aclAllow, Rules: []ACLRule{{Action: aclAllow, Commands: []string{"shutdown"}}}}
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("ListenForNewTextMessages").Return(kbchat.NewSubscription(), nil)
+
+	done := make(chan error)
+	go func() { done <- mainLoop(context.Background(), kbc, mocks.NewRequests(t)) }()
+
+	require.Eventually(t, func() bool {
+		shutdownMu.Lock()
+		defer shutdownMu.Unlock()
+		return shutdownFunc != nil
+	}, time.Second, time.Millisecond*10)
+
+	msg := createTextMessage("shutdown")
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "Shutting down.").Return(kbchat.SendResponse{}, nil)
+	handleMessage(kbc, msg, mocks.NewRequests(t))
+
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("mainLoop did not stop after shutdown command")
+	}
 }
 
-func TestMain(t *testing.T) {
-	kbLoc = "itdoesnotexist"
+func TestRunBot(t *testing.T) {
+	useGlobals(t)
+	saved := startChat
+	t.Cleanup(func() { startChat = saved })
+	startChat = func() (KeyBaseChat, error) { return nil, errors.New("keybase not found") }
 
-	fakeStdout := captureOutput(t, func() { main() })
+	var stderr bytes.Buffer
+	fakeStdout := captureOutput(t, func() {
+		require.Equal(t, 1, runCli([]string{"run"}, io.Discard, &stderr))
+	})
 
 	require.Contains(t, fakeStdout, "could not start")
-	require.NotPanics(t, func() { main() })
+	require.Equal(t, "keybasebot run: keybase not found\n", stderr.String())
 }
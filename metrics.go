@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	messagesRead       = newCounter("keybasebot_messages_read_total", "Text messages read from the chat subscription.")
+	commandsDispatched = newCounterVec("keybasebot_commands_total", "Commands dispatched to their handler.", "command")
+	replyFailures      = newCounter("keybasebot_reply_failures_total", "Replies that could not be sent.")
+	hassLatency        = newHistogramVec("keybasebot_hass_request_duration_seconds", "Time taken by Home Assistant API requests.", "method", latencyBuckets)
+	reconnects         = newCounter("keybasebot_reconnects_total", "Times the chat subscription was re-opened.")
+	commandsDropped    = newCounterVec("keybasebot_commands_dropped_total", "Commands dropped by a rate limit.", "limit")
+
+	// metrics are exposed on /metrics in this order.
+	metrics = []metric{messagesRead, commandsDispatched, replyFailures, hassLatency, reconnects, commandsDropped}
+)
+
+// metric is a metric family that writes itself in the Prometheus text
+// format.
+type metric interface {
+	write(w io.Writer)
+}
+
+type metricInfo struct {
+	name string
+	help string
+	kind string
+}
+
+func (m metricInfo) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+}
+
+// writeMetrics writes every metric in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type counter struct {
+	value uint64 // first for 64-bit alignment
+	metricInfo
+}
+
+func newCounter(name string, help string) *counter {
+	return &counter{metricInfo: metricInfo{name, help, "counter"}}
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *counter) write(w io.Writer) {
+	c.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.get())
+}
+
+// counterVec is a counter per value of label.
+type counterVec struct {
+	metricInfo
+	label  string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{metricInfo: metricInfo{name, help, "counter"}, label: label, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value]++
+}
+
+func (c *counterVec) get(value string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	c.writeHeader(w)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, formatLabel(c.label, value), c.values[value])
+	}
+}
+
+// histogramVec is a histogram per value of label.
+type histogramVec struct {
+	metricInfo
+	label   string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		metricInfo: metricInfo{name, help, "histogram"},
+		label:      label,
+		buckets:    buckets,
+		series:     make(map[string]*histogramSeries),
+	}
+}
+
+func (h *histogramVec) observe(value string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.series[value]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) count(value string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.series[value]; s != nil {
+		return s.count
+	}
+	return 0
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	values := make([]string, 0, len(h.series))
+	for value := range h.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	h.writeHeader(w)
+	for _, value := range values {
+		s := h.series[value]
+		label := formatLabel(h.label, value)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", h.name, label, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, label, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(name string, value string) string {
+	return fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
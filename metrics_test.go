@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := newCounter("test_events_total", "Events seen.")
+	c.inc()
+	c.inc()
+
+	vec := newCounterVec("test_commands_total", "Commands run.", "command")
+	vec.inc("ip")
+	vec.inc("home")
+	vec.inc("ip")
+	vec.inc(`say "hi"`)
+
+	h := newHistogramVec("test_duration_seconds", "Time taken.", "method", []float64{0.1, 1})
+	h.observe("GET", 0.05)
+	h.observe("GET", 0.5)
+	h.observe("GET", 3)
+	h.observe("POST", 0.1)
+
+	var buf bytes.Buffer
+	for _, m := range []metric{c, vec, h} {
+		m.write(&buf)
+	}
+	require.Equal(t, `# HELP test_events_total Events seen.
+# TYPE test_events_total counter
+test_events_total 2
+# HELP test_commands_total Commands run.
+# TYPE test_commands_total counter
+test_commands_total{command="home"} 1
+test_commands_total{command="ip"} 2
+test_commands_total{command="say \"hi\""} 1
+# HELP test_duration_seconds Time taken.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="GET",le="0.1"} 1
+test_duration_seconds_bucket{method="GET",le="1"} 2
+test_duration_seconds_bucket{method="GET",le="+Inf"} 3
+test_duration_seconds_sum{method="GET"} 3.55
+test_duration_seconds_count{method="GET"} 3
+test_duration_seconds_bucket{method="POST",le="0.1"} 1
+test_duration_seconds_bucket{method="POST",le="1"} 1
+test_duration_seconds_bucket{method="POST",le="+Inf"} 1
+test_duration_seconds_sum{method="POST"} 0.1
+test_duration_seconds_count{method="POST"} 1
+`, buf.String())
+}
+
+func TestCommandMetrics(t *testing.T) {
+	dispatched, failures := commandsDispatched.get("help"), replyFailures.get()
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", mock.Anything, mock.Anything, mock.Anything).Return(kbchat.SendResponse{}, errors.New("keybase is down"))
+	captureOutput(t, func() {
+		handleMessage(kbc, createTextMessage("help"), mocks.NewRequests(t))
+	})
+
+	require.Equal(t, dispatched+1, commandsDispatched.get("help"))
+	require.Equal(t, failures+1, replyFailures.get())
+}
+
+func TestHassLatencyMetric(t *testing.T) {
+	before := hassLatency.count("GET")
+
+	req, err := http.NewRequest("GET", "https://home.example:8123/api/states/sun.sun", http.NoBody)
+	require.Nil(t, err)
+	httpReq := mocks.NewRequests(t)
+	httpReq.On("Do", req).Return(nil, errors.New("connection refused"))
+	_, err = doHass(httpReq, req)
+	require.NotNil(t, err)
+
+	require.Equal(t, before+1, hassLatency.count("GET"))
+}
@@ -37,6 +37,30 @@ func (_m *KeyBaseChat) ListenForNewTextMessages() (*kbchat.Subscription, error)
 	return r0, r1
 }
 
+// SendMessage provides a mock function with given fields: channel, body, args
+func (_m *KeyBaseChat) SendMessage(channel chat1.ChatChannel, body string, args ...interface{}) (kbchat.SendResponse, error) {
+	var _ca []interface{}
+	_ca = append(_ca, channel, body)
+	_ca = append(_ca, args...)
+	ret := _m.Called(_ca...)
+
+	var r0 kbchat.SendResponse
+	if rf, ok := ret.Get(0).(func(chat1.ChatChannel, string, ...interface{}) kbchat.SendResponse); ok {
+		r0 = rf(channel, body, args...)
+	} else {
+		r0 = ret.Get(0).(kbchat.SendResponse)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(chat1.ChatChannel, string, ...interface{}) error); ok {
+		r1 = rf(channel, body, args...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SendReply provides a mock function with given fields: channel, replyTo, body, args
 func (_m *KeyBaseChat) SendReply(channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...interface{}) (kbchat.SendResponse, error) {
 	var _ca []interface{}
@@ -9,6 +9,30 @@ type Logger struct {
 	mock.Mock
 }
 
+// Debug provides a mock function with given fields: msg, keyvals
+func (_m *Logger) Debug(msg string, keyvals ...interface{}) {
+	var _ca []interface{}
+	_ca = append(_ca, msg)
+	_ca = append(_ca, keyvals...)
+	_m.Called(_ca...)
+}
+
+// Error provides a mock function with given fields: msg, keyvals
+func (_m *Logger) Error(msg string, keyvals ...interface{}) {
+	var _ca []interface{}
+	_ca = append(_ca, msg)
+	_ca = append(_ca, keyvals...)
+	_m.Called(_ca...)
+}
+
+// Info provides a mock function with given fields: msg, keyvals
+func (_m *Logger) Info(msg string, keyvals ...interface{}) {
+	var _ca []interface{}
+	_ca = append(_ca, msg)
+	_ca = append(_ca, keyvals...)
+	_m.Called(_ca...)
+}
+
 // Printf provides a mock function with given fields: format, v
 func (_m *Logger) Printf(format string, v ...interface{}) {
 	var _ca []interface{}
@@ -17,6 +41,14 @@ func (_m *Logger) Printf(format string, v ...interface{}) {
 	_m.Called(_ca...)
 }
 
+// Warn provides a mock function with given fields: msg, keyvals
+func (_m *Logger) Warn(msg string, keyvals ...interface{}) {
+	var _ca []interface{}
+	_ca = append(_ca, msg)
+	_ca = append(_ca, keyvals...)
+	_m.Called(_ca...)
+}
+
 type mockConstructorTestingTNewLogger interface {
 	mock.TestingT
 	Cleanup(func())
@@ -33,6 +33,11 @@ func (_m *SubReader) Read() (kbchat.SubscriptionMessage, error) {
 	return r0, r1
 }
 
+// Shutdown provides a mock function with given fields:
+func (_m *SubReader) Shutdown() {
+	_m.Called()
+}
+
 type mockConstructorTestingTNewSubReader interface {
 	mock.TestingT
 	Cleanup(func())
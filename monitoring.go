@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// monitoringListen is the address of the health and metrics server;
+	// empty disables it. A change takes effect on restart.
+	monitoringListen string
+
+	// subscribed is 1 while a chat subscription is open and accepting 1
+	// while mainLoop takes new commands.
+	subscribed int32
+	accepting  int32
+)
+
+func setSubscribed(ok bool) {
+	atomic.StoreInt32(&subscribed, boolFlag(ok))
+}
+
+func setAccepting(ok bool) {
+	atomic.StoreInt32(&accepting, boolFlag(ok))
+}
+
+func boolFlag(ok bool) int32 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// newMonitoringHandler serves /healthz, which fails while the chat
+// subscription is down, /readyz, which also fails while the bot is
+// starting or shutting down, and /metrics.
+func newMonitoringHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&subscribed) == 0 {
+			http.Error(w, "chat subscription is not connected", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.LoadInt32(&accepting) == 0:
+			http.Error(w, "not accepting commands", http.StatusServiceUnavailable)
+		case atomic.LoadInt32(&subscribed) == 0:
+			http.Error(w, "chat subscription is not connected", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	return mux
+}
+
+// startMonitoring serves newMonitoringHandler on addr until ctx is
+// cancelled. It returns once the address is bound.
+func startMonitoring(ctx context.Context, addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not start monitoring server: %w", err)
+	}
+
+	server := &http.Server{Handler: newMonitoringHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("monitoring server stopped", "error", err)
+		}
+	}()
+
+	logger.Info("monitoring server started", "address", listener.Addr().String())
+	return listener.Addr(), nil
+}
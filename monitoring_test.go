@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// useHealth sets the health flags until the test ends.
+func useHealth(t *testing.T, isSubscribed bool, isAccepting bool) {
+	t.Cleanup(func() {
+		setSubscribed(false)
+		setAccepting(false)
+	})
+	setSubscribed(isSubscribed)
+	setAccepting(isAccepting)
+}
+
+func getMonitoring(t *testing.T, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	newMonitoringHandler().ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	useHealth(t, false, false)
+	code, body := getMonitoring(t, "/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "chat subscription is not connected\n", body)
+	code, body = getMonitoring(t, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "not accepting commands\n", body)
+
+	setAccepting(true)
+	code, body = getMonitoring(t, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "chat subscription is not connected\n", body)
+
+	setSubscribed(true)
+	code, body = getMonitoring(t, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok\n", body)
+	code, _ = getMonitoring(t, "/readyz")
+	require.Equal(t, http.StatusOK, code)
+
+	// draining keeps the bot alive but not ready
+	setAccepting(false)
+	code, _ = getMonitoring(t, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = getMonitoring(t, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	newMonitoringHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	for _, name := range []string{
+		"keybasebot_messages_read_total",
+		"keybasebot_commands_total",
+		"keybasebot_reply_failures_total",
+		"keybasebot_hass_request_duration_seconds",
+		"keybasebot_reconnects_total",
+	} {
+		require.Contains(t, recorder.Body.String(), "# TYPE "+name+" ")
+	}
+}
+
+func TestStartMonitoring(t *testing.T) {
+	useHealth(t, true, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	var addr string
+	captureOutput(t, func() {
+		bound, err := startMonitoring(ctx, "127.0.0.1:0")
+		require.Nil(t, err)
+		addr = bound.String()
+	})
+
+	res, err := http.Get("http://" + addr + "/readyz")
+	require.Nil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "ok\n", string(body))
+
+	_, err = startMonitoring(context.Background(), addr)
+	require.Contains(t, err.Error(), "could not start monitoring server")
+
+	cancel()
+	require.Eventually(t, func() bool {
+		_, err := http.Get("http://" + addr + "/healthz")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+const (
+	limitUser         = "user"
+	limitConversation = "conversation"
+	limitCommand      = "command"
+)
+
+// maxIdleBuckets is how many token buckets are kept before full ones,
+// which behave like new ones, are dropped.
+const maxIdleBuckets = 1000
+
+// rateLimit allows bursts of Requests commands, refilled evenly over Per.
+// It is written as "10/1m" in the config.
+type rateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func parseRateLimit(text string) (rateLimit, error) {
+	count, per, _ := strings.Cut(text, "/")
+	requests, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || requests < 1 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 10/1m", text)
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || duration <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 10/1m", text)
+	}
+	return rateLimit{Requests: requests, Per: duration}, nil
+}
+
+func (l *rateLimit) UnmarshalYAML(unmarshal func(any) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	parsed, err := parseRateLimit(text)
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// perSecond is how many tokens the bucket gains per second.
+func (l *rateLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// rateLimits caps the commands of each user, of each conversation and,
+// for everyone together, of a command given by name. A nil limit is no
+// limit.
+type rateLimits struct {
+	User         *rateLimit            `yaml:"user"`         // RATE_LIMIT_USER
+	Conversation *rateLimit            `yaml:"conversation"` // RATE_LIMIT_CONVERSATION
+	Commands     map[string]*rateLimit `yaml:"commands"`
+}
+
+func (r rateLimits) validate() error {
+	for name := range r.Commands {
+		if cmd, ok := commands.Lookup(name); !ok || cmd.Name() != name {
+			return fmt.Errorf("unknown command %q, give the name rather than an alias", name)
+		}
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	limit   *rateLimit
+	tokens  float64
+	updated time.Time
+
+	// warned is when the sender was last told to slow down.
+	warned time.Time
+}
+
+// refill adds the tokens gained since the last update.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.updated).Seconds() * b.limit.perSecond()
+	b.tokens = math.Min(b.tokens, float64(b.limit.Requests))
+	b.updated = now
+}
+
+// rateLimiter keeps a token bucket per user, conversation and command.
+type rateLimiter struct {
+	limits  rateLimits
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rateLimited says which limit refused a command and how long until it
+// allows the next one. warn is set for the first refusal in a window.
+type rateLimited struct {
+	limit string
+	wait  time.Duration
+	warn  bool
+}
+
+var limiter = newRateLimiter(rateLimits{})
+
+func newRateLimiter(limits rateLimits) *rateLimiter {
+	return &rateLimiter{limits: limits, now: time.Now, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from every bucket that applies, or from none if one
+// of them is empty. command is empty for messages that are not a command.
+func (l *rateLimiter) allow(user string, conversation string, command string) *rateLimited {
+	checks := []struct {
+		limit string
+		key   string
+		rate  *rateLimit
+	}{
+		{limitUser, user, l.limits.User},
+		{limitConversation, conversation, l.limits.Conversation},
+		{limitCommand, command, l.limits.Commands[command]},
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+	var buckets []*tokenBucket
+	for _, check := range checks {
+		if check.rate == nil || check.key == "" {
+			continue
+		}
+		b := l.bucket(check.limit+":"+check.key, check.rate, now)
+		if b.tokens < 1 {
+			refused := &rateLimited{
+				limit: check.limit,
+				wait:  time.Duration((1 - b.tokens) / b.limit.perSecond() * float64(time.Second)),
+			}
+			if now.Sub(b.warned) >= b.limit.Per {
+				b.warned = now
+				refused.warn = true
+			}
+			return refused
+		}
+		buckets = append(buckets, b)
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return nil
+}
+
+// bucket returns the refilled bucket for key, creating a full one if
+// needed. Callers hold l.mu.
+func (l *rateLimiter) bucket(key string, rate *rateLimit, now time.Time) *tokenBucket {
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{limit: rate, tokens: float64(rate.Requests), updated: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// prune drops full buckets once there are too many. Callers hold l.mu.
+func (l *rateLimiter) prune(now time.Time) {
+	if len(l.buckets) < maxIdleBuckets {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Requests) && now.Sub(b.warned) >= b.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// throttled takes a token for command sent in msg and, if a limit refuses
+// it, logs that and tells the sender to slow down.
+func throttled(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, limiter *rateLimiter, command string, fields []any) bool {
+	refused := limiter.allow(msg.Message.Sender.Username, conversationKey(msg), command)
+	if refused == nil {
+		return false
+	}
+	commandsDropped.inc(refused.limit)
+	logger.Warn("rate limited", append(fields, "limit", refused.limit)...)
+	if refused.warn {
+		reply(kbc, msg, slowDownReply(refused.wait))
+	}
+	return true
+}
+
+// slowDownReply tells a sender who hit a limit when to try again.
+func slowDownReply(wait time.Duration) string {
+	seconds := math.Ceil(wait.Seconds())
+	return fmt.Sprintf("Slow down! Too many commands, try again in %s.", time.Duration(seconds)*time.Second)
+}
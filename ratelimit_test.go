@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("10/1m")
+	require.Nil(t, err)
+	require.Equal(t, rateLimit{Requests: 10, Per: time.Minute}, limit)
+
+	limit, err = parseRateLimit(" 3 / 10s ")
+	require.Nil(t, err)
+	require.Equal(t, rateLimit{Requests: 3, Per: 10 * time.Second}, limit)
+
+	for _, text := range []string{"", "10", "10/", "/1m", "0/1m", "ten/1m", "10/soon", "10/-1m"} {
+		_, err := parseRateLimit(text)
+		require.NotNil(t, err, text)
+		require.Contains(t, err.Error(), "expected e.g. 10/1m")
+	}
+
+	var limits rateLimits
+	require.Nil(t, yaml.UnmarshalStrict([]byte("user: 5/1m\ncommands:\n  home: 2/10s\n"), &limits))
+	require.Equal(t, &rateLimit{5, time.Minute}, limits.User)
+	require.Nil(t, limits.Conversation)
+	require.Equal(t, &rateLimit{2, 10 * time.Second}, limits.Commands["home"])
+
+	err = yaml.UnmarshalStrict([]byte("user: lots\n"), &limits)
+	require.Contains(t, err.Error(), `invalid rate limit "lots"`)
+}
+
+// newTestLimiter returns a limiter for limits on a fake clock.
+func newTestLimiter(limits rateLimits) (*rateLimiter, *fakeClock) {
+	clk := newFakeClock(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	l := newRateLimiter(limits)
+	l.now = clk.Now
+	return l, clk
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, clk := newTestLimiter(rateLimits{
+		User:     &rateLimit{3, time.Minute},
+		Commands: map[string]*rateLimit{"home": {2, time.Minute}},
+	})
+
+	require.Nil(t, l.allow("janik", "home#general", "home"))
+	require.Nil(t, l.allow("janik", "home#general", "home"))
+	refused := l.allow("alice", "home#general", "home")
+	require.Equal(t, &rateLimited{limit: limitCommand, wait: 30 * time.Second, warn: true}, refused)
+
+	// a refused command takes no tokens from the other buckets
+	require.Nil(t, l.allow("alice", "home#general", "ip"))
+	require.Nil(t, l.allow("janik", "home#general", "ip"))
+	refused = l.allow("janik", "home#general", "ip")
+	require.Equal(t, limitUser, refused.limit)
+	require.Equal(t, 20*time.Second, refused.wait)
+	require.True(t, refused.warn)
+
+	// the sender is only warned once per window
+	clk.Advance(10 * time.Second)
+	refused = l.allow("janik", "home#general", "")
+	require.Equal(t, 10*time.Second, refused.wait)
+	require.False(t, refused.warn)
+
+	clk.Advance(10 * time.Second)
+	require.Nil(t, l.allow("janik", "home#general", ""))
+	refused = l.allow("janik", "home#general", "")
+	require.False(t, refused.warn)
+
+	clk.Advance(time.Minute)
+	require.Nil(t, l.allow("janik", "home#general", "home"))
+	require.Nil(t, l.allow("janik", "home#general", "home"))
+	refused = l.allow("janik", "home#general", "home")
+	require.Equal(t, limitCommand, refused.limit)
+	require.True(t, refused.warn)
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l, clk := newTestLimiter(rateLimits{Conversation: &rateLimit{1, time.Minute}})
+	for i := 0; i < maxIdleBuckets; i++ {
+		require.Nil(t, l.allow("janik", fmt.Sprintf("conversation%d", i), ""))
+	}
+	require.Len(t, l.buckets, maxIdleBuckets)
+
+	clk.Advance(time.Minute)
+	require.Nil(t, l.allow("janik", "conversation0", ""))
+	require.Len(t, l.buckets, 1)
+}
+
+func TestSlowDownReply(t *testing.T) {
+	require.Equal(t, "Slow down! Too many commands, try again in 1s.", slowDownReply(200*time.Millisecond))
+	require.Equal(t, "Slow down! Too many commands, try again in 1m30s.", slowDownReply(89500*time.Millisecond))
+}
+
+func TestHandleMessageRateLimited(t *testing.T) {
+	useGlobals(t)
+	limiter, _ = newTestLimiter(rateLimits{User: &rateLimit{1, time.Minute}})
+	dropped := commandsDropped.get(limitUser)
+
+	msg := createTeamMessage("help", "janik", "home", "general")
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "Slow down! Too many commands, try again in 1m0s.").Return(kbchat.SendResponse{}, nil).Once()
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, unknownCommand(commands, "hello")).Return(kbchat.SendResponse{}, errors.New("keybase is down")).Once()
+	httpReq := mocks.NewRequests(t)
+
+	fakeStdout := captureOutput(t, func() {
+		handleMessage(kbc, createTeamMessage("hello", "janik", "home", "general"), httpReq)
+		handleMessage(kbc, msg, httpReq)
+		handleMessage(kbc, msg, httpReq)
+	})
+
+	require.Contains(t, fakeStdout, "rate limited")
+	require.Contains(t, fakeStdout, "limit=user")
+	require.Equal(t, dropped+2, commandsDropped.get(limitUser))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// maxReadErrors is how many consecutive failed reads mark a subscription
+// as dead.
+const maxReadErrors = 5
+
+// backoffPolicy controls how quickly the bot retries a lost subscription.
+type backoffPolicy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	MaxAttempts int // 0 retries forever
+}
+
+var reconnectPolicy = backoffPolicy{
+	Initial:    time.Second,
+	Max:        2 * time.Minute,
+	Multiplier: 2,
+}
+
+// listenFunc opens a new message subscription. It is a variable so tests
+// can hand out mock subscriptions.
+var listenFunc = func(kbc KeyBaseChat) (SubReader, error) {
+	sub, err := kbc.ListenForNewTextMessages()
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// delay returns the jittered wait before retry number attempt (from 0):
+// half the exponential delay is fixed and the other half random.
+func (b backoffPolicy) delay(attempt int) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if d > float64(b.Max) || math.IsInf(d, 0) {
+		d = float64(b.Max)
+	}
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+func (b backoffPolicy) exhausted(attempt int) bool {
+	return b.MaxAttempts > 0 && attempt >= b.MaxAttempts
+}
+
+// errSubscriptionDead is returned by readMessages when the subscription
+// keeps failing and needs to be replaced.
+var errSubscriptionDead = errors.New("subscription is not responding")
+
+// listen keeps a subscription open, forwarding its messages, until ctx is
+// cancelled or reconnectPolicy gives up.
+func listen(ctx context.Context, kbc KeyBaseChat, messages chan<- kbchat.SubscriptionMessage) error {
+	attempt := 0
+	for {
+		policy := snapshotConfig().reconnectPolicy
+		sub, err := listenFunc(kbc)
+		if err != nil {
+			if policy.exhausted(attempt + 1) {
+				return fmt.Errorf("could not start subscription: %s (after %d attempts)", err.Error(), attempt+1)
+			}
+			logger.Error("could not start subscription", "attempt", attempt+1, "error", err)
+		} else {
+			setSubscribed(true)
+			delivered, err := readSubscription(ctx, sub, messages)
+			setSubscribed(false)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if delivered > 0 {
+				attempt = 0
+			}
+			logger.Warn("subscription lost", "error", err)
+			if policy.exhausted(attempt + 1) {
+				return fmt.Errorf("subscription lost: %s (after %d attempts)", err.Error(), attempt+1)
+			}
+		}
+
+		wait := policy.delay(attempt)
+		attempt++
+		logger.Info("reconnecting", "delay", wait.Round(time.Millisecond), "attempt", attempt)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		reconnects.inc()
+	}
+}
+
+// readSubscription runs readMessages and shuts sub down once it returns
+// or, since Read blocks until a message arrives, as soon as ctx is
+// cancelled.
+func readSubscription(ctx context.Context, sub SubReader, messages chan<- kbchat.SubscriptionMessage) (int, error) {
+	var shutdown sync.Once
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdown.Do(sub.Shutdown)
+		case <-done:
+		}
+	}()
+
+	delivered, err := readMessages(ctx, sub, messages)
+	close(done)
+	shutdown.Do(sub.Shutdown)
+	return delivered, err
+}
+
+// readMessages forwards text messages from sub until ctx is cancelled or
+// the subscription fails maxReadErrors times in a row. It returns how many
+// messages were delivered.
+func readMessages(ctx context.Context, sub SubReader, messages chan<- kbchat.SubscriptionMessage) (int, error) {
+	delivered := 0
+	failures := 0
+	for ctx.Err() == nil {
+		msg, err := readSub(sub)
+		if errors.Is(err, errNotText) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Warn("subscription read failed", "error", err)
+			if failures++; failures >= maxReadErrors {
+				return delivered, errSubscriptionDead
+			}
+			continue
+		}
+		failures = 0
+		messagesRead.inc()
+
+		select {
+		case messages <- msg:
+			delivered++
+		case <-ctx.Done():
+		}
+	}
+	return delivered, nil
+}
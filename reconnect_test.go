@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+func useReconnectPolicy(t *testing.T, policy backoffPolicy) {
+	saved := reconnectPolicy
+	savedListen := listenFunc
+	t.Cleanup(func() {
+		reconnectPolicy = saved
+		listenFunc = savedListen
+	})
+	reconnectPolicy = policy
+}
+
+func TestBackoffDelay(t *testing.T) {
+	policy := backoffPolicy{Initial: time.Second, Max: time.Second * 10, Multiplier: 2, MaxAttempts: 3}
+
+	cases := []struct {
+		attempt int
+		full    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second * 2},
+		{3, time.Second * 8},
+		{4, time.Second * 10},
+		{5000, time.Second * 10},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			d := policy.delay(c.attempt)
+			require.True(t, d >= c.full/2 && d <= c.full, "attempt %d: %s", c.attempt, d)
+		}
+	}
+
+	require.False(t, policy.exhausted(2))
+	require.True(t, policy.exhausted(3))
+	require.False(t, backoffPolicy{}.exhausted(1000))
+}
+
+func TestReadMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := mocks.NewSubReader(t)
+	sub.On("Read").Return(createNonTextMessage("image"), nil).Once()
+	sub.On("Read").Return(createTextMessage("ip"), nil)
+
+	messages := make(chan kbchat.SubscriptionMessage)
+	done := make(chan error)
+	before := messagesRead.get()
+	go func() {
+		_, err := readMessages(ctx, sub, messages)
+		done <- err
+	}()
+
+	msg := <-messages
+	require.Equal(t, "ip", msg.Message.Content.Text.Body)
+	require.True(t, messagesRead.get() > before)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("readMessages did not stop after cancel")
+	}
+}
+
+func TestReadMessagesDead(t *testing.T) {
+	sub := mocks.NewSubReader(t)
+	sub.On("Read").Return(createTextMessage("ip"), nil).Once()
+	sub.On("Read").Return(kbchat.SubscriptionMessage{}, errors.New("keybase service restarted")).Times(maxReadErrors)
+
+	messages := make(chan kbchat.SubscriptionMessage, 1)
+
+	var delivered int
+	var err error
+	fakeStdout := captureOutput(t, func() {
+		delivered, err = readMessages(context.Background(), sub, messages)
+	})
+
+	require.Equal(t, 1, delivered)
+	require.Equal(t, errSubscriptionDead, err)
+	require.Contains(t, fakeStdout, `error="message read failed: keybase service restarted"`)
+}
+
+func TestListenReconnects(t *testing.T) {
+	useReconnectPolicy(t, backoffPolicy{Initial: time.Millisecond, Max: time.Millisecond * 5, Multiplier: 2})
+
+	dead := mocks.NewSubReader(t)
+	dead.On("Read").Return(kbchat.SubscriptionMessage{}, errors.New("broken pipe"))
+	dead.On("Shutdown").Return().Once()
+
+	healthy := mocks.NewSubReader(t)
+	healthy.On("Read").Return(createTextMessage("ip"), nil)
+	healthy.On("Shutdown").Return().Once()
+
+	subs := []SubReader{dead, nil, healthy}
+	listenFunc = func(kbc KeyBaseChat) (SubReader, error) {
+		sub := subs[0]
+		subs = subs[1:]
+		if sub == nil {
+			return nil, errors.New("keybase not running")
+		}
+		return sub, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages := make(chan kbchat.SubscriptionMessage)
+	done := make(chan error)
+	before := reconnects.get()
+
+	fakeStdout := captureOutput(t, func() {
+		go func() { done <- listen(ctx, mocks.NewKeyBaseChat(t), messages) }()
+
+		msg := <-messages
+		require.Equal(t, "ip", msg.Message.Content.Text.Body)
+		require.Equal(t, int32(1), atomic.LoadInt32(&subscribed))
+		cancel()
+		require.Nil(t, <-done)
+	})
+
+	require.Equal(t, before+2, reconnects.get())
+	require.Equal(t, int32(0), atomic.LoadInt32(&subscribed))
+	require.Contains(t, fakeStdout, `subscription lost error="subscription is not responding"`)
+	require.Contains(t, fakeStdout, `could not start subscription attempt=2 error="keybase not running"`)
+	require.Contains(t, fakeStdout, "reconnecting delay=1ms attempt=1")
+}
+
+func TestListenShutsDownOnCancel(t *testing.T) {
+	useReconnectPolicy(t, reconnectPolicy)
+	sub := kbchat.NewSubscription()
+	listenFunc = func(kbc KeyBaseChat) (SubReader, error) { return sub, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- listen(ctx, mocks.NewKeyBaseChat(t), make(chan kbchat.SubscriptionMessage)) }()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&subscribed) == 1 }, time.Second, time.Millisecond)
+
+	// Read blocks until the subscription is shut down
+	cancel()
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("listen did not return after ctx was cancelled")
+	}
+	_, err := sub.Read()
+	require.EqualError(t, err, "Subscription shutdown")
+}
+
+func TestListenGivesUp(t *testing.T) {
+	useReconnectPolicy(t, backoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 2, MaxAttempts: 3})
+
+	calls := 0
+	listenFunc = func(kbc KeyBaseChat) (SubReader, error) {
+		calls++
+		return nil, errors.New("keybase not running")
+	}
+
+	var err error
+	captureOutput(t, func() {
+		err = listen(context.Background(), mocks.NewKeyBaseChat(t), make(chan kbchat.SubscriptionMessage))
+	})
+
+	require.Equal(t, 3, calls)
+	require.EqualError(t, err, "could not start subscription: keybase not running (after 3 attempts)")
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// reminderRetryDelay is how long a reminder that could not be delivered
+// waits before the next attempt.
+const reminderRetryDelay = time.Minute
+
+// reminder is a message to post at Due. It is delivered as a reply to
+// ReplyTo when Channel is the conversation it was asked for in.
+type reminder struct {
+	Id      int               `json:"id"`
+	Owner   string            `json:"owner"`
+	Channel chat1.ChatChannel `json:"channel"`
+	Origin  chat1.ChatChannel `json:"origin"`
+	ReplyTo chat1.MessageID   `json:"reply_to"`
+	Due     time.Time         `json:"due"`
+	Text    string            `json:"text"`
+}
+
+const (
+	remindersNamespace = "reminders"
+	countersNamespace  = "counters"
+)
+
+// reminderStore keeps pending reminders in a Storage, keyed by ID, and
+// each user's timezone as the "timezone" preference.
+type reminderStore struct {
+	// mu makes ID allocation atomic.
+	mu      sync.Mutex
+	storage Storage
+
+	// wake tells the delivery loop that a reminder was added.
+	wake chan struct{}
+}
+
+var (
+	reminders        = newReminderStore(stateStorage)
+	reminderLocation = time.Local
+)
+
+func newReminderStore(storage Storage) *reminderStore {
+	return &reminderStore{storage: storage, wake: make(chan struct{}, 1)}
+}
+
+// add stores r under a new ID and wakes the delivery loop.
+func (s *reminderStore) add(r *reminder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := 1
+	if _, err := getJson(s.storage, countersNamespace, remindersNamespace, &next); err != nil {
+		return err
+	}
+	if err := putJson(s.storage, countersNamespace, remindersNamespace, next+1, 0); err != nil {
+		return err
+	}
+	r.Id = next
+	if err := putJson(s.storage, remindersNamespace, strconv.Itoa(r.Id), r, 0); err != nil {
+		return err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// remove deletes the reminder with id if owner, unless empty, owns it.
+func (s *reminderStore) remove(id int, owner string) (bool, error) {
+	var r reminder
+	found, err := getJson(s.storage, remindersNamespace, strconv.Itoa(id), &r)
+	if err != nil || !found || (owner != "" && r.Owner != owner) {
+		return false, err
+	}
+	return true, s.storage.Delete(remindersNamespace, strconv.Itoa(id))
+}
+
+// list returns the reminders of owner, or all of them when owner is
+// empty, soonest first.
+func (s *reminderStore) list(owner string) ([]reminder, error) {
+	keys, err := s.storage.List(remindersNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []reminder
+	for _, key := range keys {
+		var r reminder
+		ok, err := getJson(s.storage, remindersNamespace, key, &r)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (owner == "" || r.Owner == owner) {
+			found = append(found, r)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Due.Before(found[j].Due) })
+	return found, nil
+}
+
+// location returns the timezone user has chosen, or fallback.
+func (s *reminderStore) location(user string, fallback *time.Location) *time.Location {
+	name, err := userPref(s.storage, user, "timezone")
+	if err != nil {
+		logger.Warn("could not read timezone", "user", user, "error", err)
+	}
+	if loc, err := time.LoadLocation(name); name != "" && err == nil {
+		return loc
+	}
+	return fallback
+}
+
+func (s *reminderStore) setLocation(user string, loc *time.Location) error {
+	return setUserPref(s.storage, user, "timezone", loc.String())
+}
+
+// runReminders delivers reminders as they fall due until ctx is
+// cancelled.
+func runReminders(ctx context.Context, kbc KeyBaseChat, store *reminderStore, clk clock) {
+	for {
+		now := clk.Now()
+		var next time.Time
+		pending, err := store.list("")
+		failed := err != nil
+		if err != nil {
+			logger.Error("could not read reminders", "error", err)
+		}
+		for _, r := range pending {
+			if r.Due.After(now) {
+				if next.IsZero() || r.Due.Before(next) {
+					next = r.Due
+				}
+				continue
+			}
+			if err := deliverReminder(kbc, r); err != nil {
+				logger.Warn("could not deliver reminder", "id", r.Id, "owner", r.Owner, "error", err)
+				failed = true
+				continue
+			}
+			if _, err := store.remove(r.Id, ""); err != nil {
+				logger.Error("could not remove delivered reminder", "id", r.Id, "error", err)
+			}
+		}
+
+		// with nothing pending, sleep until a reminder is added
+		var timer <-chan time.Time
+		switch {
+		case failed && (next.IsZero() || next.Sub(now) > reminderRetryDelay):
+			timer = clk.After(reminderRetryDelay)
+		case !next.IsZero():
+			timer = clk.After(next.Sub(now))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-store.wake:
+		case <-timer:
+		}
+	}
+}
+
+func deliverReminder(kbc KeyBaseChat, r reminder) error {
+	if r.Channel == r.Origin {
+		_, err := kbc.SendReply(r.Channel, &r.ReplyTo, redactSecrets(fmt.Sprintf("@%s reminder: %s", r.Owner, r.Text)))
+		return err
+	}
+	_, err := kbc.SendMessage(r.Channel, redactSecrets(fmt.Sprintf("Reminder from @%s: %s", r.Owner, r.Text)))
+	return err
+}
+
+// reminderTarget resolves who a reminder is for: "me" is the conversation
+// it was asked in and "#channel" a channel of the same team. "team#channel"
+// is accepted when it names that team too, so a reminder never posts into
+// a team the sender asked from outside of.
+func reminderTarget(msg kbchat.SubscriptionMessage, target string) (chat1.ChatChannel, error) {
+	origin := msg.Message.Channel
+	if strings.EqualFold(target, "me") {
+		return origin, nil
+	}
+
+	team, topic, ok := strings.Cut(target, "#")
+	if !ok || topic == "" {
+		return chat1.ChatChannel{}, inputError("usage: remind me|#channel <when> <text>")
+	}
+	if origin.MembersType != "team" {
+		return chat1.ChatChannel{}, inputError("%s only works in a team conversation.", target)
+	}
+	if team != "" && !strings.EqualFold(team, origin.Name) {
+		return chat1.ChatChannel{}, inputError("Reminders can only go to channels of %s, use #%s.", origin.Name, topic)
+	}
+
+	channel := parseChannel(origin.Name + "#" + topic)
+	if strings.EqualFold(channel.TopicName, origin.TopicName) {
+		return origin, nil
+	}
+	return channel, nil
+}
+
+func remindCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	channel, err := reminderTarget(msg, args[0])
+	if err != nil {
+		return err
+	}
+
+	cfg := snapshotConfig()
+	owner := msg.Message.Sender.Username
+	loc := cfg.reminders.location(owner, cfg.reminderLocation)
+	now := schedulerClock.Now().In(loc)
+	due, used, err := parseWhen(args[1:], now)
+	if err != nil {
+		return inputError("%s", err.Error())
+	}
+
+	// keyword, target and the words of the time come before the text
+	skip := 2 + used
+	if len(args) > 1+used && strings.EqualFold(args[1+used], "to") {
+		skip++
+	}
+	text := rawArgs(msg, skip)
+	if text == "" {
+		return inputError("What should I remind you of? e.g. `remind me in 2h to close the garage`")
+	}
+
+	r := &reminder{
+		Owner:   owner,
+		Channel: channel,
+		Origin:  msg.Message.Channel,
+		ReplyTo: msg.Message.Id,
+		Due:     due,
+		Text:    text,
+	}
+	if err := cfg.reminders.add(r); err != nil {
+		return err
+	}
+	logger.Info("reminder set", "id", r.Id, "owner", owner, "due", due.Format(time.RFC3339))
+	return reply(kbc, msg, fmt.Sprintf("OK, I'll remind %s %s (#%d).", reminderWho(args[0]), formatDue(due, now), r.Id))
+}
+
+func reminderWho(target string) string {
+	if strings.EqualFold(target, "me") {
+		return "you"
+	}
+	return target
+}
+
+// formatDue renders due for a user whose clock shows now.
+func formatDue(due time.Time, now time.Time) string {
+	day := due.Format("Mon Jan 2")
+	switch {
+	case due.YearDay() == now.YearDay() && due.Year() == now.Year():
+		day = "today"
+	case due.Sub(now) < 48*time.Hour && due.AddDate(0, 0, -1).YearDay() == now.YearDay():
+		day = "tomorrow"
+	}
+	return fmt.Sprintf("%s at %s", day, due.Format("15:04 MST"))
+}
+
+func remindersCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	cfg := snapshotConfig()
+	owner := msg.Message.Sender.Username
+	loc := cfg.reminders.location(owner, cfg.reminderLocation)
+	now := schedulerClock.Now().In(loc)
+
+	action := "list"
+	if len(args) > 0 {
+		action = strings.ToLower(args[0])
+	}
+	switch {
+	case action == "list" && len(args) <= 1:
+		pending, err := cfg.reminders.list(owner)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return reply(kbc, msg, "You have no reminders.")
+		}
+		lines := []string{"Your reminders:"}
+		for _, r := range pending {
+			lines = append(lines, fmt.Sprintf("- #%d %s: %s", r.Id, formatDue(r.Due.In(loc), now), r.Text))
+		}
+		return reply(kbc, msg, strings.Join(lines, "\n"))
+
+	case action == "cancel" && len(args) == 2:
+		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			return inputError("usage: reminders cancel <id>")
+		}
+		removed, err := cfg.reminders.remove(id, owner)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return inputError("You have no reminder #%d.", id)
+		}
+		return reply(kbc, msg, fmt.Sprintf("Cancelled reminder #%d.", id))
+
+	case action == "timezone" && len(args) <= 2:
+		if len(args) == 1 {
+			return reply(kbc, msg, fmt.Sprintf("Your timezone is %s, it is %s.", loc, now.Format("15:04 MST")))
+		}
+		newLoc, err := time.LoadLocation(args[1])
+		if err != nil || strings.EqualFold(args[1], "local") {
+			return inputError("Unknown timezone %q, use a name such as Europe/Berlin or America/New_York.", args[1])
+		}
+		if err := cfg.reminders.setLocation(owner, newLoc); err != nil {
+			return err
+		}
+		return reply(kbc, msg, fmt.Sprintf("Your timezone is now %s, it is %s.", newLoc, schedulerClock.Now().In(newLoc).Format("15:04 MST")))
+	}
+	return inputError("usage: reminders [list] | reminders cancel <id> | reminders timezone [zone]")
+}
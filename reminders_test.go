@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// useReminders gives the test an empty reminder store and a fake clock on
+// Sunday morning in UTC.
+func useReminders(t *testing.T) *fakeClock {
+	useGlobals(t)
+	reminders = newReminderStore(newMemoryStorage())
+	reminderLocation = time.UTC
+	clk := newFakeClock(time.Date(2026, 10, 18, 8, 59, 30, 0, time.UTC))
+	useSchedulerClock(t, clk)
+	return clk
+}
+
+func createReminderMessage(body string) kbchat.SubscriptionMessage {
+	return createTeamMessage(body, "janik", "home", "general")
+}
+
+// listReminders returns the reminders of owner, failing the test on
+// errors.
+func listReminders(t *testing.T, owner string) []reminder {
+	pending, err := reminders.list(owner)
+	require.Nil(t, err)
+	return pending
+}
+
+func TestReminderStore(t *testing.T) {
+	useGlobals(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+	storage, err := openFileStorage(path)
+	require.Nil(t, err)
+	reminders = newReminderStore(storage)
+
+	due := time.Date(2026, 10, 18, 17, 0, 0, 0, time.UTC)
+	require.Nil(t, reminders.add(&reminder{Owner: "janik", Due: due.Add(time.Hour), Text: "later"}))
+	require.Nil(t, reminders.add(&reminder{Owner: "janik", Due: due, Text: "sooner"}))
+	require.Nil(t, reminders.add(&reminder{Owner: "alice", Due: due, Text: "hers"}))
+	require.Nil(t, reminders.setLocation("janik", time.FixedZone("CEST", 2*60*60)))
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+	require.Nil(t, reminders.setLocation("alice", berlin))
+
+	storage, err = openFileStorage(path)
+	require.Nil(t, err)
+	reminders = newReminderStore(storage)
+	pending := listReminders(t, "janik")
+	require.Len(t, pending, 2)
+	require.Equal(t, "sooner", pending[0].Text)
+	require.Equal(t, 2, pending[0].Id)
+	require.True(t, due.Equal(pending[0].Due))
+	require.Len(t, listReminders(t, ""), 3)
+
+	// a zone that does not load falls back
+	require.Equal(t, time.UTC, reminders.location("janik", time.UTC))
+	require.Equal(t, berlin.String(), reminders.location("alice", time.UTC).String())
+
+	removed, err := reminders.remove(3, "janik")
+	require.Nil(t, err)
+	require.False(t, removed)
+	removed, err = reminders.remove(3, "alice")
+	require.Nil(t, err)
+	require.True(t, removed)
+
+	require.Nil(t, reminders.add(&reminder{Owner: "janik", Due: due, Text: "fourth"}))
+	require.Equal(t, 4, listReminders(t, "janik")[1].Id)
+}
+
+func TestRunReminders(t *testing.T) {
+	clk := useReminders(t)
+	origin := parseChannel("home#general")
+
+	kbc := mocks.NewKeyBaseChat(t)
+	replyTo := chat1.MessageID(1)
+	kbc.On("SendReply", origin, &replyTo, "@janik reminder: stand up").Return(kbchat.SendResponse{}, nil).Once()
+	kbc.On("SendMessage", parseChannel("home#garage"), "Reminder from @janik: close the garage").
+		Return(kbchat.SendResponse{}, errors.New("keybase is down")).Once()
+	kbc.On("SendMessage", parseChannel("home#garage"), "Reminder from @janik: close the garage").Return(kbchat.SendResponse{}, nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runReminders(ctx, kbc, reminders, clk)
+		close(done)
+	}()
+
+	require.Nil(t, reminders.add(&reminder{Owner: "janik", Channel: origin, Origin: origin, ReplyTo: 1, Due: clk.Now().Add(time.Minute), Text: "stand up"}))
+	require.Nil(t, reminders.add(&reminder{Owner: "janik", Channel: parseChannel("home#garage"), Origin: origin, Due: clk.Now().Add(time.Hour), Text: "close the garage"}))
+	require.Eventually(t, func() bool { return clk.waiting() > 0 }, time.Second, time.Millisecond)
+
+	clk.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(listReminders(t, "")) == 1 }, time.Second, time.Millisecond)
+
+	// the failed delivery is retried a minute later
+	fakeStdout := captureOutput(t, func() {
+		clk.Advance(time.Hour)
+		require.Eventually(t, func() bool { return clk.waiting() > 0 }, time.Second, time.Millisecond)
+	})
+	require.Contains(t, fakeStdout, "could not deliver reminder")
+	require.Len(t, listReminders(t, ""), 1)
+
+	clk.Advance(reminderRetryDelay)
+	require.Eventually(t, func() bool { return len(listReminders(t, "")) == 0 }, time.Second, time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestRemindCommand(t *testing.T) {
+	useReminders(t)
+	kbc := mocks.NewKeyBaseChat(t)
+	httpReq := mocks.NewRequests(t)
+
+	remind := func(body string) error {
+		msg := createReminderMessage(body)
+		return remindCommand(kbc, msg, httpReq, strings.Fields(body)[1:])
+	}
+	expectReply := func(text string) {
+		msg := createReminderMessage("")
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, text).Return(kbchat.SendResponse{}, nil).Once()
+	}
+
+	expectReply("OK, I'll remind you today at 10:59 UTC (#1).")
+	require.Nil(t, remind("remind me in 2h to  close the garage"))
+	expectReply("OK, I'll remind #garage tomorrow at 09:00 UTC (#2).")
+	require.Nil(t, remind("remind #garage tomorrow check the door"))
+	expectReply("OK, I'll remind home#chat Fri Oct 23 at 17:00 UTC (#3).")
+	require.Nil(t, remind("remind home#chat friday at 5pm drinks?"))
+
+	pending := listReminders(t, "janik")
+	require.Len(t, pending, 3)
+	require.Equal(t, "close the garage", pending[0].Text)
+	require.Equal(t, parseChannel("home#general"), pending[0].Channel)
+	require.Equal(t, chat1.MessageID(1), pending[0].ReplyTo)
+	require.Equal(t, "check the door", pending[1].Text)
+	require.Equal(t, parseChannel("home#garage"), pending[1].Channel)
+	require.Equal(t, parseChannel("home#chat"), pending[2].Channel)
+
+	cases := []struct {
+		body          string
+		expectedError string
+	}{
+		{"remind you in 2h stretch", "usage: remind me|#channel <when> <text>"},
+		{"remind # in 2h stretch", "usage: remind me|#channel <when> <text>"},
+		{"remind family#chat in 2h drinks?", "Reminders can only go to channels of home, use #chat."},
+		{"remind me later stretch", "I did not understand when"},
+		{"remind me in 2h", "What should I remind you of?"},
+		{"remind me today 8am breakfast", "that time has already passed"},
+	}
+	for _, c := range cases {
+		var botErr *BotError
+		err := remind(c.body)
+		require.True(t, errors.As(err, &botErr), c.body)
+		require.Equal(t, KindInput, botErr.Kind)
+		require.Contains(t, botErr.Message, c.expectedError)
+	}
+
+	msg := createTextMessage("remind #garage in 2h check")
+	err := remindCommand(kbc, msg, httpReq, []string{"#garage", "in", "2h", "check"})
+	require.Contains(t, err.Error(), "#garage only works in a team conversation")
+
+	// a direct conversation has no team to post into
+	msg = createTextMessage("remind home#garage in 2h check")
+	err = remindCommand(kbc, msg, httpReq, []string{"home#garage", "in", "2h", "check"})
+	require.Contains(t, err.Error(), "home#garage only works in a team conversation")
+}
+
+func TestRemindersCommand(t *testing.T) {
+	useReminders(t)
+	kbc := mocks.NewKeyBaseChat(t)
+	httpReq := mocks.NewRequests(t)
+	msg := createReminderMessage("reminders")
+	expectReply := func(text string) {
+		kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, text).Return(kbchat.SendResponse{}, nil).Once()
+	}
+
+	expectReply("You have no reminders.")
+	require.Nil(t, remindersCommand(kbc, msg, httpReq, nil))
+
+	due := time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC)
+	require.Nil(t, reminders.add(&reminder{Owner: "janik", Due: due, Text: "call Bob"}))
+	require.Nil(t, reminders.add(&reminder{Owner: "alice", Due: due, Text: "not yours"}))
+
+	expectReply("Your timezone is now America/New_York, it is 04:59 EDT.")
+	require.Nil(t, remindersCommand(kbc, msg, httpReq, []string{"timezone", "America/New_York"}))
+	expectReply("Your timezone is America/New_York, it is 04:59 EDT.")
+	require.Nil(t, remindersCommand(kbc, msg, httpReq, []string{"timezone"}))
+
+	expectReply("Your reminders:\n- #1 tomorrow at 03:00 EDT: call Bob")
+	require.Nil(t, remindersCommand(kbc, msg, httpReq, []string{"list"}))
+
+	var botErr *BotError
+	err := remindersCommand(kbc, msg, httpReq, []string{"cancel", "2"})
+	require.True(t, errors.As(err, &botErr))
+	require.Equal(t, "You have no reminder #2.", botErr.Message)
+
+	expectReply("Cancelled reminder #1.")
+	require.Nil(t, remindersCommand(kbc, msg, httpReq, []string{"cancel", "#1"}))
+	require.Empty(t, listReminders(t, "janik"))
+
+	err = remindersCommand(kbc, msg, httpReq, []string{"timezone", "Mars/Olympus"})
+	require.True(t, errors.As(err, &botErr))
+	require.Contains(t, botErr.Message, `Unknown timezone "Mars/Olympus"`)
+
+	err = remindersCommand(kbc, msg, httpReq, []string{"snooze"})
+	require.True(t, errors.As(err, &botErr))
+	require.Equal(t, KindInput, botErr.Kind)
+}
+
+func TestFormatDue(t *testing.T) {
+	now := time.Date(2026, 12, 31, 22, 0, 0, 0, time.UTC)
+	require.Equal(t, "today at 23:00 UTC", formatDue(now.Add(time.Hour), now))
+	require.Equal(t, "tomorrow at 09:00 UTC", formatDue(time.Date(2027, 1, 1, 9, 0, 0, 0, time.UTC), now))
+	require.Equal(t, "Sat Jan 2 at 09:00 UTC", formatDue(time.Date(2027, 1, 2, 9, 0, 0, 0, time.UTC), now))
+}
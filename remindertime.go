@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReminderHour is used when a day is given without a time, as in
+// "remind me tomorrow to call Bob".
+const defaultReminderHour = 9
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+var durationUnits = map[string]time.Duration{
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+var errWhenUsage = errors.New("I did not understand when, try `in 2h`, `at 5pm`, `tomorrow 9am`, `friday at 17:30` or `on 2026-12-24 18:00`")
+
+// parseWhen reads a point in time from the start of words, such as
+// "in 2h", "in 10 minutes", "at 5pm", "tomorrow 9am", "friday at 17:30" or
+// "on 2026-12-24 18:00", relative to now and in now's location. It returns
+// the time and how many words it used.
+func parseWhen(words []string, now time.Time) (time.Time, int, error) {
+	if len(words) == 0 {
+		return time.Time{}, 0, errWhenUsage
+	}
+
+	first := strings.ToLower(words[0])
+	if first == "in" {
+		return parseIn(words[1:], now)
+	}
+
+	var day time.Time
+	used := 1
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	weekday, isWeekday := weekdays[first]
+	switch {
+	case first == "at":
+		return parseAt(words[1:], now, 1)
+	case first == "today":
+		day = today
+	case first == "tomorrow":
+		day = today.AddDate(0, 0, 1)
+	case isWeekday:
+		day = today.AddDate(0, 0, (int(weekday)-int(today.Weekday())+7)%7)
+	case first == "on" && len(words) > 1:
+		parsed, err := time.ParseInLocation("2006-01-02", words[1], now.Location())
+		if err != nil {
+			return time.Time{}, 0, errWhenUsage
+		}
+		day, used = parsed, 2
+	default:
+		if parsed, err := time.ParseInLocation("2006-01-02", words[0], now.Location()); err == nil {
+			day = parsed
+			break
+		}
+		return parseAt(words, now, 0)
+	}
+
+	hour, minute := defaultReminderHour, 0
+	rest := words[used:]
+	sawAt := len(rest) > 0 && strings.EqualFold(rest[0], "at")
+	if sawAt {
+		rest, used = rest[1:], used+1
+	}
+	h, m, ok := 0, 0, false
+	if len(rest) > 0 {
+		h, m, ok = parseClock(rest[0])
+	}
+	switch {
+	case ok:
+		hour, minute, used = h, m, used+1
+	case sawAt && len(rest) > 0:
+		return time.Time{}, 0, fmt.Errorf("%q is not a time of day, try 5pm or 17:30", rest[0])
+	case sawAt || first == "today":
+		return time.Time{}, 0, errors.New("a time of day is missing, e.g. `today 5pm`")
+	}
+
+	due := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+	if isWeekday && !due.After(now) {
+		due = due.AddDate(0, 0, 7)
+	}
+	if !due.After(now) {
+		return time.Time{}, 0, errors.New("that time has already passed")
+	}
+	return due, used, nil
+}
+
+// parseIn reads a duration such as "2h", "1h30m", "3d" or "10 minutes".
+func parseIn(words []string, now time.Time) (time.Time, int, error) {
+	if len(words) == 0 {
+		return time.Time{}, 0, errWhenUsage
+	}
+
+	if d, err := time.ParseDuration(words[0]); err == nil && d > 0 {
+		return now.Add(d), 2, nil
+	}
+	word := strings.ToLower(words[0])
+	for _, suffix := range []string{"d", "w"} {
+		if count, err := strconv.Atoi(strings.TrimSuffix(word, suffix)); err == nil && strings.HasSuffix(word, suffix) && count > 0 {
+			return now.Add(time.Duration(count) * durationUnits[suffix]), 2, nil
+		}
+	}
+
+	if len(words) > 1 {
+		count, err := strconv.Atoi(word)
+		if word == "a" || word == "an" {
+			count, err = 1, nil
+		}
+		unit, ok := durationUnits[strings.ToLower(words[1])]
+		if err == nil && ok && count > 0 {
+			return now.Add(time.Duration(count) * unit), 3, nil
+		}
+	}
+	return time.Time{}, 0, errWhenUsage
+}
+
+// parseAt reads a time of day, taking the next time it comes round.
+// skipped is the number of words already used, such as "at".
+func parseAt(words []string, now time.Time, skipped int) (time.Time, int, error) {
+	if len(words) == 0 {
+		return time.Time{}, 0, errWhenUsage
+	}
+	hour, minute, ok := parseClock(words[0])
+	if !ok {
+		return time.Time{}, 0, errWhenUsage
+	}
+
+	due := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !due.After(now) {
+		due = due.AddDate(0, 0, 1)
+	}
+	return due, skipped + 1, nil
+}
+
+// parseClock reads a time of day such as "5pm", "5:30pm", "17:30",
+// "noon" or "midnight".
+func parseClock(word string) (int, int, bool) {
+	word = strings.ToLower(word)
+	switch word {
+	case "noon":
+		return 12, 0, true
+	case "midnight":
+		return 0, 0, true
+	}
+
+	suffix := ""
+	for _, s := range []string{"am", "pm"} {
+		if strings.HasSuffix(word, s) {
+			suffix, word = s, strings.TrimSuffix(word, s)
+		}
+	}
+
+	hourPart, minutePart, hasMinutes := strings.Cut(word, ":")
+	hour, err := strconv.Atoi(hourPart)
+	if err != nil {
+		return 0, 0, false
+	}
+	minute := 0
+	if hasMinutes {
+		if len(minutePart) != 2 {
+			return 0, 0, false
+		}
+		if minute, err = strconv.Atoi(minutePart); err != nil || minute < 0 || minute > 59 {
+			return 0, 0, false
+		}
+	} else if suffix == "" {
+		// a bare number is more likely a count than a time
+		return 0, 0, false
+	}
+
+	switch suffix {
+	case "":
+		if hour < 0 || hour > 23 {
+			return 0, 0, false
+		}
+	default:
+		if hour < 1 || hour > 12 {
+			return 0, 0, false
+		}
+		hour %= 12
+		if suffix == "pm" {
+			hour += 12
+		}
+	}
+	return hour, minute, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWhen(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+	// a Sunday afternoon
+	now := time.Date(2026, 10, 18, 14, 20, 0, 0, berlin)
+	at := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, berlin)
+	}
+
+	cases := []struct {
+		input    string
+		expected time.Time
+		used     int
+	}{
+		{"in 2h close the garage", now.Add(2 * time.Hour), 2},
+		{"in 1h30m tea", now.Add(90 * time.Minute), 2},
+		{"in 10 minutes tea", now.Add(10 * time.Minute), 3},
+		{"in an hour tea", now.Add(time.Hour), 3},
+		{"in 3d renew", now.Add(3 * 24 * time.Hour), 2},
+		{"in 2 weeks renew", now.Add(14 * 24 * time.Hour), 3},
+		{"at 5pm to close the garage", at(10, 18, 17, 0), 2},
+		{"at 9:15am standup", at(10, 19, 9, 15), 2},
+		{"17:30 leave", at(10, 18, 17, 30), 1},
+		{"at noon lunch", at(10, 19, 12, 0), 2},
+		{"today 11pm sleep", at(10, 18, 23, 0), 2},
+		{"tomorrow to call Bob", at(10, 19, 9, 0), 1},
+		{"tomorrow 9am standup", at(10, 19, 9, 0), 2},
+		{"tomorrow at 18:00 dinner", at(10, 19, 18, 0), 3},
+		{"friday at 5pm drinks", at(10, 23, 17, 0), 3},
+		{"sunday 11am brunch", at(10, 25, 11, 0), 2},
+		{"sun 3pm walk", at(10, 18, 15, 0), 2},
+		{"on 2026-12-24 18:00 presents", at(12, 24, 18, 0), 3},
+		{"2026-12-31 party", at(12, 31, 9, 0), 1},
+	}
+
+	for _, c := range cases {
+		due, used, err := parseWhen(strings.Fields(c.input), now)
+		require.Nil(t, err, c.input)
+		require.Equal(t, c.expected, due, c.input)
+		require.Equal(t, c.used, used, c.input)
+	}
+}
+
+func TestParseWhenErrors(t *testing.T) {
+	now := time.Date(2026, 10, 18, 14, 20, 0, 0, time.UTC)
+
+	cases := []struct {
+		input         string
+		expectedError string
+	}{
+		{"", "I did not understand when"},
+		{"later", "I did not understand when"},
+		{"in a while", "I did not understand when"},
+		{"in -2h", "I did not understand when"},
+		{"at 25:00", "I did not understand when"},
+		{"at 13pm", "I did not understand when"},
+		{"5 things", "I did not understand when"},
+		{"today 9am", "that time has already passed"},
+		{"today", "a time of day is missing"},
+		{"tomorrow at dawn", `"dawn" is not a time of day`},
+		{"on 2026-02-30", "I did not understand when"},
+		{"on 2025-01-01 9am", "that time has already passed"},
+	}
+
+	for _, c := range cases {
+		_, _, err := parseWhen(strings.Fields(c.input), now)
+		require.NotNil(t, err, c.input)
+		require.Contains(t, err.Error(), c.expectedError, c.input)
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	cases := []struct {
+		input  string
+		hour   int
+		minute int
+		ok     bool
+	}{
+		{"5pm", 17, 0, true},
+		{"12am", 0, 0, true},
+		{"12pm", 12, 0, true},
+		{"5:30PM", 17, 30, true},
+		{"07:05", 7, 5, true},
+		{"midnight", 0, 0, true},
+		{"17", 0, 0, false},
+		{"5:3", 0, 0, false},
+		{"-1:00", 0, 0, false},
+		{"0pm", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		hour, minute, ok := parseClock(c.input)
+		require.Equal(t, c.ok, ok, c.input)
+		require.Equal(t, c.hour, hour, c.input)
+		require.Equal(t, c.minute, minute, c.input)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -19,24 +21,10 @@ type Requests interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-type httpRequests struct{}
-
-func (h *httpRequests) Get(url string) (resp *http.Response, err error) {
-	return http.Get(url)
-}
-
-func (h *httpRequests) NewRequest(method string, url string, body io.Reader) (*http.Request, error) {
-	return http.NewRequest(method, url, body)
-}
-
-func (h *httpRequests) Do(req *http.Request) (*http.Response, error) {
-	return http.DefaultClient.Do(req)
-}
-
 func getUrl(httpReq Requests, url string) (string, error) {
 	resp, err := httpReq.Get(url)
 	if err != nil {
-		return "", fmt.Errorf("error getting document: %s", err.Error())
+		return "", fmt.Errorf("error getting document: %w", err)
 	}
 	if (200 <= resp.StatusCode) && (resp.StatusCode <= 299) {
 		defer resp.Body.Close()
@@ -50,9 +38,9 @@ func getUrl(httpReq Requests, url string) (string, error) {
 	return "", fmt.Errorf("error: received status code %d", resp.StatusCode)
 }
 
-func getFromHass(httpReq Requests, hassUrl string) (string, error) {
+func getFromHass(httpReq Requests, hassUrl string, token string) (string, error) {
 	header := make(map[string][]string)
-	header["Authorization"] = []string{fmt.Sprintf("Bearer %s", hassApiKey)}
+	header["Authorization"] = []string{fmt.Sprintf("Bearer %s", token)}
 
 	req, err := httpReq.NewRequest("GET", hassUrl, http.NoBody)
 	if err != nil {
@@ -61,9 +49,9 @@ func getFromHass(httpReq Requests, hassUrl string) (string, error) {
 
 	req.Header = header
 
-	res, err := httpReq.Do(req)
+	res, err := doHass(httpReq, req)
 	if err != nil {
-		return "", fmt.Errorf("error with Home Assistant response: %s", err.Error())
+		return "", fmt.Errorf("error with Home Assistant response: %w", err)
 	}
 
 	if res.StatusCode >= 200 && res.StatusCode <= 299 {
@@ -77,14 +65,114 @@ func getFromHass(httpReq Requests, hassUrl string) (string, error) {
 		yamlOutput, _ := yaml.Marshal(jsonResponse)
 		return fmt.Sprintf("HASS says: \n```\n%s\n```", string(yamlOutput)), nil
 	}
-	return res.Status, nil
+	return "", newHassStatusError(res)
 }
 
-func getIp(httpReq Requests) (string, error) {
-	log.Println("looking up...")
-	ipResult, err := getUrl(httpReq, "https://api.ipify.org")
+// fetchFromHass GETs hassUrl and decodes the JSON response into v.
+func fetchFromHass(httpReq Requests, hassUrl string, token string, v any) error {
+	req, err := httpReq.NewRequest("GET", hassUrl, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("error with Home Assistant request: %s", err.Error())
+	}
+
+	req.Header = map[string][]string{
+		"Authorization": {fmt.Sprintf("Bearer %s", token)},
+	}
+
+	res, err := doHass(httpReq, req)
+	if err != nil {
+		return fmt.Errorf("error with Home Assistant response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newHassStatusError(res)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding response: %s", err.Error())
+	}
+	return nil
+}
+
+// doHass sends req to Home Assistant, recording how long it took.
+func doHass(httpReq Requests, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := httpReq.Do(req)
+	hassLatency.observe(req.Method, time.Since(start).Seconds())
+	return res, err
+}
+
+func postToHass(httpReq Requests, hassUrl string, token string, payload any) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding Home Assistant request: %s", err.Error())
+	}
+
+	header := make(map[string][]string)
+	header["Authorization"] = []string{fmt.Sprintf("Bearer %s", token)}
+	header["Content-Type"] = []string{"application/json"}
+
+	req, err := httpReq.NewRequest("POST", hassUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error with Home Assistant request: %s", err.Error())
+	}
+
+	req.Header = header
+
+	res, err := doHass(httpReq, req)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("error with Home Assistant response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, newHassStatusError(res)
+	}
+
+	responseBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error opening content: %s", err.Error())
+	}
+	return responseBody, nil
+}
+
+// maxErrorBody bounds how much of an error response is read for its
+// message.
+const maxErrorBody = 4096
+
+// hassStatusError is a non-2xx Home Assistant response, with the message
+// Home Assistant sent along, e.g. the syntax error for a bad template.
+type hassStatusError struct {
+	Status     string
+	StatusCode int
+	Message    string
+}
+
+func (e *hassStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("error: received status %s", e.Status)
+	}
+	return fmt.Sprintf("error: received status %s: %s", e.Status, e.Message)
+}
+
+func newHassStatusError(res *http.Response) error {
+	statusErr := &hassStatusError{Status: res.Status, StatusCode: res.StatusCode}
+	if res.Body == nil {
+		return statusErr
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	if !json.Valid(body) {
+		statusErr.Message = strings.TrimSpace(string(body))
+		return statusErr
+	}
+
+	var decoded struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &decoded) == nil {
+		statusErr.Message = decoded.Message
 	}
-	return ipResult, nil
+	return statusErr
 }
@@ -7,9 +7,11 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -68,7 +70,8 @@ func TestGetUrl(t *testing.T) {
 	}
 }
 
-func TestGetIp(t *testing.T) {
+func TestLookupPublicIpv4(t *testing.T) {
+	useIpProviders(t, builtinIpProviders["ipify"])
 	httpReq := mocks.NewRequests(t)
 
 	body, w := io.Pipe()
@@ -91,11 +94,11 @@ func TestGetIp(t *testing.T) {
 		}, c.httpError)
 
 		ipPattern := regexp.MustCompile(`\d+\.\d+\.\d+\.\d+`)
-		ipAddr, err := getIp(httpReq)
+		ip, err := lookupPublicIp(httpReq)
 		if c.httpError != nil {
 			require.NotNil(t, err)
 		} else {
-			require.True(t, ipPattern.Match([]byte(ipAddr)))
+			require.True(t, ipPattern.Match([]byte(ip.V4)))
 		}
 
 	}
@@ -158,12 +161,12 @@ func TestGetFromHass(t *testing.T) {
 			errors.New(""),
 		},
 		{
-			"404 error",
+			"",
 			nil,
 			nil,
 			false,
 			404,
-			nil,
+			errors.New("error: received status 404 error"),
 		},
 	}
 
@@ -192,7 +195,7 @@ func TestGetFromHass(t *testing.T) {
 			c.expectedResponseError,
 		).Maybe()
 
-		output, err := getFromHass(httpReq, hassUrl)
+		output, err := getFromHass(httpReq, hassUrl, hassInstances[""].Token)
 		require.Equal(t, c.expectedOutput, output)
 		if c.expectedFinalError != nil {
 			require.Contains(t, err.Error(), c.expectedFinalError.Error())
@@ -201,3 +204,72 @@ func TestGetFromHass(t *testing.T) {
 		}
 	}
 }
+
+func TestPostToHass(t *testing.T) {
+	hassUrl := "http://home-assistant.home.lan:8123/api/services/light/turn_on"
+	hassUrlAsUrl, _ := url.Parse(hassUrl)
+
+	cases := []struct {
+		statusCode           int
+		expectedRequestError error
+		expectedFinalError   error
+	}{
+		{200, nil, nil},
+		{200, errors.New("requestError"), errors.New("error with Home Assistant request: requestError")},
+		{400, nil, errors.New("error: received status 400 Bad Request")},
+	}
+
+	for _, c := range cases {
+		hassReq := &http.Request{
+			Method: "POST",
+			URL:    hassUrlAsUrl,
+		}
+
+		var sentBody []byte
+		httpReq := mocks.NewRequests(t)
+		httpReq.On("NewRequest", "POST", hassUrl, mock.Anything).Run(func(args mock.Arguments) {
+			sentBody, _ = io.ReadAll(args.Get(2).(io.Reader))
+		}).Return(hassReq, c.expectedRequestError)
+
+		httpReq.On("Do", hassReq).Return(&http.Response{
+			Status:     fmt.Sprintf("%d %s", c.statusCode, http.StatusText(c.statusCode)),
+			StatusCode: c.statusCode,
+			Body:       io.NopCloser(strings.NewReader(`[]`)),
+		}, nil).Maybe()
+
+		output, err := postToHass(httpReq, hassUrl, hassInstances[""].Token, map[string]interface{}{"entity_id": "light.kitchen"})
+		require.Equal(t, `{"entity_id":"light.kitchen"}`, string(sentBody))
+		if c.expectedFinalError != nil {
+			require.Nil(t, output)
+			require.EqualError(t, err, c.expectedFinalError.Error())
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, "[]", string(output))
+			require.Equal(t, []string{"application/json"}, hassReq.Header["Content-Type"])
+			require.Equal(t, []string{fmt.Sprintf("Bearer %s", hassInstances[""].Token)}, hassReq.Header["Authorization"])
+		}
+	}
+}
+
+func TestHassStatusError(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{`{"message":"Entity not found."}`, "error: received status 404 Not Found: Entity not found."},
+		{`[]`, "error: received status 404 Not Found"},
+		{"404: Not Found\n", "error: received status 404 Not Found: 404: Not Found"},
+		{"", "error: received status 404 Not Found"},
+	}
+
+	for _, c := range cases {
+		err := newHassStatusError(&http.Response{
+			Status:     "404 Not Found",
+			StatusCode: 404,
+			Body:       io.NopCloser(strings.NewReader(c.body)),
+		})
+		require.EqualError(t, err, c.expected)
+	}
+
+	require.EqualError(t, newHassStatusError(&http.Response{Status: "502 Bad Gateway", StatusCode: 502}), "error: received status 502 Bad Gateway")
+}
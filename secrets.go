@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minRedactLength is the shortest secret that is redacted; shorter values
+// would match ordinary words.
+const minRedactLength = 8
+
+const redacted = "[REDACTED]"
+
+// secretProvider looks up a secret by name.
+type secretProvider interface {
+	Lookup(name string) (string, error)
+}
+
+// envSecrets reads secrets from environment variables.
+type envSecrets struct {
+	getenv func(string) string
+}
+
+func (e envSecrets) Lookup(name string) (string, error) {
+	value := e.getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// fileSecrets reads a secret from the file at its name, as mounted by
+// Docker or Kubernetes secrets.
+type fileSecrets struct{}
+
+func (fileSecrets) Lookup(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %s", err.Error())
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// secretStore is a local file of named secrets encrypted with AES-GCM. The
+// key file holds a base64-encoded 32-byte key.
+type secretStore struct {
+	path string
+	aead cipher.AEAD
+}
+
+func openSecretStore(path string, keyFile string) (*secretStore, error) {
+	if keyFile == "" {
+		return nil, errors.New("secret store needs a key file")
+	}
+	encoded, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret store key: %s", err.Error())
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("secret store key must be 32 bytes, base64-encoded")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretStore{path: path, aead: aead}, nil
+}
+
+// newSecretKey returns a random key for a secret store, base64-encoded.
+func newSecretKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (s *secretStore) read() (map[string]string, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret store: %s", err.Error())
+	}
+
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("secret store is corrupt")
+	}
+	plain, err := s.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt secret store: wrong key or corrupt file")
+	}
+
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("secret store is corrupt: %s", err.Error())
+	}
+	return secrets, nil
+}
+
+func (s *secretStore) Lookup(name string) (string, error) {
+	secrets, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	value, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q not found in store", name)
+	}
+	return value, nil
+}
+
+// Set stores value under name, replacing the store file.
+func (s *secretStore) Set(name string, value string) error {
+	secrets, err := s.read()
+	if err != nil {
+		return err
+	}
+	secrets[name] = value
+
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, s.aead.Seal(nonce, nonce, plain, nil), 0o600); err != nil {
+		return fmt.Errorf("could not write secret store: %s", err.Error())
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// secretResolver turns secret references in the configuration into their
+// values. A reference is "env:NAME", "file:/path" or "store:name"; any
+// other value is taken literally.
+type secretResolver struct {
+	providers map[string]secretProvider
+}
+
+func newSecretResolver(getenv func(string) string, store *secretStore) *secretResolver {
+	providers := map[string]secretProvider{
+		"env":  envSecrets{getenv},
+		"file": fileSecrets{},
+	}
+	if store != nil {
+		providers["store"] = store
+	}
+	return &secretResolver{providers: providers}
+}
+
+// resolve replaces *ref with the secret it refers to and registers the
+// result for redaction.
+func (r *secretResolver) resolve(ref *string) error {
+	value := *ref
+	if kind, name, ok := strings.Cut(value, ":"); ok {
+		if provider, known := r.providers[kind]; known {
+			var err error
+			if value, err = provider.Lookup(name); err != nil {
+				return err
+			}
+		} else if kind == "store" {
+			return errors.New("no secret store configured")
+		}
+	}
+
+	registerSecret(value)
+	*ref = value
+	return nil
+}
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// registerSecret makes value subject to redaction from now on.
+func registerSecret(value string) {
+	if len(value) < minRedactLength {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, known := range secrets {
+		if known == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+	// replace longer secrets first so one containing another is fully
+	// hidden
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// redactSecrets hides every registered secret in text. It is applied to
+// all log output and chat messages.
+func redactSecrets(text string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	return text
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/stretchr/testify/require"
+)
+
+// useSecrets forgets every secret registered during the test.
+func useSecrets(t *testing.T) {
+	secretsMu.Lock()
+	saved := secrets
+	secrets = nil
+	secretsMu.Unlock()
+	t.Cleanup(func() {
+		secretsMu.Lock()
+		secrets = saved
+		secretsMu.Unlock()
+	})
+}
+
+func newTestStore(t *testing.T) *secretStore {
+	dir := t.TempDir()
+	key, err := newSecretKey()
+	require.Nil(t, err)
+	keyFile := filepath.Join(dir, "key")
+	require.Nil(t, os.WriteFile(keyFile, []byte(key+"\n"), 0o600))
+
+	store, err := openSecretStore(filepath.Join(dir, "secrets.enc"), keyFile)
+	require.Nil(t, err)
+	return store
+}
+
+func TestSecretStore(t *testing.T) {
+	store := newTestStore(t)
+
+	_, err := store.Lookup("hass")
+	require.EqualError(t, err, `secret "hass" not found in store`)
+
+	require.Nil(t, store.Set("hass", "storedToken123"))
+	require.Nil(t, store.Set("duckdns", "duckToken456"))
+	value, err := store.Lookup("hass")
+	require.Nil(t, err)
+	require.Equal(t, "storedToken123", value)
+
+	data, err := os.ReadFile(store.path)
+	require.Nil(t, err)
+	require.NotContains(t, string(data), "storedToken123")
+
+	other := newTestStore(t)
+	other.path = store.path
+	_, err = other.Lookup("hass")
+	require.EqualError(t, err, "could not decrypt secret store: wrong key or corrupt file")
+}
+
+func TestOpenSecretStoreErrors(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.Nil(t, os.WriteFile(keyFile, []byte("c2hvcnQ="), 0o600))
+
+	_, err := openSecretStore("secrets.enc", "")
+	require.EqualError(t, err, "secret store needs a key file")
+	_, err = openSecretStore("secrets.enc", "itdoesnotexist")
+	require.Contains(t, err.Error(), "could not read secret store key")
+	_, err = openSecretStore("secrets.enc", keyFile)
+	require.EqualError(t, err, "secret store key must be 32 bytes, base64-encoded")
+}
+
+func TestSecretResolver(t *testing.T) {
+	useSecrets(t)
+
+	secretFile := filepath.Join(t.TempDir(), "token")
+	require.Nil(t, os.WriteFile(secretFile, []byte("fileToken123\n"), 0o600))
+	store := newTestStore(t)
+	require.Nil(t, store.Set("hass", "storedToken123"))
+
+	resolver := newSecretResolver(fakeEnv(map[string]string{"TOKEN": "envToken123"}), store)
+	cases := []struct {
+		ref      string
+		expected string
+	}{
+		{"literalToken123", "literalToken123"},
+		{"env:TOKEN", "envToken123"},
+		{"file:" + secretFile, "fileToken123"},
+		{"store:hass", "storedToken123"},
+		{"other:value", "other:value"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		ref := c.ref
+		require.Nil(t, resolver.resolve(&ref))
+		require.Equal(t, c.expected, ref)
+	}
+	require.Equal(t, "[REDACTED] [REDACTED] [REDACTED] [REDACTED]", redactSecrets("literalToken123 envToken123 fileToken123 storedToken123"))
+
+	errorCases := []struct {
+		ref           string
+		expectedError string
+	}{
+		{"env:MISSING", "environment variable MISSING is not set"},
+		{"file:itdoesnotexist", "could not read secret file"},
+		{"store:missing", `secret "missing" not found in store`},
+	}
+	for _, c := range errorCases {
+		ref := c.ref
+		err := resolver.resolve(&ref)
+		require.NotNil(t, err, c.ref)
+		require.Contains(t, err.Error(), c.expectedError)
+	}
+
+	ref := "store:hass"
+	require.EqualError(t, newSecretResolver(fakeEnv(nil), nil).resolve(&ref), "no secret store configured")
+}
+
+func TestRedactSecrets(t *testing.T) {
+	useSecrets(t)
+
+	registerSecret("short")
+	registerSecret("token123")
+	registerSecret("token123456")
+	registerSecret("token123")
+
+	require.Len(t, secrets, 2)
+	require.Equal(t, "short [REDACTED] and [REDACTED]", redactSecrets("short token123456 and token123"))
+}
+
+func TestRedactOutput(t *testing.T) {
+	useSecrets(t)
+	registerSecret("leakyToken123")
+
+	fakeStdout := captureOutput(t, func() {
+		logger.Error("request failed", "error", "bad token leakyToken123")
+	})
+	require.Contains(t, fakeStdout, "bad token [REDACTED]")
+	require.NotContains(t, fakeStdout, "leakyToken123")
+
+	kbc := mocks.NewKeyBaseChat(t)
+	msg := createTextMessage("home get config")
+	kbc.On("SendReply", msg.Message.Channel, &msg.Message.Id, "token: [REDACTED]").Return(kbchat.SendResponse{}, nil)
+	require.Nil(t, reply(kbc, msg, "token: leakyToken123"))
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	useSecrets(t)
+
+	store := newTestStore(t)
+	require.Nil(t, store.Set("cabin", "cabinToken123"))
+	keyFile := filepath.Join(t.TempDir(), "key")
+	key, err := newSecretKey()
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(keyFile, []byte(key), 0o600))
+
+	config, err := loadConfig(writeConfig(t, `
+home_assistant:
+  token: env:HASS_TOKEN
+  instances:
+    cabin:
+      url: https://cabin.example:8123
+      token: store:cabin
+ddns:
+  - hostname: home.duckdns.org
+    backend: duckdns
+    token: env:DUCKDNS_TOKEN
+`), fakeEnv(map[string]string{
+		"HASS_TOKEN":       "homeToken123",
+		"DUCKDNS_TOKEN":    "duckToken123",
+		"SECRETS_STORE":    store.path,
+		"SECRETS_KEY_FILE": filepath.Join(filepath.Dir(store.path), "key"),
+	}))
+	require.Nil(t, err)
+	require.Equal(t, "homeToken123", config.hass[""].Token)
+	require.Equal(t, "cabinToken123", config.hass["cabin"].Token)
+	require.Equal(t, "duckToken123", config.DDNS[0].Token)
+	require.Equal(t, "[REDACTED] [REDACTED]", redactSecrets("homeToken123 cabinToken123"))
+
+	_, err = loadConfig(writeConfig(t, "home_assistant:\n  token: store:hass\n"), fakeEnv(map[string]string{
+		"SECRETS_STORE":    store.path,
+		"SECRETS_KEY_FILE": keyFile,
+	}))
+	require.Contains(t, err.Error(), "secrets: home_assistant token: could not decrypt secret store")
+}
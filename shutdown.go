@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const offlineNotice = "Going offline, see you soon."
+
+var (
+	// shutdownTimeout bounds how long in-flight commands may keep running
+	// once a shutdown has been requested.
+	shutdownTimeout = 10 * time.Second
+
+	// notifyChannels receive offlineNotice when the bot stops.
+	notifyChannels []chat1.ChatChannel
+
+	shutdownMu   sync.Mutex
+	shutdownFunc func()
+)
+
+func setShutdownFunc(f func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownFunc = f
+}
+
+// requestShutdown asks the running mainLoop to stop. It does nothing when
+// no loop is running.
+func requestShutdown() {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shutdownFunc != nil {
+		shutdownFunc()
+	}
+}
+
+// drain waits up to shutdownTimeout for in-flight commands tracked by
+// inflight, then aborts the outgoing requests still running, such as those
+// of commands past the deadline, and posts the offline notice.
+func drain(kbc KeyBaseChat, inflight *sync.WaitGroup) error {
+	logger.Info("shutting down", "timeout", shutdownTimeout)
+
+	drained := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-time.After(shutdownTimeout):
+		err = fmt.Errorf("in-flight commands still running after %s", shutdownTimeout)
+	}
+
+	cancelRequests()
+	notifyOffline(kbc)
+	return err
+}
+
+func notifyOffline(kbc KeyBaseChat) {
+	for _, channel := range snapshotConfig().notifyChannels {
+		if _, err := kbc.SendMessage(channel, offlineNotice); err != nil {
+			logger.Error("could not send offline notice", "channel", channel.Name, "error", err)
+		}
+	}
+}
+
+func shutdownCommand(kbc KeyBaseChat, msg kbchat.SubscriptionMessage, httpReq Requests, args []string) error {
+	err := reply(kbc, msg, "Shutting down.")
+	requestShutdown()
+	return err
+}
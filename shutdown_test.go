@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janikgar/keybase-go-bot/mocks"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChannel(t *testing.T) {
+	require.Equal(t, chat1.ChatChannel{Name: "family", MembersType: "team", TopicType: "chat", TopicName: "general"}, parseChannel("family#general"))
+	require.Equal(t, chat1.ChatChannel{Name: "alice,bob"}, parseChannel("alice,bob"))
+}
+
+func TestDrain(t *testing.T) {
+	useRequestCtx(t)
+	saved := shutdownTimeout
+	savedChannels := notifyChannels
+	t.Cleanup(func() {
+		shutdownTimeout = saved
+		notifyChannels = savedChannels
+	})
+
+	shutdownTimeout = time.Millisecond * 100
+	notifyChannels = []chat1.ChatChannel{parseChannel("family#general"), parseChannel("alice")}
+
+	kbc := mocks.NewKeyBaseChat(t)
+	kbc.On("SendMessage", notifyChannels[0], offlineNotice).Return(kbchat.SendResponse{}, nil)
+	kbc.On("SendMessage", notifyChannels[1], offlineNotice).Return(kbchat.SendResponse{}, errors.New("sendError"))
+
+	var inflight sync.WaitGroup
+	inflight.Add(1)
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		inflight.Done()
+	}()
+
+	fakeStdout := captureOutput(t, func() {
+		require.Nil(t, drain(kbc, &inflight))
+	})
+	require.Contains(t, fakeStdout, "could not send offline notice channel=alice error=sendError")
+
+	inflight.Add(1)
+	defer inflight.Done()
+	err := drain(kbc, &inflight)
+	require.EqualError(t, err, "in-flight commands still running after 100ms")
+
+	// requests of commands still running are aborted
+	require.Equal(t, context.Canceled, requestCtx.Err())
+}
+
+func TestRequestShutdownWithoutLoop(t *testing.T) {
+	require.NotPanics(t, requestShutdown)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	storageFile    = "file"
+	storageMemory  = "memory"
+	storageKeybase = "keybase"
+)
+
+// errNoEntry is returned by Storage.Get for a key that is not set or has
+// expired.
+var errNoEntry = errors.New("no such entry")
+
+// Storage keeps the bot's state across restarts as values under keys,
+// grouped in namespaces.
+type Storage interface {
+	// Get returns the value of key or errNoEntry.
+	Get(namespace string, key string) ([]byte, error)
+	// Put sets key to value; a positive ttl makes it expire.
+	Put(namespace string, key string, value []byte, ttl time.Duration) error
+	// Delete removes key, if set.
+	Delete(namespace string, key string) error
+	// List returns the keys set in namespace, sorted.
+	List(namespace string) ([]string, error)
+}
+
+// storageSettings selects the Storage backend. File may be on KBFS, such
+// as /keybase/team/home.bot/state.json, and Team is the team whose KV
+// store the keybase backend uses instead of the bot's own.
+type storageSettings struct {
+	Backend string `yaml:"backend"` // STATE_BACKEND
+	File    string `yaml:"file"`    // STATE_FILE
+	Team    string `yaml:"team"`    // STATE_TEAM
+}
+
+var (
+	stateStorage Storage = newMemoryStorage()
+
+	// stateSettings are the settings stateStorage was opened with, so a
+	// reload only reopens it when they change.
+	stateSettings = storageSettings{Backend: storageMemory}
+)
+
+// validate checks settings without opening anything.
+func (s storageSettings) validate() error {
+	switch s.Backend {
+	case storageMemory, storageKeybase:
+		return nil
+	case storageFile:
+		if s.File == "" {
+			return errors.New("the file backend needs a file")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown backend %q", s.Backend)
+}
+
+// openStorage opens the backend chosen by settings.
+func openStorage(settings storageSettings) (Storage, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	switch settings.Backend {
+	case storageMemory:
+		return newMemoryStorage(), nil
+	case storageFile:
+		return openFileStorage(settings.File)
+	}
+	return newKeybaseStorage(settings.Team), nil
+}
+
+type storageEntry struct {
+	Value   []byte     `json:"value"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (e storageEntry) expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
+}
+
+// localStorage keeps entries in memory and, when path is set, saves them
+// to a JSON file after every change.
+type localStorage struct {
+	mu   sync.Mutex
+	path string
+	now  func() time.Time
+	data map[string]map[string]storageEntry
+}
+
+func newMemoryStorage() *localStorage {
+	return &localStorage{now: time.Now, data: make(map[string]map[string]storageEntry)}
+}
+
+func openFileStorage(path string) (*localStorage, error) {
+	s := newMemoryStorage()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file: %s", err.Error())
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return nil, fmt.Errorf("could not parse state file: %s", err.Error())
+	}
+	if s.data == nil {
+		s.data = make(map[string]map[string]storageEntry)
+	}
+	return s, nil
+}
+
+func (s *localStorage) Get(namespace string, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.data[namespace][key]
+	if !ok || entry.expired(s.now()) {
+		return nil, errNoEntry
+	}
+	return append([]byte(nil), entry.Value...), nil
+}
+
+func (s *localStorage) Put(namespace string, key string, value []byte, ttl time.Duration) error {
+	entry := storageEntry{Value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		expires := s.now().Add(ttl)
+		entry.Expires = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(namespace, key, &entry)
+}
+
+func (s *localStorage) Delete(namespace string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[namespace][key]; !ok {
+		return nil
+	}
+	return s.update(namespace, key, nil)
+}
+
+func (s *localStorage) List(namespace string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	keys := []string{}
+	for key, entry := range s.data[namespace] {
+		if !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// update sets key to entry, or removes it when entry is nil, and saves.
+// The change is undone if it cannot be saved. Callers hold s.mu.
+func (s *localStorage) update(namespace string, key string, entry *storageEntry) error {
+	entries := s.data[namespace]
+	if entries == nil {
+		entries = make(map[string]storageEntry)
+		s.data[namespace] = entries
+	}
+	previous, existed := entries[key]
+	if entry != nil {
+		entries[key] = *entry
+	} else {
+		delete(entries, key)
+	}
+
+	if err := s.save(); err != nil {
+		if existed {
+			entries[key] = previous
+		} else {
+			delete(entries, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// save drops expired entries and writes the rest to the file. Callers
+// hold s.mu.
+func (s *localStorage) save() error {
+	now := s.now()
+	for namespace, entries := range s.data {
+		for key, entry := range entries {
+			if entry.expired(now) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(s.data, namespace)
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("could not save state: %s", err.Error())
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// getJson decodes the value of key into v. It returns false when key is
+// not set.
+func getJson(s Storage, namespace string, key string, v any) (bool, error) {
+	data, err := s.Get(namespace, key)
+	if errors.Is(err, errNoEntry) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("could not decode %s/%s: %s", namespace, key, err.Error())
+	}
+	return true, nil
+}
+
+func putJson(s Storage, namespace string, key string, v any, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(namespace, key, data, ttl)
+}
+
+// prefsNamespace holds per-user preferences under "<user>/<name>".
+const prefsNamespace = "prefs"
+
+// userPref returns the preference name of user, or "" if it is not set.
+func userPref(s Storage, user string, name string) (string, error) {
+	value, err := s.Get(prefsNamespace, user+"/"+name)
+	if errors.Is(err, errNoEntry) {
+		return "", nil
+	}
+	return string(value), err
+}
+
+func setUserPref(s Storage, user string, name string, value string) error {
+	return s.Put(prefsNamespace, user+"/"+name, []byte(value), 0)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// useStorage replaces stateStorage with an empty in-memory storage until
+// the test ends.
+func useStorage(t *testing.T) *localStorage {
+	saved := stateStorage
+	t.Cleanup(func() { stateStorage = saved })
+	storage := newMemoryStorage()
+	stateStorage = storage
+	return storage
+}
+
+// testStorage runs the checks every Storage backend has to pass. advance
+// moves the backend's clock forward.
+func testStorage(t *testing.T, s Storage, advance func(time.Duration)) {
+	_, err := s.Get("prefs", "janik/timezone")
+	require.Equal(t, errNoEntry, err)
+
+	require.Nil(t, s.Put("prefs", "janik/timezone", []byte("Europe/Berlin"), 0))
+	require.Nil(t, s.Put("prefs", "alice/timezone", []byte("UTC"), 0))
+	require.Nil(t, s.Put("ip", "last", []byte(`{"V4":"203.0.113.7"}`), 0))
+	require.Nil(t, s.Put("prefs", "bob/timezone", []byte("Asia/Tokyo"), time.Minute))
+
+	value, err := s.Get("prefs", "janik/timezone")
+	require.Nil(t, err)
+	require.Equal(t, "Europe/Berlin", string(value))
+	keys, err := s.List("prefs")
+	require.Nil(t, err)
+	require.Equal(t, []string{"alice/timezone", "bob/timezone", "janik/timezone"}, keys)
+
+	advance(time.Minute)
+	_, err = s.Get("prefs", "bob/timezone")
+	require.Equal(t, errNoEntry, err)
+	keys, err = s.List("prefs")
+	require.Nil(t, err)
+	require.Equal(t, []string{"alice/timezone", "janik/timezone"}, keys)
+
+	require.Nil(t, s.Put("prefs", "janik/timezone", []byte("UTC"), 0))
+	require.Nil(t, s.Delete("prefs", "alice/timezone"))
+	require.Nil(t, s.Delete("prefs", "nobody/timezone"))
+	keys, err = s.List("prefs")
+	require.Nil(t, err)
+	require.Equal(t, []string{"janik/timezone"}, keys)
+
+	keys, err = s.List("empty")
+	require.Nil(t, err)
+	require.Empty(t, keys)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := newMemoryStorage()
+	clk := newFakeClock(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	s.now = clk.Now
+	testStorage(t, s, clk.Advance)
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := openFileStorage(path)
+	require.Nil(t, err)
+	clk := newFakeClock(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	s.now = clk.Now
+	testStorage(t, s, clk.Advance)
+
+	reopened, err := openFileStorage(path)
+	require.Nil(t, err)
+	value, err := reopened.Get("prefs", "janik/timezone")
+	require.Nil(t, err)
+	require.Equal(t, "UTC", string(value))
+	value, err = reopened.Get("ip", "last")
+	require.Nil(t, err)
+	require.Equal(t, `{"V4":"203.0.113.7"}`, string(value))
+
+	// expired entries are dropped from the file
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.NotContains(t, string(data), "bob")
+}
+
+func TestFileStorageErrors(t *testing.T) {
+	_, err := openFileStorage(writeConfig(t, "{"))
+	require.Contains(t, err.Error(), "could not parse state file")
+
+	// a change that cannot be saved is undone
+	s, err := openFileStorage(filepath.Join(t.TempDir(), "missing", "state.json"))
+	require.Nil(t, err)
+	require.Contains(t, s.Put("prefs", "janik/timezone", []byte("UTC"), 0).Error(), "could not save state")
+	_, err = s.Get("prefs", "janik/timezone")
+	require.Equal(t, errNoEntry, err)
+}
+
+func TestJsonHelpers(t *testing.T) {
+	s := newMemoryStorage()
+	var ip publicIp
+	found, err := getJson(s, ipNamespace, "last", &ip)
+	require.Nil(t, err)
+	require.False(t, found)
+
+	require.Nil(t, putJson(s, ipNamespace, "last", publicIp{V4: "203.0.113.7"}, 0))
+	found, err = getJson(s, ipNamespace, "last", &ip)
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, publicIp{V4: "203.0.113.7"}, ip)
+
+	require.Nil(t, s.Put(ipNamespace, "broken", []byte("{"), 0))
+	_, err = getJson(s, ipNamespace, "broken", &ip)
+	require.Contains(t, err.Error(), "could not decode ip/broken")
+
+	pref, err := userPref(s, "janik", "timezone")
+	require.Nil(t, err)
+	require.Empty(t, pref)
+	require.Nil(t, setUserPref(s, "janik", "timezone", "Europe/Berlin"))
+	pref, err = userPref(s, "janik", "timezone")
+	require.Nil(t, err)
+	require.Equal(t, "Europe/Berlin", pref)
+}
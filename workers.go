@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+const busyReply = "I'm busy right now, try again in a moment."
+
+var (
+	workerCount = 4
+	queueDepth  = 16
+)
+
+// workerPool handles messages concurrently while keeping messages from the
+// same conversation in order: each conversation with pending messages has
+// its own queue, handled serially, and at most workers messages are
+// handled at once across all conversations.
+type workerPool struct {
+	handle func(kbchat.SubscriptionMessage)
+	depth  int
+	slots  chan struct{}
+
+	mu     sync.Mutex
+	queues map[string][]kbchat.SubscriptionMessage
+	queued int
+	closed bool
+
+	// wg tracks running conversation queues, so waiting on it drains the
+	// pool once it has been closed.
+	wg sync.WaitGroup
+}
+
+func newWorkerPool(workers int, depth int, handle func(kbchat.SubscriptionMessage)) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &workerPool{
+		handle: handle,
+		depth:  depth,
+		slots:  make(chan struct{}, workers),
+		queues: make(map[string][]kbchat.SubscriptionMessage),
+	}
+}
+
+// submit queues msg behind the other messages of its conversation. It
+// returns false without blocking when depth messages are already waiting
+// or the pool is closed.
+func (p *workerPool) submit(msg kbchat.SubscriptionMessage) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.queued >= p.depth {
+		return false
+	}
+	key := conversationKey(msg)
+	queue, running := p.queues[key]
+	p.queues[key] = append(queue, msg)
+	p.queued++
+	if !running {
+		p.wg.Add(1)
+		go p.work(key)
+	}
+	return true
+}
+
+// work handles the queue of conversation key until it is empty, taking a
+// worker slot for each message.
+func (p *workerPool) work(key string) {
+	defer p.wg.Done()
+	for {
+		p.slots <- struct{}{}
+		p.mu.Lock()
+		queue := p.queues[key]
+		if len(queue) == 0 {
+			delete(p.queues, key)
+			p.mu.Unlock()
+			<-p.slots
+			return
+		}
+		msg := queue[0]
+		p.queues[key] = queue[1:]
+		p.queued--
+		p.mu.Unlock()
+
+		p.handle(msg)
+		<-p.slots
+	}
+}
+
+// close stops accepting messages; the queues exit once they are empty.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+// conversationKey identifies the conversation a message belongs to.
+func conversationKey(msg kbchat.SubscriptionMessage) string {
+	if msg.Message.ConvID != "" {
+		return string(msg.Message.ConvID)
+	}
+	channel := msg.Message.Channel
+	return channel.Name + "#" + channel.TopicName
+}
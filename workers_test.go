@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func createConvMessage(conv string, body string) kbchat.SubscriptionMessage {
+	msg := createTextMessage(body)
+	msg.Message.ConvID = chat1.ConvIDStr(conv)
+	return msg
+}
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]string)
+
+	pool := newWorkerPool(4, 100, func(msg kbchat.SubscriptionMessage) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		conv := string(msg.Message.ConvID)
+		seen[conv] = append(seen[conv], msg.Message.Content.Text.Body)
+	})
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		expected = append(expected, fmt.Sprint(i))
+		for _, conv := range []string{"a", "b", "c"} {
+			require.True(t, pool.submit(createConvMessage(conv, fmt.Sprint(i))))
+		}
+	}
+
+	pool.close()
+	pool.wg.Wait()
+
+	for _, conv := range []string{"a", "b", "c"} {
+		require.Equal(t, expected, seen[conv], conv)
+	}
+}
+
+func TestWorkerPoolParallel(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 2)
+
+	pool := newWorkerPool(2, 1, func(msg kbchat.SubscriptionMessage) {
+		started <- string(msg.Message.ConvID)
+		<-release
+	})
+
+	// any other conversation runs while a worker is free
+	require.True(t, pool.submit(createConvMessage("conv-0", "slow")))
+	require.Equal(t, "conv-0", <-started)
+	require.True(t, pool.submit(createConvMessage("conv-1", "fast")))
+
+	select {
+	case conv := <-started:
+		require.Equal(t, "conv-1", conv)
+	case <-time.After(time.Second):
+		t.Fatal("conversations were not handled in parallel")
+	}
+
+	close(release)
+	pool.close()
+	pool.wg.Wait()
+}
+
+func TestWorkerPoolSaturated(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 2)
+
+	pool := newWorkerPool(1, 1, func(msg kbchat.SubscriptionMessage) {
+		started <- msg.Message.Content.Text.Body
+		<-release
+	})
+
+	require.True(t, pool.submit(createConvMessage("a", "running")))
+	require.Equal(t, "running", <-started)
+
+	// the depth is shared by every conversation
+	require.True(t, pool.submit(createConvMessage("b", "queued")))
+	require.False(t, pool.submit(createConvMessage("c", "rejected")))
+	require.False(t, pool.submit(createConvMessage("a", "rejected")))
+
+	release <- struct{}{}
+	require.Equal(t, "queued", <-started)
+	require.True(t, pool.submit(createConvMessage("c", "accepted")))
+
+	close(release)
+	pool.close()
+	pool.wg.Wait()
+	require.False(t, pool.submit(createConvMessage("a", "closed")))
+	require.Equal(t, "accepted", <-started)
+}
+
+func TestConversationKey(t *testing.T) {
+	require.Equal(t, "abc", conversationKey(createConvMessage("abc", "")))
+	require.Equal(t, "test#c", conversationKey(createTextMessage("")))
+}